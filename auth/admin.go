@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+const adminPageSize = 20
+
+var ErrAdminSelf = errors.New("you cannot do that to your own account")
+
+// adminUserRow is one line of the admin user list.
+type adminUserRow struct {
+	store.User
+	Self bool
+}
+
+// AdminPageHandler serves the admin console, which is open to users with the
+// admin flag. Its user pages also need the users:manage permission, which
+// SetUserAdmin grants through the admin role.
+func (s *Service) AdminPageHandler(c *gin.Context) {
+	data, err := s.adminUsersData(c, "", "")
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list users"})
+		return
+	}
+
+	lockouts, err := s.Throttler.Tracker.Lockouts(time.Now())
+	if err != nil {
+		log.Printf("Failed to list lockouts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list lockouts"})
+		return
+	}
+	data["Lockouts"] = lockouts
+
+	renderHTML(c, http.StatusOK, "admin.html", data)
+}
+
+func (s *Service) AdminUsersHandler(c *gin.Context) {
+	s.renderAdminUsers(c, "", "")
+}
+
+func (s *Service) AdminCreateUserHandler(c *gin.Context) {
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+
+	if err := store.ValidateUsername(username); err != nil {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+	if err := s.Hasher.ValidatePassword(password); err != nil {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+
+	userID, err := s.Users.CreateUser(c.Request.Context(), username, password)
+	if errors.Is(err, store.ErrUserExists) {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	if c.PostForm("admin") != "" {
+		if err := s.SetUserAdmin(c.Request.Context(), int(userID), true); err != nil {
+			log.Printf("Failed to make user %d an admin: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to make user an admin"})
+			return
+		}
+	}
+
+	s.renderAdminUsers(c, "", fmt.Sprintf("Created %s.", username))
+}
+
+// AdminResetPasswordHandler sets the password entered in the htmx prompt and
+// signs the user out everywhere.
+func (s *Service) AdminResetPasswordHandler(c *gin.Context) {
+	user, ok := s.adminTargetUser(c, false)
+	if !ok {
+		return
+	}
+
+	password := c.GetHeader("HX-Prompt")
+	if err := s.Hasher.ValidatePassword(password); err != nil {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+
+	if err := s.Users.UpdateUser(c.Request.Context(), user.ID, "", password); err != nil {
+		log.Printf("Failed to reset password for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if err := s.Sessions.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("Failed to revoke sessions for user %d: %v", user.ID, err)
+	}
+
+	s.renderAdminUsers(c, "", fmt.Sprintf("Reset the password of %s.", user.Username))
+}
+
+func (s *Service) AdminRenameUserHandler(c *gin.Context) {
+	user, ok := s.adminTargetUser(c, false)
+	if !ok {
+		return
+	}
+
+	username := c.GetHeader("HX-Prompt")
+	if err := store.ValidateUsername(username); err != nil {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+
+	err := s.Users.UpdateUser(c.Request.Context(), user.ID, username, "")
+	if errors.Is(err, store.ErrUserExists) {
+		s.renderAdminUsers(c, err.Error(), "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rename user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename user"})
+		return
+	}
+
+	s.renderAdminUsers(c, "", fmt.Sprintf("Renamed %s to %s.", user.Username, username))
+}
+
+func (s *Service) AdminDisableUserHandler(c *gin.Context) {
+	s.setAdminUserDisabled(c, true)
+}
+
+func (s *Service) AdminEnableUserHandler(c *gin.Context) {
+	s.setAdminUserDisabled(c, false)
+}
+
+func (s *Service) setAdminUserDisabled(c *gin.Context, disabled bool) {
+	user, ok := s.adminTargetUser(c, true)
+	if !ok {
+		return
+	}
+
+	if err := s.SetUserDisabled(c.Request.Context(), user.ID, disabled); err != nil {
+		log.Printf("Failed to update user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	action := "Enabled"
+	if disabled {
+		action = "Disabled"
+	}
+	s.renderAdminUsers(c, "", fmt.Sprintf("%s %s.", action, user.Username))
+}
+
+func (s *Service) AdminDeleteUserHandler(c *gin.Context) {
+	user, ok := s.adminTargetUser(c, true)
+	if !ok {
+		return
+	}
+
+	if err := s.DeleteUser(c.Request.Context(), user.ID); err != nil {
+		log.Printf("Failed to delete user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	s.renderAdminUsers(c, "", fmt.Sprintf("Deleted %s.", user.Username))
+}
+
+// AdminSetAdminHandler sets or clears the user's admin flag depending on the
+// admin form value.
+func (s *Service) AdminSetAdminHandler(c *gin.Context) {
+	user, ok := s.adminTargetUser(c, true)
+	if !ok {
+		return
+	}
+
+	admin := c.PostForm("admin") == "true"
+	message := fmt.Sprintf("%s is no longer an admin.", user.Username)
+	if admin {
+		message = fmt.Sprintf("%s is now an admin.", user.Username)
+	}
+	if err := s.SetUserAdmin(c.Request.Context(), user.ID, admin); err != nil {
+		log.Printf("Failed to update admin flag of user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	s.renderAdminUsers(c, "", message)
+}
+
+func (s *Service) AdminLockoutsHandler(c *gin.Context) {
+	s.renderAdminLockouts(c, "", "")
+}
+
+// AdminUnlockHandler lifts the lockout of the username in the form. Lockouts
+// are kept by the name that was typed at login, which need not belong to an
+// account, so it is not looked up.
+func (s *Service) AdminUnlockHandler(c *gin.Context) {
+	username := c.PostForm("username")
+
+	err := s.Throttler.UnlockAccount(username)
+	if errors.Is(err, ErrAccountNotLocked) {
+		s.renderAdminLockouts(c, err.Error(), "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to unlock %q: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock account"})
+		return
+	}
+
+	s.renderAdminLockouts(c, "", fmt.Sprintf("Unlocked %s.", username))
+}
+
+func (s *Service) renderAdminLockouts(c *gin.Context, errorMessage, message string) {
+	lockouts, err := s.Throttler.Tracker.Lockouts(time.Now())
+	if err != nil {
+		log.Printf("Failed to list lockouts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list lockouts"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "admin_lockouts.html", gin.H{
+		"Lockouts":     lockouts,
+		"ErrorMessage": errorMessage,
+		"Message":      message,
+	})
+}
+
+// adminTargetUser loads the user named by the :id parameter. With notSelf
+// set, the admin's own account is refused so they cannot lock themselves out.
+func (s *Service) adminTargetUser(c *gin.Context, notSelf bool) (*store.User, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	if notSelf && session.Values["user_id"] == id {
+		s.renderAdminUsers(c, ErrAdminSelf.Error(), "")
+		return nil, false
+	}
+
+	user, err := s.Users.ReadUser(c.Request.Context(), id)
+	if err == sql.ErrNoRows {
+		s.renderAdminUsers(c, "User not found", "")
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (s *Service) renderAdminUsers(c *gin.Context, errorMessage, message string) {
+	data, err := s.adminUsersData(c, errorMessage, message)
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list users"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "admin_users.html", data)
+}
+
+// adminUsersData lists the page of users selected by the q and page values,
+// which come from the query string on searches and from the form body (via
+// hx-include) on every other action.
+func (s *Service) adminUsersData(c *gin.Context, errorMessage, message string) (gin.H, error) {
+	search := c.Request.FormValue("q")
+	page, err := strconv.Atoi(c.Request.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := s.Users.ListUsers(c.Request.Context(), search, (page-1)*adminPageSize, adminPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	rows := make([]adminUserRow, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, adminUserRow{
+			User: user,
+			Self: session.Values["user_id"] == user.ID,
+		})
+	}
+
+	pages := (total + adminPageSize - 1) / adminPageSize
+	if pages == 0 {
+		pages = 1
+	}
+
+	return gin.H{
+		"Users":        rows,
+		"Query":        search,
+		"Page":         page,
+		"Pages":        pages,
+		"Total":        total,
+		"PrevPage":     page - 1,
+		"NextPage":     page + 1,
+		"HasPrev":      page > 1,
+		"HasNext":      page < pages,
+		"ErrorMessage": errorMessage,
+		"Message":      message,
+	}, nil
+}
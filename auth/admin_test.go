@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func TestDisabledUserCannotLogIn(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	ctx := context.Background()
+	userID, err := store.CreateUserIfNotExists(ctx, db, testHasher, "disableme", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	if _, err := s.LoginUser(httptest.NewRecorder(), r, "disableme", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	if err := s.SetUserDisabled(ctx, int(userID), true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	activeSessions, _ := s.Sessions.ListUserSessions(int(userID), "")
+	if len(activeSessions) != 0 {
+		t.Errorf("Expected disabling to revoke %d sessions", len(activeSessions))
+	}
+	if _, err := s.LoginUser(httptest.NewRecorder(), r, "disableme", "ValidP@ssw0rd"); err != store.ErrUserDisabled {
+		t.Errorf("Expected ErrUserDisabled, got %v", err)
+	}
+
+	if err := s.SetUserDisabled(ctx, int(userID), false); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if _, err := s.LoginUser(httptest.NewRecorder(), r, "disableme", "ValidP@ssw0rd"); err != nil {
+		t.Errorf("Expected re-enabled user to log in, got %v", err)
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+
+	ctx := context.Background()
+	adminID, err := store.CreateUserIfNotExists(ctx, db, testHasher, "root", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := s.SetUserAdmin(ctx, int(adminID), true); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+
+	const csrfToken = "test-csrf-token"
+	router := gin.New()
+	router.SetHTMLTemplate(web.Templates())
+	router.Use(func(c *gin.Context) {
+		session := sessions.NewSession(s.Sessions, "session-name")
+		session.Values["user_id"] = int(adminID)
+		session.Values[csrfSessionKey] = csrfToken
+		c.Set("session", session)
+		c.Next()
+	})
+	admin := router.Group("/admin", s.RequireAdmin(), s.RequireCSRF())
+	admin.GET("", s.AdminPageHandler)
+	admin.GET("/users", s.AdminUsersHandler)
+	admin.POST("/users", s.AdminCreateUserHandler)
+	admin.POST("/users/:id/rename", s.AdminRenameUserHandler)
+	admin.POST("/users/:id/password", s.AdminResetPasswordHandler)
+	admin.POST("/users/:id/admin", s.AdminSetAdminHandler)
+	admin.POST("/users/:id/disable", s.AdminDisableUserHandler)
+	admin.POST("/users/:id/delete", s.AdminDeleteUserHandler)
+	admin.POST("/lockouts/unlock", s.AdminUnlockHandler)
+
+	post := func(path string, form url.Values, prompt string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(CSRFHeader, csrfToken)
+		if prompt != "" {
+			req.Header.Set("HX-Prompt", prompt)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	now := time.Now()
+	if err := s.Throttler.Tracker.Lock("victim", now, now.Add(LockoutDuration)); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), csrfToken)
+	assert.Contains(t, w.Body.String(), "root &middot; admin")
+	assert.Contains(t, w.Body.String(), `name="username" value="victim"`)
+
+	w = post("/admin/lockouts/unlock", url.Values{"username": {"victim"}}, "")
+	assert.Contains(t, w.Body.String(), "Unlocked victim.")
+	assert.Contains(t, w.Body.String(), "No accounts are locked.")
+	if lockedUntil, _ := s.Throttler.Tracker.LockedUntil("victim"); !lockedUntil.IsZero() {
+		t.Errorf("Expected victim to be unlocked, locked until %v", lockedUntil)
+	}
+	w = post("/admin/lockouts/unlock", url.Values{"username": {"victim"}}, "")
+	assert.Contains(t, w.Body.String(), ErrAccountNotLocked.Error())
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/admin/users", strings.NewReader("username=nocsrf&password=ValidP%40ssw0rd"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = post("/admin/users", url.Values{"username": {"managed"}, "password": {"weak"}}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "login-error")
+
+	w = post("/admin/users", url.Values{"username": {"managed"}, "password": {"ValidP@ssw0rd"}}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Created managed.")
+
+	managed, err := store.GetUserByUsername(ctx, db, "managed")
+	if err != nil {
+		t.Fatalf("Expected managed to be created: %v", err)
+	}
+	base := fmt.Sprintf("/admin/users/%d", managed.ID)
+
+	w = post(base+"/rename", nil, "root")
+	assert.Contains(t, w.Body.String(), store.ErrUserExists.Error())
+	w = post(base+"/rename", nil, "renamed")
+	assert.Contains(t, w.Body.String(), "Renamed managed to renamed.")
+
+	w = post(base+"/password", nil, "N3wP@ssw0rd!")
+	assert.Contains(t, w.Body.String(), "Reset the password of renamed.")
+	user, _ := store.ReadUser(ctx, db, managed.ID)
+	if user.Username != "renamed" || !store.CheckPasswordHash("N3wP@ssw0rd!", user.PasswordHash) {
+		t.Errorf("Expected rename and password reset to be stored, got %+v", user)
+	}
+
+	post(base+"/admin", url.Values{"admin": {"true"}}, "")
+	user, _ = store.ReadUser(ctx, db, managed.ID)
+	assert.True(t, user.Admin)
+	grants, _ := store.LoadGrants(ctx, db, managed.ID)
+	assert.True(t, grants.HasRole(store.RoleAdmin))
+
+	post(base+"/admin", url.Values{"admin": {"false"}}, "")
+	user, _ = store.ReadUser(ctx, db, managed.ID)
+	assert.False(t, user.Admin)
+	grants, _ = store.LoadGrants(ctx, db, managed.ID)
+	assert.False(t, grants.HasRole(store.RoleAdmin))
+
+	post(base+"/disable", nil, "")
+	user, _ = store.ReadUser(ctx, db, managed.ID)
+	assert.True(t, user.Disabled)
+
+	w = post(fmt.Sprintf("/admin/users/%d/delete", adminID), nil, "")
+	assert.Contains(t, w.Body.String(), ErrAdminSelf.Error())
+
+	w = post(base+"/delete", nil, "")
+	assert.Contains(t, w.Body.String(), "Deleted renamed.")
+	if _, err := store.ReadUser(ctx, db, managed.ID); err == nil {
+		t.Errorf("Expected the user to be deleted")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/users?q=ro&page=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "page 1 of 1 &middot; 1 users")
+}
+
+func TestAdminConsoleRequiresAdminFlag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	ctx := context.Background()
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "operator", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	// The role alone carries the permissions, but not the flag.
+	if err := s.AssignRole(ctx, int(userID), store.RoleAdmin); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+
+	browser := newTestBrowser(router)
+	page := browser.get("/login")
+	browser.post("/login", page.Body.String(), url.Values{"username": {"operator"}, "password": {"ValidP@ssw0rd"}})
+
+	assert.Equal(t, http.StatusForbidden, browser.get("/admin").Code)
+	assert.NotContains(t, browser.get("/dashboard").Body.String(), `href="/admin"`)
+
+	if err := s.SetUserAdmin(ctx, int(userID), true); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, browser.get("/admin").Code)
+	assert.Equal(t, http.StatusOK, browser.get("/admin/users").Code)
+	assert.Contains(t, browser.get("/dashboard").Body.String(), `href="/admin"`)
+
+	if err := s.SetUserAdmin(ctx, int(userID), false); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+	assert.Equal(t, http.StatusForbidden, browser.get("/admin").Code)
+}
@@ -0,0 +1,392 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+// Scopes an API token can carry. read covers GET and HEAD requests, write
+// every other method, and admin lets the token use the owner's admin
+// permissions.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// APITokenScopes lists the scopes in the order the tokens page offers them.
+var APITokenScopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+const (
+	// apiTokenPrefix marks our tokens so they are easy to recognise in
+	// scripts and secret scanners.
+	apiTokenPrefix     = "pat_"
+	apiTokenContextKey = "api_token"
+	apiTokenMaxName    = 64
+	apiTokenMaxDays    = 3650
+
+	// APITokenTouchInterval is how stale last_used_at may get before a
+	// request through the token updates it.
+	APITokenTouchInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIToken  = errors.New("API token is invalid, expired or revoked")
+	ErrAPITokenNotFound = errors.New("API token not found")
+	ErrAPITokenName     = fmt.Errorf("token name must be between 1 and %d characters", apiTokenMaxName)
+	ErrAPITokenScopes   = errors.New("choose at least one of the read, write and admin scopes")
+	ErrAPITokenExpiry   = fmt.Errorf("token expiry must be between 0 (never) and %d days", apiTokenMaxDays)
+)
+
+// APIToken is a personal access token as the owner sees it. The secret itself
+// is only returned once, by CreateAPIToken.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero if the token never expires
+	LastUsedAt time.Time // zero if the token has not been used
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && !t.ExpiresAt.After(time.Now())
+}
+
+// CreateAPIToken issues a token for the user and returns its secret. Only a
+// SHA-256 hash of the secret is stored. A zero expiresAt means the token
+// never expires.
+func CreateAPIToken(ctx context.Context, db *sql.DB, userID int, name string, scopes []string, expiresAt, now time.Time) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > apiTokenMaxName {
+		return "", nil, ErrAPITokenName
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		return "", nil, err
+	}
+	secret = apiTokenPrefix + secret
+
+	var expires sql.NullInt64
+	if !expiresAt.IsZero() {
+		expires = sql.NullInt64{Int64: expiresAt.Unix(), Valid: true}
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, name, hashSecretToken(secret), strings.Join(scopes, " "), now.Unix(), expires)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := &APIToken{
+		ID:        int(id),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Unix(now.Unix(), 0),
+	}
+	if expires.Valid {
+		token.ExpiresAt = time.Unix(expires.Int64, 0)
+	}
+	return secret, token, nil
+}
+
+// normalizeScopes drops duplicates, puts scopes in APITokenScopes order and
+// rejects unknown ones.
+func normalizeScopes(scopes []string) ([]string, error) {
+	requested := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		requested[scope] = true
+	}
+
+	var normalized []string
+	for _, scope := range APITokenScopes {
+		if requested[scope] {
+			normalized = append(normalized, scope)
+			delete(requested, scope)
+		}
+	}
+	if len(normalized) == 0 || len(requested) > 0 {
+		return nil, ErrAPITokenScopes
+	}
+	return normalized, nil
+}
+
+const apiTokenColumns = "api_tokens.id, api_tokens.user_id, api_tokens.name, api_tokens.scopes, api_tokens.created_at, api_tokens.expires_at, api_tokens.last_used_at"
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*APIToken, error) {
+	var (
+		token             APIToken
+		scopes            string
+		createdAt         int64
+		expiresAt, usedAt sql.NullInt64
+	)
+	if err := row.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &createdAt, &expiresAt, &usedAt); err != nil {
+		return nil, err
+	}
+
+	token.Scopes = strings.Fields(scopes)
+	token.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt.Valid {
+		token.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	if usedAt.Valid {
+		token.LastUsedAt = time.Unix(usedAt.Int64, 0)
+	}
+	return &token, nil
+}
+
+// ListAPITokens returns the user's tokens, newest first, including expired
+// ones so the owner can see and clean them up.
+func ListAPITokens(ctx context.Context, db *sql.DB, userID int) ([]APIToken, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken deletes one of the user's tokens.
+func RevokeAPIToken(ctx context.Context, db *sql.DB, userID, id int) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPITokenNotFound
+	}
+
+	return nil
+}
+
+// LookupAPIToken resolves a secret to its token. Expired tokens and tokens of
+// users who are disabled or missing from users are rejected with
+// ErrInvalidAPIToken. last_used_at is updated at most once per
+// APITokenTouchInterval.
+func LookupAPIToken(ctx context.Context, db *sql.DB, users store.UserStore, secret string, now time.Time) (*APIToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	row := db.QueryRowContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens "+
+		"WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)",
+		hashSecretToken(secret), now.Unix())
+	token, err := scanAPIToken(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := users.ReadUser(ctx, token.UserID)
+	if err == sql.ErrNoRows || (err == nil && user.Disabled) {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if now.Sub(token.LastUsedAt) >= APITokenTouchInterval {
+		if _, err := db.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now.Unix(), token.ID); err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = time.Unix(now.Unix(), 0)
+	}
+
+	return token, nil
+}
+
+// bearerToken returns the credentials of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticateAPIToken is the bearer half of AuthMiddleware. It replaces the
+// request's session with an unsaved one holding the token owner's user_id, so
+// handlers behind AuthMiddleware need not care how the caller signed in.
+func (s *Service) authenticateAPIToken(c *gin.Context, secret string) {
+	token, err := LookupAPIToken(c.Request.Context(), s.DB, s.Users, secret, time.Now())
+	if errors.Is(err, ErrInvalidAPIToken) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid API token"})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API token"})
+		c.Abort()
+		return
+	}
+
+	scope := ScopeWrite
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		scope = ScopeRead
+	}
+	if !token.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: API token lacks the " + scope + " scope"})
+		c.Abort()
+		return
+	}
+
+	session := sessions.NewSession(s.Sessions, "session-name")
+	session.Values["user_id"] = token.UserID
+	c.Set("session", session)
+	c.Set(apiTokenContextKey, token)
+
+	c.Next()
+}
+
+// sessionOnly refuses requests made with an API token, so a token cannot be
+// used to mint itself broader scopes, revoke its siblings or change how the
+// account signs in.
+func sessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(apiTokenContextKey); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: this page needs a browser session, not an API token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Service) TokensPageHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	s.renderTokens(c, userID, gin.H{})
+}
+
+func (s *Service) CreateTokenHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	now := time.Now()
+	var expiresAt time.Time
+	days, err := strconv.Atoi(c.DefaultPostForm("expires_in_days", "0"))
+	if err != nil || days < 0 || days > apiTokenMaxDays {
+		s.renderTokens(c, userID, gin.H{"ErrorMessage": ErrAPITokenExpiry.Error()})
+		return
+	}
+	if days > 0 {
+		expiresAt = now.AddDate(0, 0, days)
+	}
+
+	secret, token, err := CreateAPIToken(c.Request.Context(), s.DB, userID, c.PostForm("name"), c.PostFormArray("scope"), expiresAt, now)
+	if errors.Is(err, ErrAPITokenName) || errors.Is(err, ErrAPITokenScopes) {
+		s.renderTokens(c, userID, gin.H{"ErrorMessage": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	s.renderTokens(c, userID, gin.H{"NewToken": secret, "NewTokenName": token.Name})
+}
+
+func (s *Service) RevokeTokenHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	err = RevokeAPIToken(c.Request.Context(), s.DB, userID, id)
+	if errors.Is(err, ErrAPITokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+
+	s.renderTokens(c, userID, gin.H{})
+}
+
+func (s *Service) renderTokens(c *gin.Context, userID int, data gin.H) {
+	tokens, err := ListAPITokens(c.Request.Context(), s.DB, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tokens"})
+		return
+	}
+
+	data["Tokens"] = tokens
+	data["Scopes"] = APITokenScopes
+	renderHTML(c, http.StatusOK, "tokens.html", data)
+}
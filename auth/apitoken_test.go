@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	s := newTestService(t, nil)
+	ctx := context.Background()
+	now := time.Now()
+
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "scripter", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	if _, _, err := CreateAPIToken(ctx, s.DB, int(userID), " ", []string{ScopeRead}, time.Time{}, now); err != ErrAPITokenName {
+		t.Errorf("Expected ErrAPITokenName, got %v", err)
+	}
+	if _, _, err := CreateAPIToken(ctx, s.DB, int(userID), "ci", nil, time.Time{}, now); err != ErrAPITokenScopes {
+		t.Errorf("Expected ErrAPITokenScopes for no scopes, got %v", err)
+	}
+	if _, _, err := CreateAPIToken(ctx, s.DB, int(userID), "ci", []string{ScopeRead, "root"}, time.Time{}, now); err != ErrAPITokenScopes {
+		t.Errorf("Expected ErrAPITokenScopes for an unknown scope, got %v", err)
+	}
+
+	secret, token, err := CreateAPIToken(ctx, s.DB, int(userID), "ci", []string{ScopeWrite, ScopeRead, ScopeRead}, time.Time{}, now)
+	if err != nil {
+		t.Fatalf("CreateAPIToken failed: %v", err)
+	}
+	assert.True(t, strings.HasPrefix(secret, apiTokenPrefix))
+	assert.Equal(t, []string{ScopeRead, ScopeWrite}, token.Scopes)
+
+	var stored string
+	if err := s.DB.QueryRow("SELECT token_hash FROM api_tokens WHERE id = ?", token.ID).Scan(&stored); err != nil {
+		t.Fatalf("Failed to read token hash: %v", err)
+	}
+	assert.NotContains(t, stored, secret)
+
+	found, err := LookupAPIToken(ctx, s.DB, s.Users, secret, now)
+	if err != nil {
+		t.Fatalf("LookupAPIToken failed: %v", err)
+	}
+	assert.Equal(t, int(userID), found.UserID)
+	assert.Equal(t, now.Unix(), found.LastUsedAt.Unix())
+
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, secret+"x", now); err != ErrInvalidAPIToken {
+		t.Errorf("Expected ErrInvalidAPIToken for a wrong secret, got %v", err)
+	}
+
+	expiring, _, err := CreateAPIToken(ctx, s.DB, int(userID), "short", []string{ScopeRead}, now.Add(time.Hour), now)
+	if err != nil {
+		t.Fatalf("CreateAPIToken failed: %v", err)
+	}
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, expiring, now.Add(2*time.Hour)); err != ErrInvalidAPIToken {
+		t.Errorf("Expected an expired token to be rejected, got %v", err)
+	}
+
+	tokens, err := ListAPITokens(ctx, s.DB, int(userID))
+	if err != nil {
+		t.Fatalf("ListAPITokens failed: %v", err)
+	}
+	assert.Len(t, tokens, 2)
+
+	if err := s.SetUserDisabled(ctx, int(userID), true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, secret, now); err != ErrInvalidAPIToken {
+		t.Errorf("Expected a disabled user's token to be rejected, got %v", err)
+	}
+	if err := s.SetUserDisabled(ctx, int(userID), false); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+
+	if err := RevokeAPIToken(ctx, s.DB, int(userID)+1, token.ID); err != ErrAPITokenNotFound {
+		t.Errorf("Expected another user to be unable to revoke the token, got %v", err)
+	}
+	if err := RevokeAPIToken(ctx, s.DB, int(userID), token.ID); err != nil {
+		t.Fatalf("RevokeAPIToken failed: %v", err)
+	}
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, secret, now); err != ErrInvalidAPIToken {
+		t.Errorf("Expected a revoked token to be rejected, got %v", err)
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	ctx := context.Background()
+	now := time.Now()
+
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "root", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := s.SetUserAdmin(ctx, int(userID), true); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+
+	issue := func(scopes ...string) string {
+		secret, _, err := CreateAPIToken(ctx, s.DB, int(userID), strings.Join(scopes, "+"), scopes, time.Time{}, now)
+		if err != nil {
+			t.Fatalf("CreateAPIToken failed: %v", err)
+		}
+		return secret
+	}
+	reader := issue(ScopeRead)
+	writer := issue(ScopeRead, ScopeWrite)
+	admin := issue(ScopeRead, ScopeAdmin)
+	adminWriter := issue(ScopeRead, ScopeWrite, ScopeAdmin)
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	call := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/dashboard", "").Code)
+	assert.Equal(t, http.StatusOK, call("GET", "/dashboard", reader).Code)
+
+	w := call("GET", "/dashboard", "pat_forged")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	assert.Equal(t, http.StatusForbidden, call("GET", "/admin", reader).Code)
+	assert.Equal(t, http.StatusOK, call("GET", "/admin", admin).Code)
+
+	// Bearer requests skip the CSRF check but still need the write scope.
+	assert.Equal(t, http.StatusForbidden, call("POST", "/admin/lockouts/unlock", writer).Code)
+	assert.Equal(t, http.StatusForbidden, call("POST", "/admin/lockouts/unlock", admin).Code)
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/lockouts/unlock", adminWriter).Code)
+
+	// Even a token with every scope cannot touch the account's security
+	// settings.
+	for _, route := range [][2]string{
+		{"GET", "/tokens"},
+		{"POST", "/tokens"},
+		{"GET", "/account/identities"},
+		{"GET", "/account/email"},
+		{"POST", "/account/email"},
+		{"GET", "/mfa/setup"},
+		{"POST", "/mfa/setup"},
+		{"GET", "/passkeys"},
+		{"POST", "/passkeys/1/delete"},
+		{"POST", "/webauthn/register/begin"},
+		{"POST", "/webauthn/register/finish"},
+		{"GET", "/sessions"},
+		{"POST", "/sessions/x/revoke"},
+		{"POST", "/sessions/revoke-others"},
+	} {
+		assert.Equal(t, http.StatusForbidden, call(route[0], route[1], adminWriter).Code, "%s %s", route[0], route[1])
+	}
+}
+
+func TestTokensPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	userID, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, "scripter", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	router := gin.New()
+	router.SetHTMLTemplate(web.Templates())
+	router.Use(func(c *gin.Context) {
+		session := sessions.NewSession(s.Sessions, "session-name")
+		session.Values["user_id"] = int(userID)
+		c.Set("session", session)
+		c.Next()
+	})
+	router.GET("/tokens", s.TokensPageHandler)
+	router.POST("/tokens", s.CreateTokenHandler)
+	router.POST("/tokens/:id/revoke", s.RevokeTokenHandler)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/tokens", url.Values{"name": {"backup"}, "scope": {"read"}, "expires_in_days": {"-1"}})
+	assert.Contains(t, w.Body.String(), ErrAPITokenExpiry.Error())
+
+	w = post("/tokens", url.Values{"name": {"backup"}, "scope": {"read"}, "expires_in_days": {"30"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	secret := regexp.MustCompile(`pat_[A-Za-z0-9_-]+`).FindString(w.Body.String())
+	if secret == "" {
+		t.Fatalf("Expected the new token to be shown")
+	}
+	assert.Contains(t, w.Body.String(), "expires "+time.Now().AddDate(0, 0, 30).Format("2006-01-02"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tokens", nil))
+	assert.Contains(t, w.Body.String(), "backup")
+	assert.NotContains(t, w.Body.String(), secret)
+
+	tokens, err := ListAPITokens(context.Background(), s.DB, int(userID))
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Expected one token, got %d (%v)", len(tokens), err)
+	}
+	w = post("/tokens/"+strconv.Itoa(tokens[0].ID)+"/revoke", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "No API tokens yet.")
+}
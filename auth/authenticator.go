@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"auth_module/store"
+)
+
+// ErrUnknownUser is returned by an Authenticator that has no account with
+// the given username.
+var ErrUnknownUser = errors.New("unknown user")
+
+// Authenticator checks a username and password against one source of
+// accounts and returns the local user they belong to. LoginUser asks the
+// service's Authenticators in order; an authenticator returns ErrUnknownUser
+// to pass the login on to the next one and ErrInvalidCredentials for a wrong
+// password, which ends it. Checks that apply to every login, such as
+// disabled accounts, MFA and email verification, are left to admitLogin.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*store.User, error)
+}
+
+// LocalAuthenticator checks passwords against the hashes in the user store.
+// Users shadowing a directory account, which db records, are left to the
+// directory.
+type LocalAuthenticator struct {
+	users  store.UserStore
+	db     *sql.DB
+	hasher *store.PasswordHasher
+}
+
+func NewLocalAuthenticator(users store.UserStore, db *sql.DB, hasher *store.PasswordHasher) *LocalAuthenticator {
+	return &LocalAuthenticator{users: users, db: db, hasher: hasher}
+}
+
+func (a *LocalAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	user, err := a.users.GetUserByUsername(ctx, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUnknownUser
+		}
+		return nil, err
+	}
+
+	directoryUser, err := isDirectoryUser(ctx, a.db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if directoryUser {
+		return nil, ErrUnknownUser
+	}
+
+	if !store.CheckPasswordHash(password, user.PasswordHash) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if a.hasher.NeedsRehash(user.PasswordHash) {
+		// The password is known to be correct here, so this is the only
+		// chance to move the stored hash to the current format and cost.
+		if err := a.users.UpdateUser(ctx, user.ID, "", password); err != nil {
+			log.Printf("Failed to rehash password for user %d: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// authenticate asks each of the service's authenticators in turn until one
+// knows the user.
+func (s *Service) authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	for _, authenticator := range s.Authenticators {
+		user, err := authenticator.Authenticate(ctx, username, password)
+		if !errors.Is(err, ErrUnknownUser) {
+			return user, err
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
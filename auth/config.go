@@ -0,0 +1,472 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"gopkg.in/yaml.v2"
+
+	"auth_module/store"
+)
+
+// Config is read from config.yaml. Every key can be overridden with an
+// environment variable named AUTH_ followed by the key's path in upper case,
+// e.g. AUTH_SESSION_SECRET_KEY or AUTH_DATABASE_PATH. Entries of maps that
+// are present in the file are addressed by their key, so the client secret
+// of oidc_providers.corp is AUTH_OIDC_PROVIDERS_CORP_CLIENT_SECRET. Appending
+// _FILE to the variable name reads the value from that file instead, which is
+// how Docker and Kubernetes hand out secrets.
+type Config struct {
+	ListenAddr       string        `yaml:"listen_addr"`
+	SessionSecretKey string        `yaml:"session_secret_key" secret:"true"`
+	SessionMaxAge    time.Duration `yaml:"session_max_age"`
+	CookieSecure     bool          `yaml:"cookie_secure"`
+	RegistrationMode string        `yaml:"registration_mode"`
+	WebAuthnRPID     string        `yaml:"webauthn_rp_id"`
+	WebAuthnOrigin   string        `yaml:"webauthn_origin"`
+	LoginThrottle    string        `yaml:"login_throttle_store"`
+	UserStore        string        `yaml:"user_store"`
+	PostgresDSN      string        `yaml:"postgres_dsn" secret:"true"`
+	BaseURL          string        `yaml:"base_url"`
+	Mailer           string        `yaml:"mailer"`
+	MailFrom         string        `yaml:"mail_from"`
+	MailDir          string        `yaml:"mail_dir"`
+	SMTPAddr         string        `yaml:"smtp_addr"`
+	SMTPUsername     string        `yaml:"smtp_username"`
+	SMTPPassword     string        `yaml:"smtp_password" secret:"true"`
+
+	RequireVerifiedEmail bool `yaml:"require_verified_email"`
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed. By default none are, and
+	// clients are known by the address they connect from.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	Database store.DatabaseConfig `yaml:"database"`
+	Argon2   store.Argon2Config   `yaml:"argon2"`
+	Password store.PasswordPolicy `yaml:"password"`
+	OIDC     OIDCConfig           `yaml:"oidc"`
+
+	// OIDCProviders are the external identity providers users can log in
+	// with, keyed by the name used in their URLs.
+	OIDCProviders map[string]OIDCProviderConfig `yaml:"oidc_providers"`
+
+	LDAP LDAPConfig `yaml:"ldap"`
+}
+
+const (
+	RegistrationOpen       = "open"
+	RegistrationInviteOnly = "invite"
+	RegistrationClosed     = "closed"
+)
+
+// Where user accounts are kept. Everything else stays in the SQLite
+// database; with postgres, its foreign keys to users must be off.
+const (
+	UserStoreSQLite   = "sqlite"
+	UserStorePostgres = "postgres"
+)
+
+const (
+	configEnvPrefix = "AUTH_"
+	redacted        = "REDACTED"
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// LoadConfig reads path, applies environment overrides and defaults, and
+// validates the result. A missing file is not an error as long as the
+// environment supplies everything required. All problems are reported
+// together rather than one per restart.
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	var config Config
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	errs := applyEnv(reflect.ValueOf(&config).Elem(), configEnvPrefix, lookupEnv)
+	config.applyDefaults()
+	errs = append(errs, config.validate()...)
+
+	return &config, errors.Join(errs...)
+}
+
+func (c *Config) applyDefaults() {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":8080"
+	}
+	if c.SessionMaxAge == 0 {
+		c.SessionMaxAge = 8 * time.Hour
+	}
+	if c.RegistrationMode == "" {
+		c.RegistrationMode = RegistrationClosed
+	}
+	if c.WebAuthnRPID == "" {
+		c.WebAuthnRPID = "localhost"
+	}
+	if c.WebAuthnOrigin == "" {
+		c.WebAuthnOrigin = "http://localhost:8080"
+	}
+	if c.LoginThrottle == "" {
+		c.LoginThrottle = ThrottleStoreMemory
+	}
+	if c.UserStore == "" {
+		c.UserStore = UserStoreSQLite
+	}
+	if c.UserStore == UserStorePostgres && c.Database.ForeignKeys == nil {
+		foreignKeys := false
+		c.Database.ForeignKeys = &foreignKeys
+	}
+	if c.BaseURL == "" {
+		c.BaseURL = "http://localhost:8080"
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	if c.Mailer == "" {
+		c.Mailer = MailerFile
+	}
+	if c.MailFrom == "" {
+		c.MailFrom = "no-reply@localhost"
+	}
+	if c.Mailer == MailerFile && c.MailDir == "" {
+		c.MailDir = "mail"
+	}
+	c.Argon2.ApplyDefaults()
+	c.Password.ApplyDefaults()
+	c.OIDC.applyDefaults()
+	if c.OIDCProviders != nil {
+		// The map may be shared with the config NewService was given.
+		providers := make(map[string]OIDCProviderConfig, len(c.OIDCProviders))
+		for name, provider := range c.OIDCProviders {
+			provider.applyDefaults(name)
+			providers[name] = provider
+		}
+		c.OIDCProviders = providers
+	}
+	c.LDAP.applyDefaults()
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen_addr: %v", err)
+	}
+	if c.SessionSecretKey == "" {
+		invalid("session_secret_key: must be set")
+	}
+	if c.SessionMaxAge < time.Second {
+		invalid("session_max_age: must be at least one second")
+	}
+
+	switch c.RegistrationMode {
+	case RegistrationOpen, RegistrationInviteOnly, RegistrationClosed:
+	default:
+		invalid("registration_mode: unknown mode %q", c.RegistrationMode)
+	}
+
+	switch c.LoginThrottle {
+	case ThrottleStoreMemory, ThrottleStoreSQLite:
+	default:
+		invalid("login_throttle_store: unknown store %q", c.LoginThrottle)
+	}
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		invalid("trusted_proxies: %v", err)
+	}
+
+	switch c.UserStore {
+	case UserStoreSQLite:
+	case UserStorePostgres:
+		if c.PostgresDSN == "" {
+			invalid("postgres_dsn: must be set when user_store is postgres")
+		}
+		if c.Database.ForeignKeys != nil && *c.Database.ForeignKeys {
+			invalid("database.foreign_keys: must be off when user_store is postgres")
+		}
+	default:
+		invalid("user_store: unknown store %q", c.UserStore)
+	}
+
+	for key, value := range map[string]string{"base_url": c.BaseURL, "webauthn_origin": c.WebAuthnOrigin} {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("%s: must be an absolute http or https URL", key)
+		}
+	}
+
+	switch c.Mailer {
+	case MailerFile, MailerMemory:
+	case MailerSMTP:
+		if c.SMTPAddr == "" {
+			invalid("smtp_addr: must be set when mailer is smtp")
+		} else if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			invalid("smtp_addr: %v", err)
+		}
+	default:
+		invalid("mailer: unknown mailer %q", c.Mailer)
+	}
+
+	if err := c.Database.ApplyDefaults(); err != nil {
+		invalid("database: %v", err)
+	}
+	if c.Database.BusyTimeout < 0 || c.Database.ConnMaxLifetime < 0 {
+		invalid("database: timeouts must not be negative")
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 {
+		invalid("database: connection limits must not be negative")
+	}
+
+	// argon2 needs at least 8 KiB of memory per thread.
+	if c.Argon2.Memory < 8*uint32(c.Argon2.Threads) {
+		invalid("argon2.memory: must be at least 8 KiB per thread")
+	}
+	// Hashes beyond the store's limits could not be verified.
+	if c.Argon2.Memory > store.MaxArgonMemory {
+		invalid("argon2.memory: must be at most %d KiB", store.MaxArgonMemory)
+	}
+	if c.Argon2.Time > store.MaxArgonTime {
+		invalid("argon2.time: must be at most %d", store.MaxArgonTime)
+	}
+	if c.Argon2.Threads > store.MaxArgonThreads {
+		invalid("argon2.threads: must be at most %d", store.MaxArgonThreads)
+	}
+
+	if c.Password.MinLength < 1 {
+		invalid("password.min_length: must be at least 1")
+	}
+	if c.Password.MaxLength != 0 && c.Password.MaxLength < c.Password.MinLength {
+		invalid("password.max_length: must be 0 or at least min_length")
+	}
+
+	if c.OIDC.SigningAlg != AlgRS256 && c.OIDC.SigningAlg != AlgES256 {
+		invalid("oidc.signing_alg: must be %s or %s", AlgRS256, AlgES256)
+	}
+	if c.OIDC.KeyOverlap < OIDCIDTokenTTL {
+		invalid("oidc.key_overlap: must be at least %v, the lifetime of an ID token", OIDCIDTokenTTL)
+	}
+	if c.OIDC.KeyRotation < 2*c.OIDC.KeyOverlap {
+		invalid("oidc.key_rotation: must be at least twice oidc.key_overlap")
+	}
+
+	for name, provider := range c.OIDCProviders {
+		if !providerNamePattern.MatchString(name) {
+			invalid("oidc_providers.%s: names may only contain lowercase letters, digits and dashes", name)
+		}
+		if name == ldapProvider {
+			invalid("oidc_providers.%s: the name is reserved for directory users", name)
+		}
+		if u, err := url.Parse(provider.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("oidc_providers.%s.issuer: must be an absolute http or https URL", name)
+		}
+		if provider.ClientID == "" {
+			invalid("oidc_providers.%s.client_id: must be set", name)
+		}
+		if !slices.Contains(provider.Scopes, ScopeOpenID) {
+			invalid("oidc_providers.%s.scopes: must include %s", name, ScopeOpenID)
+		}
+	}
+
+	if c.LDAP.URL != "" {
+		if u, err := url.Parse(c.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			invalid("ldap.url: must be an ldap or ldaps URL")
+		} else if c.LDAP.StartTLS && u.Scheme == "ldaps" {
+			invalid("ldap.start_tls: cannot be used with ldaps")
+		}
+		if _, err := ldap.ParseDN(c.LDAP.BaseDN); err != nil || c.LDAP.BaseDN == "" {
+			invalid("ldap.base_dn: must be a DN")
+		}
+		if strings.Count(c.LDAP.UserFilter, "%s") != 1 {
+			invalid("ldap.user_filter: must contain %%s once")
+		}
+		if c.LDAP.GroupFilter != "" && strings.Count(c.LDAP.GroupFilter, "%s") != 1 {
+			invalid("ldap.group_filter: must contain %%s once")
+		}
+		for group, role := range c.LDAP.GroupRoles {
+			if _, err := ldap.ParseDN(group); err != nil || role == "" {
+				invalid("ldap.group_roles: %q must be a DN mapped to a role", group)
+			}
+		}
+		if c.LDAP.Timeout < 0 {
+			invalid("ldap.timeout: must not be negative")
+		}
+	}
+
+	return errs
+}
+
+// applyEnv walks the struct v and overrides each field whose environment
+// variable is set, descending into nested structs with the key appended to
+// the prefix.
+func applyEnv(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) []error {
+	var errs []error
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(time.Duration(0)) {
+			errs = append(errs, applyEnv(field, name+"_", lookupEnv)...)
+			continue
+		}
+		if field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Struct {
+			// Map values are not addressable, so each entry is updated
+			// through a copy.
+			iter := field.MapRange()
+			for iter.Next() {
+				entry := reflect.New(field.Type().Elem()).Elem()
+				entry.Set(iter.Value())
+				entryName := name + "_" + strings.ToUpper(strings.ReplaceAll(iter.Key().String(), "-", "_")) + "_"
+				errs = append(errs, applyEnv(entry, entryName, lookupEnv)...)
+				field.SetMapIndex(iter.Key(), entry)
+			}
+			continue
+		}
+
+		value, ok := lookupEnv(name)
+		path, fromFile := lookupEnv(name + "_FILE")
+		if ok && fromFile {
+			errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", name, name))
+			continue
+		}
+		if fromFile {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %w", name, err))
+				continue
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setConfigField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errs
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setConfigField(ptr.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(strings.Fields(value)).Convert(field.Type()))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the config with every field tagged secret
+// replaced, so it can be printed or logged.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	redactSecrets(reflect.ValueOf(&copied).Elem())
+	return &copied
+}
+
+func redactSecrets(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			redactSecrets(field)
+		case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Struct && !field.IsNil():
+			// The copy Redacted made still shares the map, so build a new one.
+			copied := reflect.MakeMapWithSize(field.Type(), field.Len())
+			iter := field.MapRange()
+			for iter.Next() {
+				entry := reflect.New(field.Type().Elem()).Elem()
+				entry.Set(iter.Value())
+				redactSecrets(entry)
+				copied.SetMapIndex(iter.Key(), entry)
+			}
+			field.Set(copied)
+		case v.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "":
+			field.SetString(redacted)
+		}
+	}
+}
+
+// parseTrustedProxies turns the trusted_proxies entries, single addresses or
+// CIDR ranges, into prefixes.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR range", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
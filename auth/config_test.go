@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"auth_module/store"
+)
+
+func writeTestConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+session_secret_key: "from-file"
+registration_mode: open
+database:
+  path: ./other.db
+argon2:
+  memory: 32768
+password:
+  min_length: 12
+  require_special: false
+oidc_providers:
+  corp-sso:
+    issuer: https://login.corp.example/
+    client_id: auth-module
+`)
+
+	secretFile := filepath.Join(t.TempDir(), "smtp_password")
+	if err := os.WriteFile(secretFile, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+
+	config, err := LoadConfig(path, envMap(map[string]string{
+		"AUTH_SESSION_SECRET_KEY":    "from-env",
+		"AUTH_SESSION_MAX_AGE":       "30m",
+		"AUTH_COOKIE_SECURE":         "true",
+		"AUTH_DATABASE_BUSY_TIMEOUT": "2s",
+		"AUTH_SMTP_PASSWORD_FILE":    secretFile,
+
+		"AUTH_OIDC_PROVIDERS_CORP_SSO_CLIENT_SECRET": "corp-secret",
+		"AUTH_OIDC_PROVIDERS_CORP_SSO_SCOPES":        "openid email",
+	}))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if config.SessionSecretKey != "from-env" || config.SessionMaxAge != 30*time.Minute || !config.CookieSecure {
+		t.Errorf("Expected environment overrides to apply, got %+v", config)
+	}
+	if config.SMTPPassword != "hunter2" {
+		t.Errorf("Expected the secret to be read from the _FILE variable, got %q", config.SMTPPassword)
+	}
+	if config.Database.Path != "./other.db" || config.Database.BusyTimeout != 2*time.Second || config.Database.JournalMode != "WAL" {
+		t.Errorf("Unexpected database config: %+v", config.Database)
+	}
+	if config.Argon2.Memory != 32768 || config.Argon2.Time != store.ArgonTime {
+		t.Errorf("Unexpected argon2 config: %+v", config.Argon2)
+	}
+	if config.Password.MinLength != 12 || *config.Password.RequireSpecial || !*config.Password.RequireUpper {
+		t.Errorf("Unexpected password policy: %+v", config.Password)
+	}
+	if config.ListenAddr != ":8080" || config.RegistrationMode != RegistrationOpen || config.UserStore != UserStoreSQLite {
+		t.Errorf("Unexpected defaults: %+v", config)
+	}
+
+	corp := config.OIDCProviders["corp-sso"]
+	if corp.ClientSecret != "corp-secret" || strings.Join(corp.Scopes, " ") != "openid email" {
+		t.Errorf("Expected environment overrides of the provider to apply, got %+v", corp)
+	}
+	if corp.Issuer != "https://login.corp.example" || corp.DisplayName != "corp-sso" || corp.UsernameClaim != "preferred_username" {
+		t.Errorf("Unexpected provider defaults: %+v", corp)
+	}
+	if redacted := config.Redacted().OIDCProviders["corp-sso"].ClientSecret; redacted != "REDACTED" {
+		t.Errorf("Expected the provider's client secret to be redacted, got %q", redacted)
+	}
+	if config.OIDCProviders["corp-sso"].ClientSecret != "corp-secret" {
+		t.Errorf("Expected Redacted to leave the config alone")
+	}
+
+	path = writeTestConfig(t, "session_secret_key: x\nuser_store: postgres\npostgres_dsn: host=/run/postgresql\n")
+	config, err = LoadConfig(path, envMap(nil))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if *config.Database.ForeignKeys {
+		t.Errorf("Expected foreign keys to default to off with a postgres user store")
+	}
+	if config.Redacted().PostgresDSN != "REDACTED" {
+		t.Errorf("Expected the postgres DSN to be redacted")
+	}
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	path := writeTestConfig(t, `
+registration_mode: sometimes
+user_store: mysql
+trusted_proxies: [10.0.0.0/8, proxy.internal]
+mailer: smtp
+base_url: not-a-url
+argon2:
+  memory: 8
+  time: 100
+  threads: 4
+oidc:
+  signing_alg: HS256
+  key_overlap: 10m
+oidc_providers:
+  Corp:
+    issuer: login.corp.example
+    scopes: [email]
+ldap:
+  url: https://dc.corp.example
+  user_filter: (uid=x)
+  group_roles:
+    not a dn: admin
+`)
+
+	_, err := LoadConfig(path, envMap(map[string]string{"AUTH_COOKIE_SECURE": "maybe"}))
+	if err == nil {
+		t.Fatalf("Expected an invalid config to be rejected")
+	}
+
+	for _, want := range []string{"AUTH_COOKIE_SECURE", "session_secret_key", "registration_mode", "user_store", "trusted_proxies", "smtp_addr", "base_url", "argon2.memory", "argon2.time", "oidc.signing_alg", "oidc.key_overlap",
+		"oidc_providers.Corp: names", "oidc_providers.Corp.issuer", "oidc_providers.Corp.client_id", "oidc_providers.Corp.scopes",
+		"ldap.url", "ldap.base_dn", "ldap.user_filter", "ldap.group_roles"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error about %s, got:\n%v", want, err)
+		}
+	}
+
+	path = writeTestConfig(t, "session_secret_key: x\nuser_store: postgres\ndatabase:\n  foreign_keys: true\n")
+	_, err = LoadConfig(path, envMap(nil))
+	for _, want := range []string{"postgres_dsn", "database.foreign_keys"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error about %s, got: %v", want, err)
+		}
+	}
+
+	path = writeTestConfig(t, "session_secret_key: x\nsesion_max_age: 1h\n")
+	if _, err := LoadConfig(path, envMap(nil)); err == nil {
+		t.Errorf("Expected an unknown key to be rejected")
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *Config) {
+		config.BaseURL = "https://auth.example.com"
+	})
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("Expected the login page to start a session")
+	}
+	match := regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("Expected the login page to carry a CSRF token")
+	}
+	token := match[1]
+	assert.Contains(t, w.Body.String(), `hx-headers='{"X-CSRF-Token": "`+token+`"}'`)
+
+	// A failed login answers 401, so anything else means the middleware
+	// stopped the request first.
+	login := func(form url.Values, headers map[string]string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	credentials := url.Values{"username": {"nobody"}, "password": {"wrong"}}
+	withField := url.Values{"username": {"nobody"}, "password": {"wrong"}, CSRFFormField: {token}}
+
+	assert.Equal(t, http.StatusUnauthorized, login(credentials, map[string]string{CSRFHeader: token}))
+	assert.Equal(t, http.StatusUnauthorized, login(withField, nil))
+	assert.Equal(t, http.StatusForbidden, login(credentials, nil))
+	assert.Equal(t, http.StatusForbidden, login(credentials, map[string]string{CSRFHeader: "forged"}))
+	assert.Equal(t, http.StatusForbidden, login(credentials, map[string]string{CSRFHeader: "forged", "Origin": "https://auth.example.com"}))
+
+	assert.Equal(t, http.StatusUnauthorized, login(credentials, map[string]string{"Origin": "https://auth.example.com"}))
+	assert.Equal(t, http.StatusUnauthorized, login(credentials, map[string]string{"Referer": "https://auth.example.com/login"}))
+	assert.Equal(t, http.StatusForbidden, login(credentials, map[string]string{"Origin": "https://evil.example.com"}))
+	assert.Equal(t, http.StatusForbidden, login(credentials, map[string]string{"Origin": "https://evil.example.com", "Referer": "https://auth.example.com/login"}))
+	assert.Equal(t, http.StatusForbidden, login(credentials, map[string]string{"Origin": "null"}))
+}
+
+func TestLoginReplacesCSRFToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	ctx := context.Background()
+	if _, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "alice", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	mfaUserID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "mallory", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	secret, err := s.BeginTOTPEnrollment(int(mfaUserID))
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+	if _, err := s.ConfirmTOTPEnrollment(int(mfaUserID), GenerateTOTP(secret, time.Now())); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment failed: %v", err)
+	}
+
+	csrfToken := func(page string) string {
+		match := regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`).FindStringSubmatch(page)
+		if match == nil {
+			t.Fatalf("Expected the page to carry a CSRF token")
+		}
+		return match[1]
+	}
+	postWithToken := func(b *testBrowser, path, token string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(url.Values{CSRFFormField: {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return b.do(req).Code
+	}
+
+	t.Run("Password", func(t *testing.T) {
+		b := newTestBrowser(router)
+		page := b.get("/login").Body.String()
+		before := csrfToken(page)
+
+		w := b.post("/login", page, url.Values{"username": {"alice"}, "password": {"ValidP@ssw0rd"}})
+		assert.Equal(t, "/dashboard", w.Header().Get("HX-Redirect"))
+
+		assert.Equal(t, http.StatusForbidden, postWithToken(b, "/sessions/revoke-others", before))
+
+		after := csrfToken(b.get("/dashboard").Body.String())
+		assert.NotEqual(t, before, after)
+		assert.NotEqual(t, http.StatusForbidden, postWithToken(b, "/sessions/revoke-others", after))
+	})
+
+	t.Run("MFA", func(t *testing.T) {
+		b := newTestBrowser(router)
+		page := b.get("/login").Body.String()
+		before := csrfToken(page)
+
+		w := b.post("/login", page, url.Values{"username": {"mallory"}, "password": {"ValidP@ssw0rd"}})
+		assert.Equal(t, "/login/mfa", w.Header().Get("HX-Redirect"))
+
+		assert.Equal(t, http.StatusForbidden, postWithToken(b, "/login/mfa", before))
+
+		after := csrfToken(b.get("/login/mfa").Body.String())
+		assert.NotEqual(t, before, after)
+		assert.Equal(t, http.StatusOK, postWithToken(b, "/login/mfa", after))
+	})
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+const EmailVerificationTokenTTL = 24 * time.Hour
+
+var (
+	ErrEmailNotVerified         = errors.New("email address has not been verified")
+	ErrInvalidVerificationToken = errors.New("verification link is invalid or has expired")
+)
+
+// SendVerificationEmail mails a link that confirms the user's current email
+// address. The token is bound to that address, so changing the email before
+// the link is opened makes it useless.
+func (s *Service) SendVerificationEmail(ctx context.Context, userID int, now time.Time) error {
+	db := s.DB
+
+	user, err := s.Users.ReadUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || user.EmailVerified {
+		return nil
+	}
+
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verification_tokens WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO email_verification_tokens (token_hash, user_id, email, expires_at) VALUES (?, ?, ?, ?)",
+		tokenHash, userID, user.Email, now.Add(EmailVerificationTokenTTL).Unix())
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := s.Config.BaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return s.Mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Verify your nope.tools email address",
+		Body: fmt.Sprintf("Confirm that %s belongs to the account %s by opening this link within %d hours:\n\n%s\n\n"+
+			"If you did not add this address, you can ignore this email.\n",
+			user.Email, user.Username, int(EmailVerificationTokenTTL.Hours()), link),
+	})
+}
+
+// VerifyEmail consumes token and marks the address it was issued for as
+// verified in users.
+func VerifyEmail(ctx context.Context, db *sql.DB, users store.UserStore, token string, now time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRowContext(ctx, "DELETE FROM email_verification_tokens WHERE token_hash = ? AND expires_at > ? RETURNING user_id, email",
+		hashSecretToken(token), now.Unix()).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// users may share db, so the token is consumed before the address is
+	// marked rather than in one transaction with it.
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	verified, err := users.MarkEmailVerified(ctx, userID, email, now)
+	if err != nil {
+		return 0, err
+	}
+	if !verified {
+		return 0, ErrInvalidVerificationToken
+	}
+
+	return userID, nil
+}
+
+func (s *Service) VerifyEmailHandler(c *gin.Context) {
+	_, err := VerifyEmail(c.Request.Context(), s.DB, s.Users, c.Query("token"), time.Now())
+	if errors.Is(err, ErrInvalidVerificationToken) {
+		renderHTML(c, http.StatusOK, "verify_email.html", gin.H{"ErrorMessage": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email address"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "verify_email.html", gin.H{"Verified": true})
+}
+
+// ResendVerificationHandler lets users who cannot log in yet because
+// require_verified_email is set ask for a new link. Like the forgot password
+// form, it gives the same answer whether or not the account exists.
+func (s *Service) ResendVerificationHandler(c *gin.Context) {
+	username := c.PostForm("username")
+
+	user, err := s.Users.GetUserByUsername(c.Request.Context(), username)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if err == nil {
+		if err := s.SendVerificationEmail(c.Request.Context(), user.ID, time.Now()); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+			return
+		}
+	}
+
+	renderHTML(c, http.StatusOK, "verify_email.html", gin.H{"Sent": true})
+}
+
+func (s *Service) EmailPageHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	renderEmailSettings(c, s.Users, userID, "", "")
+}
+
+func (s *Service) UpdateEmailHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	email := store.NormalizeEmail(c.PostForm("email"))
+	if email != "" {
+		if err := store.ValidateEmail(email); err != nil {
+			renderEmailSettings(c, s.Users, userID, err.Error(), "")
+			return
+		}
+	}
+
+	err := s.Users.SetUserEmail(c.Request.Context(), userID, email)
+	if errors.Is(err, store.ErrEmailExists) {
+		renderEmailSettings(c, s.Users, userID, err.Error(), "")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email address"})
+		return
+	}
+
+	if email == "" {
+		renderEmailSettings(c, s.Users, userID, "", "Email address removed.")
+		return
+	}
+
+	if err := s.SendVerificationEmail(c.Request.Context(), userID, time.Now()); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+		renderEmailSettings(c, s.Users, userID, "Failed to send verification email", "")
+		return
+	}
+
+	renderEmailSettings(c, s.Users, userID, "", "Check your inbox for a verification link.")
+}
+
+func renderEmailSettings(c *gin.Context, users store.UserStore, userID int, errorMessage, message string) {
+	user, err := users.ReadUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "email.html", gin.H{
+		"Email":        user.Email,
+		"Verified":     user.EmailVerified,
+		"ErrorMessage": errorMessage,
+		"Message":      message,
+	})
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"auth_module/store"
+)
+
+func verificationTokenFromMessage(t *testing.T, s *Service, msg Message) string {
+	for _, field := range strings.Fields(msg.Body) {
+		if strings.HasPrefix(field, s.Config.BaseURL+"/verify-email?") {
+			link, err := url.Parse(field)
+			if err != nil {
+				t.Fatalf("Failed to parse verification link: %v", err)
+			}
+			return link.Query().Get("token")
+		}
+	}
+	t.Fatalf("No verification link in message: %q", msg.Body)
+	return ""
+}
+
+func TestEmailVerification(t *testing.T) {
+	s := newTestService(t, func(config *Config) {
+		config.RegistrationMode = RegistrationOpen
+		config.RequireVerifiedEmail = true
+	})
+	db := s.DB
+	m := s.Mailer.(*MemoryMailer)
+
+	username := "verifyme"
+	password := "ValidP@ssw0rd"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/register", nil)
+
+	if _, err := s.RegisterUser(w, r, username, password, "", ""); err != ErrEmailRequired {
+		t.Errorf("Expected ErrEmailRequired, got %v", err)
+	}
+
+	userID, err := s.RegisterUser(w, r, username, password, "verifyme@example.com", "")
+	if err != ErrEmailNotVerified {
+		t.Fatalf("Expected ErrEmailNotVerified after registration, got %v", err)
+	}
+	if len(m.Messages()) != 1 || m.Messages()[0].To != "verifyme@example.com" {
+		t.Fatalf("Expected one verification email, got %+v", m.Messages())
+	}
+	token := verificationTokenFromMessage(t, s, m.Messages()[0])
+
+	if _, err := s.LoginUser(w, r, username, password); err != ErrEmailNotVerified {
+		t.Errorf("Expected login to be blocked until verification, got %v", err)
+	}
+
+	if _, err := VerifyEmail(context.Background(), db, s.Users, token, time.Now().Add(EmailVerificationTokenTTL+time.Second)); err != ErrInvalidVerificationToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+
+	verifiedID, err := VerifyEmail(context.Background(), db, s.Users, token, time.Now())
+	if err != nil {
+		t.Fatalf("VerifyEmail failed: %v", err)
+	}
+	if verifiedID != userID {
+		t.Errorf("Expected user ID %d, got %d", userID, verifiedID)
+	}
+	if _, err := VerifyEmail(context.Background(), db, s.Users, token, time.Now()); err != ErrInvalidVerificationToken {
+		t.Errorf("Expected token to be single use, got %v", err)
+	}
+
+	if _, err := s.LoginUser(w, r, username, password); err != nil {
+		t.Errorf("LoginUser failed after verification: %v", err)
+	}
+
+	if err := store.SetUserEmail(context.Background(), db, userID, "changed@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	if _, err := s.LoginUser(w, r, username, password); err != ErrEmailNotVerified {
+		t.Errorf("Expected a changed address to need verification again, got %v", err)
+	}
+
+	if err := s.SendVerificationEmail(context.Background(), userID, time.Now()); err != nil {
+		t.Fatalf("SendVerificationEmail failed: %v", err)
+	}
+	staleToken := verificationTokenFromMessage(t, s, m.Messages()[1])
+	if err := store.SetUserEmail(context.Background(), db, userID, "again@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	if _, err := VerifyEmail(context.Background(), db, s.Users, staleToken, time.Now()); err != ErrInvalidVerificationToken {
+		t.Errorf("Expected a token for a previous address to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,559 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+const (
+	// externalLoginKey holds the state of a login at an external provider
+	// between leaving for the provider and coming back.
+	externalLoginKey = "external_login"
+	externalLoginTTL = 10 * time.Minute
+)
+
+var (
+	ErrExternalIdentityLinked   = errors.New("this identity is already linked to another account")
+	ErrExternalProviderLinked   = errors.New("another identity of this provider is already linked to your account")
+	ErrExternalIdentityNotFound = errors.New("external identity not found")
+)
+
+// ExternalIdentity is an account at an external provider that a user can log
+// in with.
+type ExternalIdentity struct {
+	Provider    string
+	Subject     string
+	UserID      int
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time // zero if the identity was linked but not used yet
+}
+
+// LinkExternalIdentity lets the user log in with the provider's account
+// subject from now on.
+func LinkExternalIdentity(ctx context.Context, db *sql.DB, userID int, provider, subject, email string, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var linkedTo int
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM external_identities WHERE provider = ? AND subject = ?", provider, subject).Scan(&linkedTo)
+	if err == nil {
+		if linkedTo != userID {
+			return ErrExternalIdentityLinked
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(1) FROM external_identities WHERE user_id = ? AND provider = ?", userID, provider).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrExternalProviderLinked
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO external_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		provider, subject, userID, email, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindExternalIdentity returns the user the provider's account subject is
+// linked to.
+func FindExternalIdentity(ctx context.Context, db *sql.DB, provider, subject string) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM external_identities WHERE provider = ? AND subject = ?", provider, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrExternalIdentityNotFound
+	}
+	return userID, err
+}
+
+func ListExternalIdentities(ctx context.Context, db *sql.DB, userID int) ([]ExternalIdentity, error) {
+	rows, err := db.QueryContext(ctx, "SELECT provider, subject, user_id, email, created_at, last_login_at FROM external_identities WHERE user_id = ? ORDER BY provider", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []ExternalIdentity
+	for rows.Next() {
+		var (
+			identity    ExternalIdentity
+			createdAt   int64
+			lastLoginAt sql.NullInt64
+		)
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &createdAt, &lastLoginAt); err != nil {
+			return nil, err
+		}
+		identity.CreatedAt = time.Unix(createdAt, 0)
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = time.Unix(lastLoginAt.Int64, 0)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// UnlinkExternalIdentity removes the user's link to the provider.
+func UnlinkExternalIdentity(ctx context.Context, db *sql.DB, userID int, provider string) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM external_identities WHERE user_id = ? AND provider = ?", userID, provider)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrExternalIdentityNotFound
+	}
+
+	return nil
+}
+
+func touchExternalIdentity(ctx context.Context, db *sql.DB, provider, subject, email string, now time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE external_identities SET last_login_at = ?, email = ? WHERE provider = ? AND subject = ?",
+		now.Unix(), email, provider, subject)
+	return err
+}
+
+// externalUsername derives a username that ValidateUsername accepts from the
+// claims, trying the configured claim, then the local part of the email
+// address, then the name.
+func externalUsername(claims *externalClaims, claim string) string {
+	email, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.stringClaim(claim), email, claims.Name} {
+		if username := localUsername(candidate); username != "" {
+			return username
+		}
+	}
+	return "user"
+}
+
+// localUsername turns name into one that ValidateUsername accepts: dots,
+// dashes and spaces become underscores, other characters are dropped, and
+// the result is padded or cut to fit. It returns "" if name has no letter to
+// start with.
+func localUsername(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9', r == '_':
+			if b.Len() > 0 {
+				b.WriteRune(r)
+			}
+		case r == '.' || r == '-' || r == ' ':
+			if b.Len() > 0 {
+				b.WriteRune('_')
+			}
+		}
+	}
+
+	username := strings.TrimRight(b.String(), "_")
+	if len(username) > 24 {
+		username = strings.TrimRight(username[:24], "_")
+	}
+	if username == "" {
+		return ""
+	}
+	for len(username) < 4 {
+		username += "_"
+	}
+	return username
+}
+
+// createNumberedUser creates a user without a password named base, or
+// base2, base3 and so on if that name is taken.
+func createNumberedUser(ctx context.Context, users store.UserStore, base string) (int64, error) {
+	username := base
+	for n := 2; ; n++ {
+		userID, err := users.CreateUserWithoutPassword(ctx, username)
+		if !errors.Is(err, store.ErrUserExists) || n > 1000 {
+			return userID, err
+		}
+		suffix := fmt.Sprintf("%d", n)
+		username = base
+		if len(username)+len(suffix) > 24 {
+			username = username[:24-len(suffix)]
+		}
+		username += suffix
+	}
+}
+
+// setVerifiedEmail gives the user an address that an identity provider or
+// the directory vouches for, unless another account uses it.
+func setVerifiedEmail(ctx context.Context, users store.UserStore, userID int, email string, now time.Time) {
+	err := users.SetUserEmail(ctx, userID, email)
+	if err == nil {
+		_, err = users.MarkEmailVerified(ctx, userID, email, now)
+	}
+	if err != nil && !errors.Is(err, store.ErrEmailExists) {
+		log.Printf("Failed to set email of user %d: %v", userID, err)
+	}
+}
+
+// createExternalUser creates a user for someone logging in with an unlinked
+// identity, numbering the username if it is taken. The user has no
+// password; they can set one through a password reset.
+func (s *Service) createExternalUser(ctx context.Context, provider *oidcProvider, claims *externalClaims, now time.Time) (int, error) {
+	userID, err := createNumberedUser(ctx, s.Users, externalUsername(claims, provider.Config.UsernameClaim))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := LinkExternalIdentity(ctx, s.DB, int(userID), provider.Name, claims.Subject, claims.Email, now); err != nil {
+		if deleteErr := s.Users.DeleteUser(ctx, int(userID)); deleteErr != nil {
+			return 0, deleteErr
+		}
+		return 0, err
+	}
+
+	// Take over the address only if the provider verified it and no other
+	// account uses it.
+	if email := claims.verifiedEmail(); email != "" {
+		setVerifiedEmail(ctx, s.Users, int(userID), email, now)
+	}
+
+	return int(userID), nil
+}
+
+// externalLogin is what we remember about a login at a provider while the
+// user is away.
+type externalLogin struct {
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	LinkUser  int    `json:"link_user,omitempty"`
+	StartedAt int64  `json:"started_at"`
+}
+
+// loginProvider is a provider as the login page lists it.
+type loginProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// loginProviders returns the configured providers sorted by name.
+func (s *Service) loginProviders() []loginProvider {
+	providers := make([]loginProvider, 0, len(s.providers))
+	for name, provider := range s.providers {
+		providers = append(providers, loginProvider{Name: name, DisplayName: provider.Config.DisplayName})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+	return providers
+}
+
+// renderLogin shows the login page, with errorMessage if it is not empty.
+func (s *Service) renderLogin(c *gin.Context, code int, errorMessage string) {
+	renderHTML(c, code, "login.html", gin.H{
+		"RegistrationOpen": s.Config.RegistrationMode != RegistrationClosed,
+		"Providers":        s.loginProviders(),
+		"ErrorMessage":     errorMessage,
+	})
+}
+
+func (s *Service) LoginPageHandler(c *gin.Context) {
+	s.renderLogin(c, http.StatusOK, "")
+}
+
+// startExternalLogin sends the browser to the provider's authorization
+// endpoint. linkUser is the signed-in user when the identity is to be linked
+// to their account rather than used to log in.
+func (s *Service) startExternalLogin(c *gin.Context, linkUser int) {
+	provider, ok := s.providers[c.Param("provider")]
+	if !ok {
+		s.renderLogin(c, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	now := time.Now()
+	metadata, err := provider.discover(c.Request.Context(), s.httpClient, now)
+	if err != nil {
+		log.Printf("External login failed: %v", err)
+		s.renderLogin(c, http.StatusBadGateway, fmt.Sprintf("%s is not reachable right now", provider.Config.DisplayName))
+		return
+	}
+
+	login := externalLogin{Provider: provider.Name, LinkUser: linkUser, StartedAt: now.Unix()}
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *value, _, err = newSecretToken(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+	}
+	encoded, err := json.Marshal(login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	session.Values[externalLoginKey] = string(encoded)
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	redirectWithParams(c, metadata.AuthorizationEndpoint, url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.Config.ClientID},
+		"redirect_uri":          {provider.redirectURI(s.Config.BaseURL)},
+		"scope":                 {strings.Join(provider.Config.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {pkceChallenge(login.Verifier)},
+		"code_challenge_method": {"S256"},
+	})
+}
+
+// ExternalLoginHandler starts logging in with the provider in the URL.
+func (s *Service) ExternalLoginHandler(c *gin.Context) {
+	s.startExternalLogin(c, 0)
+}
+
+// LinkIdentityHandler starts linking an identity at the provider in the URL
+// to the signed-in user.
+func (s *Service) LinkIdentityHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	s.startExternalLogin(c, userID)
+}
+
+// ExternalCallbackHandler is where providers send the browser back to. It
+// checks the state, redeems the code, verifies the ID token and then logs the
+// user in, creating or linking their account as configured.
+func (s *Service) ExternalCallbackHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	now := time.Now()
+	session := c.MustGet("session").(*sessions.Session)
+
+	// The state is single use, whatever happens next.
+	var login externalLogin
+	encoded, _ := session.Values[externalLoginKey].(string)
+	delete(session.Values, externalLoginKey)
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	state := c.Query("state")
+	if encoded == "" || json.Unmarshal([]byte(encoded), &login) != nil || login.Provider != c.Param("provider") ||
+		state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 ||
+		now.After(time.Unix(login.StartedAt, 0).Add(externalLoginTTL)) {
+		s.renderLogin(c, http.StatusBadRequest, "The login request is invalid or has expired. Please try again.")
+		return
+	}
+	provider := s.providers[login.Provider]
+	if provider == nil {
+		s.renderLogin(c, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	if errorCode := c.Query("error"); errorCode != "" {
+		log.Printf("Login at %s failed: %s %s", provider.Name, errorCode, c.Query("error_description"))
+		s.renderLogin(c, http.StatusUnauthorized, fmt.Sprintf("%s did not log you in", provider.Config.DisplayName))
+		return
+	}
+
+	claims, err := s.redeemExternalLogin(ctx, provider, &login, c.Query("code"), now)
+	if err != nil {
+		log.Printf("Login at %s failed: %v", provider.Name, err)
+		s.renderLogin(c, http.StatusUnauthorized, fmt.Sprintf("Logging in with %s failed", provider.Config.DisplayName))
+		return
+	}
+
+	s.finishExternalLogin(c, provider, &login, claims, now)
+}
+
+// redeemExternalLogin trades code for tokens and returns the claims of the
+// verified ID token.
+func (s *Service) redeemExternalLogin(ctx context.Context, provider *oidcProvider, login *externalLogin, code string, now time.Time) (*externalClaims, error) {
+	metadata, err := provider.discover(ctx, s.httpClient, now)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := provider.exchangeCode(ctx, s.httpClient, metadata, s.Config.BaseURL, code, login.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	return provider.verifyIDToken(ctx, s.httpClient, metadata, tokens, login.Nonce, now)
+}
+
+func (s *Service) finishExternalLogin(c *gin.Context, provider *oidcProvider, login *externalLogin, claims *externalClaims, now time.Time) {
+	ctx := c.Request.Context()
+	session := c.MustGet("session").(*sessions.Session)
+
+	if login.LinkUser != 0 {
+		if userID, ok := session.Values["user_id"].(int); !ok || userID != login.LinkUser {
+			s.renderLogin(c, http.StatusForbidden, "Log in again to link your account")
+			return
+		}
+
+		err := LinkExternalIdentity(ctx, s.DB, login.LinkUser, provider.Name, claims.Subject, claims.Email, now)
+		if errors.Is(err, ErrExternalIdentityLinked) || errors.Is(err, ErrExternalProviderLinked) {
+			s.renderIdentities(c, login.LinkUser, http.StatusConflict, gin.H{"ErrorMessage": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to link identity: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link identity"})
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/account/identities")
+		return
+	}
+
+	userID, err := FindExternalIdentity(ctx, s.DB, provider.Name, claims.Subject)
+	if errors.Is(err, ErrExternalIdentityNotFound) {
+		if !provider.Config.CreateUsers {
+			s.renderLogin(c, http.StatusForbidden, fmt.Sprintf("No account is linked to this %s identity. Log in with your password and link it from your account page.", provider.Config.DisplayName))
+			return
+		}
+		userID, err = s.createExternalUser(ctx, provider, claims, now)
+	}
+	if err != nil {
+		log.Printf("External login failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	user, err := s.Users.ReadUser(ctx, userID)
+	if err != nil {
+		log.Printf("External login failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	// The provider stands in for the password; a second factor set up here
+	// is still required.
+	err = s.admitLogin(c.Writer, c.Request, user, user.Username, true)
+	switch {
+	case errors.Is(err, store.ErrUserDisabled):
+		s.renderLogin(c, http.StatusForbidden, "Account disabled")
+		return
+	case errors.Is(err, ErrEmailNotVerified):
+		s.renderLogin(c, http.StatusForbidden, "Email address not verified")
+		return
+	case err != nil && !errors.Is(err, ErrMFARequired):
+		log.Printf("External login failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	if err := touchExternalIdentity(ctx, s.DB, provider.Name, claims.Subject, claims.Email, now); err != nil {
+		log.Printf("Failed to record login of identity: %v", err)
+	}
+
+	if errors.Is(err, ErrMFARequired) {
+		c.Redirect(http.StatusSeeOther, "/login/mfa")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, loginRedirect(c))
+}
+
+// identityRow is a configured provider on the linked accounts page.
+type identityRow struct {
+	loginProvider
+	Identity *ExternalIdentity
+}
+
+func (s *Service) renderIdentities(c *gin.Context, userID, code int, data gin.H) {
+	identities, err := ListExternalIdentities(c.Request.Context(), s.DB, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load linked accounts"})
+		return
+	}
+
+	var rows []identityRow
+	for _, provider := range s.loginProviders() {
+		row := identityRow{loginProvider: provider}
+		for i := range identities {
+			if identities[i].Provider == provider.Name {
+				row.Identity = &identities[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	data["Providers"] = rows
+	renderHTML(c, code, "identities.html", data)
+}
+
+func (s *Service) IdentitiesPageHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	s.renderIdentities(c, userID, http.StatusOK, gin.H{})
+}
+
+func (s *Service) UnlinkIdentityHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	// Only links to configured providers can be removed. The directory
+	// link in particular stays: without it, a directory user would count
+	// as local and could set a password of their own.
+	provider, ok := s.providers[c.Param("provider")]
+	if !ok {
+		s.renderIdentities(c, userID, http.StatusNotFound, gin.H{"ErrorMessage": "Unknown login provider"})
+		return
+	}
+
+	err := UnlinkExternalIdentity(c.Request.Context(), s.DB, userID, provider.Name)
+	if errors.Is(err, ErrExternalIdentityNotFound) {
+		s.renderIdentities(c, userID, http.StatusNotFound, gin.H{"ErrorMessage": "No account of this provider is linked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink account"})
+		return
+	}
+
+	s.renderIdentities(c, userID, http.StatusOK, gin.H{})
+}
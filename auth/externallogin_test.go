@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+// fakeIdP is an OpenID Connect provider serving discovery, its key set and a
+// token endpoint. Users are "authenticated" by approve, which stands in for
+// the provider's login page.
+type fakeIdP struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *ecdsa.PrivateKey
+	clientID string
+	secret   string
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	redirectURI string
+	challenge   string
+	claims      map[string]interface{}
+}
+
+func newFakeIdP(t *testing.T, clientID, secret string) *fakeIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	idp := &fakeIdP{t: t, key: key, clientID: clientID, secret: secret, codes: make(map[string]fakeGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := newJWK(&idp.key.PublicKey, AlgES256, "idp-key")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// approve plays the provider's side of the authorization request the
+// browser was sent to, logging in a user with claims. It returns the path of
+// the callback the browser is sent back to. Claims override the ones approve
+// would set, so a test can send a wrong nonce.
+func (idp *fakeIdP) approve(authorizeURL string, claims map[string]interface{}) string {
+	idp.t.Helper()
+
+	u, err := url.Parse(authorizeURL)
+	if err != nil || !strings.HasPrefix(authorizeURL, idp.server.URL+"/authorize?") {
+		idp.t.Fatalf("Expected a redirect to the authorization endpoint, got %q", authorizeURL)
+	}
+	query := u.Query()
+	assert.Equal(idp.t, "code", query.Get("response_type"))
+	assert.Equal(idp.t, idp.clientID, query.Get("client_id"))
+	assert.Equal(idp.t, "S256", query.Get("code_challenge_method"))
+	assert.Contains(idp.t, strings.Fields(query.Get("scope")), ScopeOpenID)
+
+	grantClaims := map[string]interface{}{"nonce": query.Get("nonce")}
+	for name, value := range claims {
+		grantClaims[name] = value
+	}
+	code, _, err := newSecretToken()
+	if err != nil {
+		idp.t.Fatalf("newSecretToken failed: %v", err)
+	}
+	idp.mu.Lock()
+	idp.codes[code] = fakeGrant{redirectURI: query.Get("redirect_uri"), challenge: query.Get("code_challenge"), claims: grantClaims}
+	idp.mu.Unlock()
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		idp.t.Fatalf("Invalid redirect URI %q", query.Get("redirect_uri"))
+	}
+	return callback.Path + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	clientID, secret, _ := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	secret, _ = url.QueryUnescape(secret)
+	if clientID != idp.clientID || secret != idp.secret {
+		fail("invalid_client")
+		return
+	}
+
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != grant.redirectURI ||
+		pkceChallenge(r.PostFormValue("code_verifier")) != grant.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	accessToken, _, _ := newSecretToken()
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":     idp.server.URL,
+		"aud":     idp.clientID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(time.Hour).Unix(),
+		"at_hash": tokenHash(accessToken),
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	idToken, err := signJWT(idp.key, AlgES256, "idp-key", claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": accessToken, "token_type": "Bearer", "id_token": idToken})
+}
+
+// login starts logging in with provider, has idp approve it with
+// claims and returns the response to the callback.
+func (idp *fakeIdP) login(browser *testBrowser, provider string, claims map[string]interface{}) *httptest.ResponseRecorder {
+	idp.t.Helper()
+
+	w := browser.get("/login/oidc/" + provider)
+	if w.Code != http.StatusSeeOther {
+		idp.t.Fatalf("Expected a redirect to the provider, got %d %s", w.Code, w.Body.String())
+	}
+	return browser.get(idp.approve(w.Header().Get("Location"), claims))
+}
+
+func TestExternalLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	idp := newFakeIdP(t, "auth-module", "idp-secret")
+	s := newTestService(t, func(config *Config) {
+		config.BaseURL = "https://id.example.com"
+		config.OIDCProviders = map[string]OIDCProviderConfig{
+			"corp":    {DisplayName: "Corp", Issuer: idp.server.URL, ClientID: "auth-module", ClientSecret: "idp-secret", CreateUsers: true},
+			"partner": {Issuer: idp.server.URL + "/", ClientID: "auth-module", ClientSecret: "idp-secret"},
+		}
+	})
+	ctx := context.Background()
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	w := newTestBrowser(router).get("/login")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href="/login/oidc/corp">Log in with Corp</a>`)
+	assert.Contains(t, w.Body.String(), `href="/login/oidc/partner">Log in with partner</a>`)
+
+	jane := map[string]interface{}{"sub": "jane-1", "preferred_username": "Jane.Doe", "email": "jane@corp.example", "email_verified": true}
+
+	t.Run("CreatesUser", func(t *testing.T) {
+		browser := newTestBrowser(router)
+		w := idp.login(browser, "corp", jane)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+		assert.Equal(t, http.StatusOK, browser.get("/dashboard").Code)
+
+		user, err := store.GetUserByUsername(ctx, s.DB, "jane_doe")
+		if err != nil {
+			t.Fatalf("Expected a user named after preferred_username: %v", err)
+		}
+		assert.Equal(t, "jane@corp.example", user.Email)
+		assert.True(t, user.EmailVerified)
+
+		// The same identity logs in to the same account.
+		w = idp.login(newTestBrowser(router), "corp", jane)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		userID, err := FindExternalIdentity(ctx, s.DB, "corp", "jane-1")
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, userID)
+		if _, err := store.GetUserByUsername(ctx, s.DB, "jane_doe2"); err == nil {
+			t.Errorf("Expected no second user for the same identity")
+		}
+
+		// Someone else with the same preferred username gets a numbered
+		// one.
+		w = idp.login(newTestBrowser(router), "corp", map[string]interface{}{"sub": "jane-2", "preferred_username": "jane_doe"})
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		if _, err := store.GetUserByUsername(ctx, s.DB, "jane_doe2"); err != nil {
+			t.Errorf("Expected a numbered username: %v", err)
+		}
+	})
+
+	t.Run("RejectsForgedResponses", func(t *testing.T) {
+		browser := newTestBrowser(router)
+		w := browser.get("/login/oidc/corp")
+		callback := idp.approve(w.Header().Get("Location"), jane)
+		forged := strings.Replace(callback, "state=", "state=x", 1)
+		assert.Equal(t, http.StatusBadRequest, browser.get(forged).Code)
+		// The state was used up by the failed attempt.
+		assert.Equal(t, http.StatusBadRequest, browser.get(callback).Code)
+		assert.NotEqual(t, http.StatusOK, browser.get("/dashboard").Code)
+
+		assert.Equal(t, http.StatusBadRequest, newTestBrowser(router).get(callback).Code)
+
+		withNonce := map[string]interface{}{"nonce": "replayed"}
+		for name, value := range jane {
+			withNonce[name] = value
+		}
+		w = idp.login(browser, "corp", withNonce)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotEqual(t, http.StatusOK, browser.get("/dashboard").Code)
+
+		assert.Equal(t, http.StatusNotFound, browser.get("/login/oidc/nope").Code)
+	})
+
+	t.Run("LinksIdentity", func(t *testing.T) {
+		userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "bobby", "ValidP@ssw0rd")
+		if err != nil {
+			t.Fatalf("CreateUserIfNotExists failed: %v", err)
+		}
+		bobAtPartner := map[string]interface{}{"sub": "bob-1", "preferred_username": "robert"}
+
+		// partner does not create users, so the identity has to be linked
+		// first.
+		w := idp.login(newTestBrowser(router), "partner", bobAtPartner)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "No account is linked")
+
+		browser := newTestBrowser(router)
+		w = browser.get("/login")
+		browser.post("/login", w.Body.String(), url.Values{"username": {"bobby"}, "password": {"ValidP@ssw0rd"}})
+		page := browser.get("/account/identities")
+		assert.Equal(t, http.StatusOK, page.Code)
+		assert.Contains(t, page.Body.String(), "not linked")
+
+		w = browser.post("/account/identities/partner/link", page.Body.String(), url.Values{})
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		w = browser.get(idp.approve(w.Header().Get("Location"), bobAtPartner))
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/account/identities", w.Header().Get("Location"))
+
+		// Jane's identity cannot be taken over.
+		page = browser.get("/account/identities")
+		w = browser.post("/account/identities/corp/link", page.Body.String(), url.Values{})
+		w = browser.get(idp.approve(w.Header().Get("Location"), jane))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "already linked to another account")
+
+		other := newTestBrowser(router)
+		w = idp.login(other, "partner", bobAtPartner)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, http.StatusOK, other.get("/dashboard").Code)
+		identities, err := ListExternalIdentities(ctx, s.DB, int(userID))
+		assert.NoError(t, err)
+		if assert.Len(t, identities, 1) {
+			assert.Equal(t, "partner", identities[0].Provider)
+			assert.False(t, identities[0].LastLoginAt.IsZero())
+		}
+
+		page = browser.get("/account/identities")
+		w = browser.post("/account/identities/partner/unlink", page.Body.String(), url.Values{})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "not linked")
+		_, err = FindExternalIdentity(ctx, s.DB, "partner", "bob-1")
+		assert.ErrorIs(t, err, ErrExternalIdentityNotFound)
+		w = browser.post("/account/identities/partner/unlink", page.Body.String(), url.Values{})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestExternalUsername(t *testing.T) {
+	tests := []struct {
+		claims map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"preferred_username": "Jane.Doe"}, "jane_doe"},
+		{map[string]interface{}{"preferred_username": "jd", "email": "x@corp.example"}, "jd__"},
+		{map[string]interface{}{"preferred_username": "42", "email": "j.doe+tag@corp.example"}, "j_doetag"},
+		{map[string]interface{}{"name": "Jane Q. Public-Doe"}, "jane_q__public_doe"},
+		{map[string]interface{}{"preferred_username": "a_very_long_username_from_the_idp"}, "a_very_long_username_fro"},
+		{map[string]interface{}{"name": "Ж"}, "user"},
+	}
+
+	for _, test := range tests {
+		data, _ := json.Marshal(test.claims)
+		var claims externalClaims
+		json.Unmarshal(data, &claims)
+		json.Unmarshal(data, &claims.raw)
+
+		got := externalUsername(&claims, "preferred_username")
+		assert.Equal(t, test.want, got, "claims %v", test.claims)
+		assert.NoError(t, store.ValidateUsername(got), "username %q", got)
+	}
+}
+
+func TestExternalLoginIgnoresPasswordPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	idp := newFakeIdP(t, "auth-module", "idp-secret")
+	s := newTestService(t, func(config *Config) {
+		config.BaseURL = "https://id.example.com"
+		config.OIDCProviders = map[string]OIDCProviderConfig{
+			"corp": {Issuer: idp.server.URL, ClientID: "auth-module", ClientSecret: "idp-secret", CreateUsers: true},
+		}
+		config.Password.MaxLength = 12
+	})
+	ctx := context.Background()
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	w := idp.login(newTestBrowser(router), "corp", map[string]interface{}{"sub": "kim-1", "preferred_username": "kim"})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+
+	user, err := s.Users.GetUserByUsername(ctx, "kim_")
+	if err != nil {
+		t.Fatalf("Expected a user for the new identity: %v", err)
+	}
+	assert.Equal(t, store.NoPasswordHash, user.PasswordHash)
+
+	// Without a password of its own the account is only reachable through
+	// the provider.
+	_, err = s.LoginUser(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), "kim_", "")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
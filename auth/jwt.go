@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// The JWS algorithms ID tokens are signed with. Both hash with SHA-256.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+var ErrInvalidJWT = errors.New("invalid JWT")
+
+// jwtHeader is the JOSE header of a compact JWS.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// signJWT returns claims as a compact JWS signed by key with alg, which must
+// match the key type.
+func signJWT(key crypto.Signer, alg, kid string, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case AlgRS256:
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case AlgES256:
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("%s needs an ECDSA key", alg)
+		}
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err == nil {
+			// JWS wants the fixed-size concatenation of r and s, not ASN.1.
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	default:
+		return "", fmt.Errorf("unsupported JWS algorithm %q", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseJWT verifies the signature of a compact JWS with the key keyFor
+// returns for its header and decodes the payload into claims. Checking the
+// claims themselves is up to the caller.
+func parseJWT(token string, keyFor func(jwtHeader) (crypto.PublicKey, error), claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidJWT
+	}
+
+	key, err := keyFor(header)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch header.Alg {
+	case AlgRS256:
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+		}
+	case AlgES256:
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(ecKey, digest[:], r, s)
+		}
+	}
+	if !valid {
+		return ErrInvalidJWT
+	}
+
+	return decodeJWTPart(parts[1], claims)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidJWT
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidJWT
+	}
+	return nil
+}
+
+// JWK is a public key as published in a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served by a JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newJWK(key crypto.PublicKey, alg, kid string) (JWK, error) {
+	jwk := JWK{Use: "sig", Alg: alg, Kid: kid}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JWK{}, errors.New("only P-256 ECDSA keys are supported")
+		}
+		point, err := key.ECDH()
+		if err != nil {
+			return JWK{}, err
+		}
+		// An uncompressed point is 0x04 followed by X and Y.
+		raw := point.Bytes()
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(raw[1:33])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(raw[33:])
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", key)
+	}
+	return jwk, nil
+}
+
+// PublicKey decodes the RSA or P-256 key the JWK describes.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 key")
+		}
+		// crypto/ecdh rejects points that are not on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+// Key returns the key in the set with the given ID.
+func (s *JWKSet) Key(kid string) (JWK, bool) {
+	for _, key := range s.Keys {
+		if key.Kid == kid {
+			return key, true
+		}
+	}
+	return JWK{}, false
+}
+
+// tokenHash is the at_hash of OpenID Connect Core 3.1.3.6 for the SHA-256
+// based algorithms: the left half of the token's hash, base64url encoded.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"auth_module/store"
+)
+
+// ldapProvider is the provider name directory users are linked under in
+// external_identities. OIDC providers cannot use it.
+const ldapProvider = "ldap"
+
+// LDAPConfig connects logins to an LDAP directory or Active Directory. A
+// user is looked up with the service account, then authenticated by binding
+// as them. The first login creates a local user shadowing the directory
+// entry, so sessions, MFA and roles work as for everyone else.
+type LDAPConfig struct {
+	// URL is ldap://host[:port] or ldaps://host[:port]. LDAP logins are
+	// off when it is empty.
+	URL      string `yaml:"url"`
+	StartTLS bool   `yaml:"start_tls"`
+	// CAFile is a PEM bundle to verify the server with instead of the
+	// system roots.
+	CAFile string `yaml:"ca_file"`
+
+	// BindDN and BindPassword are the account users are searched with.
+	// Without them the search is anonymous.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password" secret:"true"`
+
+	// BaseDN is searched with UserFilter, in which %s stands for the
+	// escaped username, e.g. (sAMAccountName=%s) for Active Directory.
+	BaseDN     string `yaml:"base_dn"`
+	UserFilter string `yaml:"user_filter"`
+	// IDAttribute identifies a user across renames, e.g. objectGUID for
+	// Active Directory. Entries without it are identified by their DN.
+	IDAttribute    string `yaml:"id_attribute"`
+	EmailAttribute string `yaml:"email_attribute"`
+
+	// GroupAttribute lists the DNs of the user's groups on the user entry,
+	// like memberOf. If GroupFilter is set, groups under GroupBaseDN
+	// matching it, with %s standing for the user's DN, are added too.
+	GroupAttribute string `yaml:"group_attribute"`
+	GroupBaseDN    string `yaml:"group_base_dn"`
+	GroupFilter    string `yaml:"group_filter"`
+	// GroupRoles maps group DNs to the role their members get. The roles
+	// named here are synchronized on every login; others are left to the
+	// admin pages.
+	GroupRoles map[string]string `yaml:"group_roles"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *LDAPConfig) applyDefaults() {
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.IDAttribute == "" {
+		c.IDAttribute = "entryUUID"
+	}
+	if c.EmailAttribute == "" {
+		c.EmailAttribute = "mail"
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "memberOf"
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+// groupRole is an entry of LDAPConfig.GroupRoles with the DN parsed for
+// comparison.
+type groupRole struct {
+	group *ldap.DN
+	role  string
+}
+
+// LDAPAuthenticator checks passwords by binding to the directory as the
+// user, and keeps a local user for each directory user that logs in.
+type LDAPAuthenticator struct {
+	config     LDAPConfig
+	tlsConfig  *tls.Config
+	groupRoles []groupRole
+
+	users  store.UserStore
+	db     *sql.DB
+	grants *store.GrantCache
+}
+
+// NewLDAPAuthenticator returns an authenticator for the directory config
+// describes, which must have passed Config validation. Shadow users are
+// created in users, linked to their entries in db, and their grants
+// invalidated in grants when roles change.
+func NewLDAPAuthenticator(config LDAPConfig, users store.UserStore, db *sql.DB, grants *store.GrantCache) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	a := &LDAPAuthenticator{
+		config:    config,
+		tlsConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		users:     users,
+		db:        db,
+		grants:    grants,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ldap.ca_file: %w", err)
+		}
+		a.tlsConfig.RootCAs = x509.NewCertPool()
+		if !a.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap.ca_file: no certificates in %s", config.CAFile)
+		}
+	}
+
+	for group, role := range config.GroupRoles {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			return nil, fmt.Errorf("ldap.group_roles: %w", err)
+		}
+		a.groupRoles = append(a.groupRoles, groupRole{group: dn, role: role})
+	}
+
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.Timeout)
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: bind as %s: %w", a.config.BindDN, err)
+		}
+	}
+
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := a.groups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty password would make the bind below an unauthenticated one,
+	// which servers accept without checking anything (RFC 4513 5.1.2).
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap: bind as %s: %w", entry.DN, err)
+	}
+
+	user, err := a.shadowUser(ctx, username, entry, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := a.syncRoles(ctx, user.ID, groups); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// findUser returns the directory entry of username, or ErrUnknownUser.
+func (a *LDAPAuthenticator) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.config.IDAttribute, a.config.EmailAttribute, a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil && (result == nil || !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded)) {
+		return nil, fmt.Errorf("ldap: search for %s: %w", username, err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("ldap: more than one entry matches %s", username)
+	}
+}
+
+// groups returns the DNs of the groups entry belongs to.
+func (a *LDAPAuthenticator) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	groups := entry.GetEqualFoldAttributeValues(a.config.GroupAttribute)
+	if a.config.GroupFilter == "" {
+		return groups, nil
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.config.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{"1.1"}, // no attributes, just the DNs
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: search for groups of %s: %w", entry.DN, err)
+	}
+	for _, group := range result.Entries {
+		groups = append(groups, group.DN)
+	}
+	return groups, nil
+}
+
+// subject identifies entry in external_identities.
+func (a *LDAPAuthenticator) subject(entry *ldap.Entry) string {
+	id := entry.GetEqualFoldRawAttributeValue(a.config.IDAttribute)
+	switch {
+	case len(id) == 0:
+		return entry.DN
+	case utf8.Valid(id):
+		return string(id)
+	default:
+		// Binary IDs such as objectGUID.
+		return hex.EncodeToString(id)
+	}
+}
+
+// shadowUser returns the local user of entry, creating it on the first login
+// and updating the email address from the directory. The local username is
+// derived from the login name, so it may differ from it: the directory
+// subject, not the name, ties the two together.
+func (a *LDAPAuthenticator) shadowUser(ctx context.Context, username string, entry *ldap.Entry, now time.Time) (*store.User, error) {
+	subject := a.subject(entry)
+	email := store.NormalizeEmail(entry.GetEqualFoldAttributeValue(a.config.EmailAttribute))
+
+	userID, err := FindExternalIdentity(ctx, a.db, ldapProvider, subject)
+	if errors.Is(err, ErrExternalIdentityNotFound) {
+		userID, err = a.createShadowUser(ctx, username, subject, email, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := touchExternalIdentity(ctx, a.db, ldapProvider, subject, email, now); err != nil {
+		log.Printf("Failed to record login of directory user %d: %v", userID, err)
+	}
+
+	user, err := a.users.ReadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if email != "" && email != user.Email {
+		setVerifiedEmail(ctx, a.users, userID, email, now)
+		return a.users.ReadUser(ctx, userID)
+	}
+	return user, nil
+}
+
+func (a *LDAPAuthenticator) createShadowUser(ctx context.Context, username, subject, email string, now time.Time) (int, error) {
+	// Directory names need not be valid local ones (john.doe, bob), and
+	// the cleaned-up name may be taken by a local user or by a directory
+	// account since renamed or deleted there, so it is numbered like the
+	// accounts of external logins.
+	base := localUsername(username)
+	if base == "" {
+		base = "user"
+	}
+	userID, err := createNumberedUser(ctx, a.users, base)
+	if err != nil {
+		return 0, fmt.Errorf("ldap: cannot create a local user for %s: %w", username, err)
+	}
+
+	if err := LinkExternalIdentity(ctx, a.db, int(userID), ldapProvider, subject, email, now); err != nil {
+		if deleteErr := a.users.DeleteUser(ctx, int(userID)); deleteErr != nil {
+			return 0, deleteErr
+		}
+		return 0, err
+	}
+
+	return int(userID), nil
+}
+
+// syncRoles gives the user the roles mapped from their groups and takes away
+// the mapped roles of groups they are not in. A group mapped to the admin
+// role makes its members admins.
+func (a *LDAPAuthenticator) syncRoles(ctx context.Context, userID int, groups []string) error {
+	if len(a.groupRoles) == 0 {
+		return nil
+	}
+
+	member := make(map[string]bool)
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			continue
+		}
+		for _, mapping := range a.groupRoles {
+			if mapping.group.EqualFold(dn) {
+				member[mapping.role] = true
+			}
+		}
+	}
+
+	for _, mapping := range a.groupRoles {
+		var err error
+		if member[mapping.role] {
+			err = store.AssignRole(ctx, a.db, userID, mapping.role)
+		} else {
+			err = store.UnassignRole(ctx, a.db, userID, mapping.role)
+		}
+		if errors.Is(err, store.ErrRoleNotFound) {
+			log.Printf("ldap.group_roles: role %q does not exist", mapping.role)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Like Service.SetUserAdmin, keep the flag that opens the admin
+		// console in step with the admin role.
+		if mapping.role == store.RoleAdmin {
+			if err := a.users.SetUserAdmin(ctx, userID, member[mapping.role]); err != nil {
+				return err
+			}
+		}
+	}
+	a.grants.Invalidate(userID)
+
+	return nil
+}
+
+// isDirectoryUser reports whether the user shadows a directory entry, whose
+// password only the directory knows.
+func isDirectoryUser(ctx context.Context, db *sql.DB, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT COUNT(1) FROM external_identities WHERE user_id = ? AND provider = ?", userID, ldapProvider).Scan(&exists)
+	return exists, err
+}
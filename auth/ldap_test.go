@@ -0,0 +1,405 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+// testDirectory is an in-process LDAP server holding entries. It supports
+// simple binds with the userPassword attribute and subtree searches with
+// equality, presence, and, or and not filters, which is all
+// LDAPAuthenticator needs.
+type testDirectory struct {
+	URL string
+
+	mu      sync.Mutex
+	entries map[string]map[string][]string // by DN
+}
+
+func startTestDirectory(t *testing.T) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	d := &testDirectory{URL: "ldap://" + addr, entries: make(map[string]map[string][]string)}
+
+	mux, err := gldap.NewMux()
+	if err != nil {
+		t.Fatalf("NewMux failed: %v", err)
+	}
+	mux.Bind(d.bind)
+	mux.Search(d.search)
+	server, err := gldap.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	server.Router(mux)
+	go server.Run(addr)
+	t.Cleanup(func() { server.Stop() })
+
+	for deadline := time.Now().Add(5 * time.Second); !server.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Test directory did not start")
+		}
+	}
+	return d
+}
+
+func (d *testDirectory) set(dn string, attributes map[string][]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[dn] = attributes
+}
+
+func (d *testDirectory) remove(dn string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, dn)
+}
+
+func (d *testDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if entry, ok := d.entries[m.UserName]; ok && len(m.Password) > 0 && string(m.Password) == first(entry["userPassword"]) {
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (d *testDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(resp)
+
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		resp.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for dn, attributes := range d.entries {
+		if !strings.HasSuffix(strings.ToLower(dn), ","+strings.ToLower(m.BaseDN)) || !matchTestFilter(m.Filter, attributes) {
+			continue
+		}
+		returned := make(map[string][]string)
+		for name, values := range attributes {
+			if name != "userPassword" {
+				returned[name] = values
+			}
+		}
+		w.Write(r.NewSearchResponseEntry(dn, gldap.WithAttributes(returned)))
+	}
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// matchTestFilter evaluates a filter in its string form against an entry.
+func matchTestFilter(filter string, attributes map[string][]string) bool {
+	inner := strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")")
+	if inner == "" {
+		return false
+	}
+
+	switch inner[0] {
+	case '&', '|', '!':
+		var children []string
+		depth, start := 0, 0
+		for i, c := range inner[1:] {
+			switch c {
+			case '(':
+				if depth == 0 {
+					start = i + 1
+				}
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					children = append(children, inner[start:i+2])
+				}
+			}
+		}
+		switch inner[0] {
+		case '!':
+			return len(children) == 1 && !matchTestFilter(children[0], attributes)
+		case '&':
+			for _, child := range children {
+				if !matchTestFilter(child, attributes) {
+					return false
+				}
+			}
+			return true
+		default:
+			for _, child := range children {
+				if matchTestFilter(child, attributes) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	name, value, _ := strings.Cut(inner, "=")
+	for attribute, values := range attributes {
+		if !strings.EqualFold(attribute, name) {
+			continue
+		}
+		for _, v := range values {
+			if value == "*" || strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestLDAPLogin(t *testing.T) {
+	directory := startTestDirectory(t)
+	const (
+		people  = "ou=people,dc=example,dc=org"
+		admins  = "cn=admins,ou=groups,dc=example,dc=org"
+		editors = "cn=editors,ou=groups,dc=example,dc=org"
+	)
+	directory.set("cn=reader,dc=example,dc=org", map[string][]string{"userPassword": {"reader-secret"}})
+	directory.set("uid=alice,"+people, map[string][]string{
+		"objectClass":  {"inetOrgPerson"},
+		"uid":          {"alice"},
+		"entryUUID":    {"7d1c3d4e-0001"},
+		"mail":         {"Alice@Example.org"},
+		"memberOf":     {"CN=Admins,OU=Groups,DC=example,DC=org"},
+		"userPassword": {"directory-pass"},
+	})
+	directory.set("uid=carol,"+people, map[string][]string{
+		"objectClass":  {"inetOrgPerson"},
+		"uid":          {"carol"},
+		"entryUUID":    {"7d1c3d4e-0002"},
+		"userPassword": {"directory-pass"},
+	})
+	directory.set(editors, map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=alice," + people},
+	})
+
+	s := newTestService(t, func(config *Config) {
+		config.LDAP = LDAPConfig{
+			URL:          directory.URL,
+			BindDN:       "cn=reader,dc=example,dc=org",
+			BindPassword: "reader-secret",
+			BaseDN:       "dc=example,dc=org",
+			UserFilter:   "(&(objectClass=inetOrgPerson)(uid=%s))",
+			GroupFilter:  "(&(objectClass=groupOfNames)(member=%s))",
+			GroupRoles:   map[string]string{admins: store.RoleAdmin, editors: "editor"},
+		}
+	})
+	ctx := context.Background()
+	if _, err := store.CreateRole(ctx, s.DB, "editor", "Edits pages"); err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	if _, err := store.CreateRole(ctx, s.DB, "support", "Helps users"); err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	// carol is also a local account, which wins over the directory.
+	if _, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "carol", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	login := func(username, password string) (int, error) {
+		w := httptest.NewRecorder()
+		return s.LoginUser(w, httptest.NewRequest("POST", "/login", nil), username, password)
+	}
+
+	aliceID, err := login("Alice", "directory-pass")
+	if err != nil {
+		t.Fatalf("Expected the directory user to log in, got %v", err)
+	}
+	alice, err := store.ReadUser(ctx, s.DB, aliceID)
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+	assert.Equal(t, "alice", alice.Username)
+	assert.Equal(t, "alice@example.org", alice.Email)
+	assert.True(t, alice.EmailVerified)
+	assert.True(t, alice.Admin, "member of the group mapped to the admin role")
+	grants, err := s.Grants.Get(ctx, s.DB, aliceID)
+	if assert.NoError(t, err) {
+		assert.True(t, grants.HasRole(store.RoleAdmin), "role of the memberOf group")
+		assert.True(t, grants.HasRole("editor"), "role of the group found with group_filter")
+	}
+
+	for _, attempt := range []struct{ username, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"nobody", "directory-pass"},
+		{"carol", "directory-pass"},
+	} {
+		if _, err := login(attempt.username, attempt.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Expected %s/%q to be rejected, got %v", attempt.username, attempt.password, err)
+		}
+	}
+	if _, err := login("carol", "ValidP@ssw0rd"); err != nil {
+		t.Errorf("Expected the local user to log in, got %v", err)
+	}
+
+	// The local password of a directory user is never checked.
+	if err := store.UpdateUser(ctx, s.DB, testHasher, aliceID, "", "L0cal-P@ssword"); err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	if _, err := login("alice", "L0cal-P@ssword"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected the local password of a directory user to be rejected, got %v", err)
+	}
+	if err := s.RequestPasswordReset(ctx, "alice"); err != nil {
+		t.Fatalf("RequestPasswordReset failed: %v", err)
+	}
+	assert.Empty(t, s.Mailer.(*MemoryMailer).Messages(), "password reset for a directory user")
+	token, err := CreatePasswordResetToken(ctx, s.DB, aliceID, time.Now())
+	if err != nil {
+		t.Fatalf("CreatePasswordResetToken failed: %v", err)
+	}
+	if _, err := ResetPassword(ctx, s.DB, s.Users, s.Hasher, token, "L0cal-P@ssword", time.Now()); !errors.Is(err, ErrDirectoryPassword) {
+		t.Errorf("Expected ErrDirectoryPassword for a directory user, got %v", err)
+	}
+
+	// Nor can the directory link be removed to turn alice into a local
+	// user.
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+	browser := newTestBrowser(router)
+	page := browser.get("/login")
+	browser.post("/login", page.Body.String(), url.Values{"username": {"alice"}, "password": {"directory-pass"}})
+	page = browser.get("/account/identities")
+	assert.Equal(t, http.StatusOK, page.Code)
+	w := browser.post("/account/identities/"+ldapProvider+"/unlink", page.Body.String(), url.Values{})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	if directoryUser, err := isDirectoryUser(ctx, s.DB, aliceID); err != nil || !directoryUser {
+		t.Errorf("Expected alice to stay a directory user, got %v (%v)", directoryUser, err)
+	}
+
+	// Group changes apply on the next login, leaving roles that are not
+	// mapped alone. A renamed entry keeps its account.
+	if err := s.AssignRole(ctx, aliceID, "support"); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+	directory.remove("uid=alice," + people)
+	directory.set("uid=alice,ou=staff,dc=example,dc=org", map[string][]string{
+		"objectClass":  {"inetOrgPerson"},
+		"uid":          {"alice"},
+		"entryUUID":    {"7d1c3d4e-0001"},
+		"mail":         {"alice@example.org"},
+		"userPassword": {"directory-pass"},
+	})
+	userID, err := login("alice", "directory-pass")
+	if err != nil {
+		t.Fatalf("Expected the renamed user to log in, got %v", err)
+	}
+	assert.Equal(t, aliceID, userID)
+	grants, err = s.Grants.Get(ctx, s.DB, aliceID)
+	if assert.NoError(t, err) {
+		assert.False(t, grants.HasRole(store.RoleAdmin))
+		assert.False(t, grants.HasRole("editor"))
+		assert.True(t, grants.HasRole("support"))
+	}
+	if alice, err := s.Users.ReadUser(ctx, aliceID); assert.NoError(t, err) {
+		assert.False(t, alice.Admin, "no longer in the group mapped to the admin role")
+	}
+
+	if err := s.SetUserDisabled(ctx, aliceID, true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if _, err := login("alice", "directory-pass"); !errors.Is(err, store.ErrUserDisabled) {
+		t.Errorf("Expected a disabled directory user to be refused, got %v", err)
+	}
+
+	// Local users can still log in while the directory is down.
+	s.Authenticators[1].(*LDAPAuthenticator).config.URL = "ldap://127.0.0.1:1"
+	if _, err := login("carol", "ValidP@ssw0rd"); err != nil {
+		t.Errorf("Expected the local user to log in without the directory, got %v", err)
+	}
+	if _, err := login("bob", "directory-pass"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected an outage to be reported as such, got %v", err)
+	}
+}
+
+func TestLDAPLoginUsernames(t *testing.T) {
+	directory := startTestDirectory(t)
+	const people = "ou=people,dc=example,dc=org"
+	for i, uid := range []string{"john.doe", "j-smith", "bob"} {
+		directory.set("uid="+uid+","+people, map[string][]string{
+			"objectClass":  {"inetOrgPerson"},
+			"uid":          {uid},
+			"entryUUID":    {fmt.Sprintf("7d1c3d4e-%04d", i)},
+			"userPassword": {"directory-pass"},
+		})
+	}
+
+	s := newTestService(t, func(config *Config) {
+		config.LDAP = LDAPConfig{
+			URL:        directory.URL,
+			BaseDN:     "dc=example,dc=org",
+			UserFilter: "(&(objectClass=inetOrgPerson)(uid=%s))",
+		}
+		// Shadow users have no local password, so the policy does not
+		// get in their way.
+		config.Password.MaxLength = 12
+	})
+	ctx := context.Background()
+	// A local user already has the name j-smith would get.
+	if _, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "j_smith", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	tests := []struct {
+		login string
+		want  string
+	}{
+		{"john.doe", "john_doe"},
+		{"j-smith", "j_smith2"},
+		{"bob", "bob_"},
+	}
+	for _, test := range tests {
+		userID, err := s.LoginUser(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), test.login, "directory-pass")
+		if err != nil {
+			t.Errorf("Expected %s to log in, got %v", test.login, err)
+			continue
+		}
+		user, err := s.Users.ReadUser(ctx, userID)
+		if err != nil {
+			t.Fatalf("ReadUser failed: %v", err)
+		}
+		assert.Equal(t, test.want, user.Username, "local username of %s", test.login)
+
+		again, err := s.LoginUser(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), test.login, "directory-pass")
+		if assert.NoError(t, err, "second login of %s", test.login) {
+			assert.Equal(t, userID, again, "the directory subject keeps %s on the same user", test.login)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+var (
+	ErrOAuthClientNotFound = errors.New("OAuth client not found")
+	ErrOAuthClientName     = errors.New("client name must not be empty")
+	ErrOAuthRedirectURI    = errors.New("redirect URIs must be absolute https URLs, or http on a loopback address, without a fragment")
+	ErrOAuthScope          = errors.New("scopes may not contain quotes or backslashes")
+)
+
+// OAuthError is an error response from RFC 6749, sent as JSON by the token
+// endpoints and as query parameters on the redirect by the authorize
+// endpoint.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// OAuthClient is an application that signs its users in through us. Public
+// clients, such as single-page and native apps, have no secret; every client
+// has to use PKCE.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	RedirectURIs []string
+	Scopes       []string
+	Public       bool
+	CreatedAt    time.Time
+	secretHash   string
+
+	// PostLogoutRedirectURIs are where RP-initiated logout may send the
+	// browser afterwards.
+	PostLogoutRedirectURIs []string
+}
+
+// AllowsScopes reports whether every scope in scopes was registered for the
+// client.
+func (c *OAuthClient) AllowsScopes(scopes []string) bool {
+	return scopeSubset(scopes, c.Scopes)
+}
+
+// CreateOAuthClient registers a client and returns its secret, which is ""
+// for public clients. Only a hash of the secret is stored.
+func CreateOAuthClient(ctx context.Context, db *sql.DB, name string, redirectURIs, scopes []string, public bool, now time.Time) (*OAuthClient, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", ErrOAuthClientName
+	}
+	if len(redirectURIs) == 0 {
+		return nil, "", ErrOAuthRedirectURI
+	}
+	for _, uri := range redirectURIs {
+		if !validRedirectURI(uri) {
+			return nil, "", fmt.Errorf("%w: %q", ErrOAuthRedirectURI, uri)
+		}
+	}
+	scopes = uniqueScopes(scopes)
+	for _, scope := range scopes {
+		if strings.ContainsAny(scope, "\"\\") {
+			return nil, "", fmt.Errorf("%w: %q", ErrOAuthScope, scope)
+		}
+	}
+
+	id, _, err := newSecretToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id = id[:22]
+
+	var secret string
+	var secretHash sql.NullString
+	if !public {
+		secret, secretHash.String, err = newSecretToken()
+		if err != nil {
+			return nil, "", err
+		}
+		secretHash.Valid = true
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, secretHash, name, strings.Join(redirectURIs, " "), strings.Join(scopes, " "), now.Unix())
+	if err != nil {
+		return nil, "", err
+	}
+
+	client := &OAuthClient{
+		ID:           id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		Public:       public,
+		CreatedAt:    time.Unix(now.Unix(), 0),
+		secretHash:   secretHash.String,
+	}
+	return client, secret, nil
+}
+
+// validRedirectURI accepts absolute https URLs, and http URLs on a loopback
+// address for native apps and local development.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" || strings.ContainsAny(raw, " #") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+const oauthClientColumns = "id, secret_hash, name, redirect_uris, scopes, created_at, post_logout_redirect_uris"
+
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*OAuthClient, error) {
+	var (
+		client                                       OAuthClient
+		secretHash                                   sql.NullString
+		redirectURIs, scopes, postLogoutRedirectURIs string
+		createdAt                                    int64
+	)
+	if err := row.Scan(&client.ID, &secretHash, &client.Name, &redirectURIs, &scopes, &createdAt, &postLogoutRedirectURIs); err != nil {
+		return nil, err
+	}
+
+	client.secretHash = secretHash.String
+	client.Public = !secretHash.Valid
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	client.CreatedAt = time.Unix(createdAt, 0)
+	client.PostLogoutRedirectURIs = strings.Fields(postLogoutRedirectURIs)
+	return &client, nil
+}
+
+func GetOAuthClient(ctx context.Context, db *sql.DB, id string) (*OAuthClient, error) {
+	client, err := scanOAuthClient(db.QueryRowContext(ctx, "SELECT "+oauthClientColumns+" FROM oauth_clients WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrOAuthClientNotFound
+	}
+	return client, err
+}
+
+func ListOAuthClients(ctx context.Context, db *sql.DB) ([]OAuthClient, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+oauthClientColumns+" FROM oauth_clients ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *client)
+	}
+
+	return clients, rows.Err()
+}
+
+// SetPostLogoutRedirectURIs replaces the URIs RP-initiated logout may
+// redirect to for the client. They follow the rules for redirect URIs.
+func SetPostLogoutRedirectURIs(ctx context.Context, db *sql.DB, id string, uris []string) error {
+	for _, uri := range uris {
+		if !validRedirectURI(uri) {
+			return fmt.Errorf("%w: %q", ErrOAuthRedirectURI, uri)
+		}
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE oauth_clients SET post_logout_redirect_uris = ? WHERE id = ?", strings.Join(uris, " "), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOAuthClientNotFound
+	}
+
+	return nil
+}
+
+// DeleteOAuthClient removes the client together with its codes, tokens and
+// the consents users gave it.
+func DeleteOAuthClient(ctx context.Context, db *sql.DB, id string) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM oauth_clients WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOAuthClientNotFound
+	}
+
+	return nil
+}
+
+// uniqueScopes drops empty and repeated scopes, keeping the first occurrence
+// of each.
+func uniqueScopes(scopes []string) []string {
+	seen := make(map[string]bool, len(scopes))
+	unique := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		for _, scope := range strings.Fields(scope) {
+			if !seen[scope] {
+				seen[scope] = true
+				unique = append(unique, scope)
+			}
+		}
+	}
+	return unique
+}
+
+func scopeSubset(scopes, allowed []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, a := range allowed {
+			if a == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasOAuthConsent reports whether the user already agreed to give the client
+// every scope in scopes.
+func hasOAuthConsent(ctx context.Context, db *sql.DB, userID int, clientID string, scopes []string) (bool, error) {
+	var granted string
+	err := db.QueryRowContext(ctx, "SELECT scope FROM oauth_consents WHERE user_id = ? AND client_id = ?", userID, clientID).Scan(&granted)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return scopeSubset(scopes, strings.Fields(granted)), nil
+}
+
+// saveOAuthConsent adds scopes to what the user has granted the client.
+func saveOAuthConsent(ctx context.Context, db *sql.DB, userID int, clientID string, scopes []string, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var granted string
+	err = tx.QueryRowContext(ctx, "SELECT scope FROM oauth_consents WHERE user_id = ? AND client_id = ?", userID, clientID).Scan(&granted)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO oauth_consents (user_id, client_id, scope, granted_at) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT (user_id, client_id) DO UPDATE SET scope = excluded.scope, granted_at = excluded.granted_at",
+		userID, clientID, strings.Join(uniqueScopes(append(strings.Fields(granted), scopes...)), " "), now.Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// authorizeRequest is a validated /oauth/authorize request.
+type authorizeRequest struct {
+	Client        *OAuthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	Prompt        string
+	Nonce         string
+}
+
+// fields returns the parameters the consent form has to post back.
+func (r *authorizeRequest) fields() map[string]string {
+	return map[string]string{
+		"response_type":         "code",
+		"client_id":             r.Client.ID,
+		"redirect_uri":          r.RedirectURI,
+		"scope":                 strings.Join(r.Scopes, " "),
+		"state":                 r.State,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": "S256",
+		"nonce":                 r.Nonce,
+	}
+}
+
+// parseAuthorizeRequest validates the parameters of an authorization request,
+// from the query string or the consent form. The client and redirect URI are
+// checked first: until both are known to be good, the returned request is nil
+// and errors must be shown to the user instead of sent to the redirect URI.
+func (s *Service) parseAuthorizeRequest(c *gin.Context) (*authorizeRequest, error) {
+	client, err := GetOAuthClient(c.Request.Context(), s.DB, c.Request.FormValue("client_id"))
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, oauthError("invalid_request", "Unknown client")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURI := c.Request.FormValue("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	found := false
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, oauthError("invalid_request", "The redirect URI is not registered for this client")
+	}
+
+	request := &authorizeRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         c.Request.FormValue("state"),
+		CodeChallenge: c.Request.FormValue("code_challenge"),
+		Prompt:        c.Request.FormValue("prompt"),
+		Nonce:         c.Request.FormValue("nonce"),
+	}
+
+	if c.Request.FormValue("response_type") != "code" {
+		return request, oauthError("unsupported_response_type", "Only the code response type is supported")
+	}
+
+	request.Scopes = uniqueScopes([]string{c.Request.FormValue("scope")})
+	if len(request.Scopes) == 0 {
+		request.Scopes = client.Scopes
+	}
+	if !client.AllowsScopes(request.Scopes) {
+		return request, oauthError("invalid_scope", "The client may not request these scopes")
+	}
+
+	if c.Request.FormValue("code_challenge_method") != "S256" || !validPKCEValue(request.CodeChallenge) {
+		return request, oauthError("invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+
+	switch request.Prompt {
+	case "", "none", "consent":
+	default:
+		return request, oauthError("invalid_request", "Unsupported prompt value")
+	}
+
+	return request, nil
+}
+
+// validPKCEValue checks the length and alphabet RFC 7636 sets for code
+// verifiers, which S256 challenges also satisfy.
+func validPKCEValue(value string) bool {
+	if len(value) < 43 || len(value) > 128 {
+		return false
+	}
+	for _, r := range value {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', strings.ContainsRune("-._~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// pkceChallenge is the S256 code challenge for verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func verifyPKCE(challenge, verifier string) bool {
+	if !validPKCEValue(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// authorizeFailed reports err on the client's redirect URI when request says
+// it can be trusted, and on an error page otherwise.
+func authorizeFailed(c *gin.Context, request *authorizeRequest, err error) {
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) {
+		log.Printf("Authorization request failed: %v", err)
+		oauthErr = oauthError("server_error", "The authorization server failed to process the request")
+	}
+
+	if request == nil {
+		renderHTML(c, http.StatusBadRequest, "consent.html", gin.H{"ErrorMessage": oauthErr.Description})
+		return
+	}
+
+	redirectWithParams(c, request.RedirectURI, url.Values{
+		"error":             {oauthErr.Code},
+		"error_description": {oauthErr.Description},
+		"state":             {request.State},
+	})
+}
+
+// redirectWithParams sends the browser to uri with params added to its
+// query. 303 makes sure a redirect answering the consent form becomes a GET.
+func redirectWithParams(c *gin.Context, uri string, params url.Values) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid redirect URI"})
+		return
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query[key] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// OAuthAuthorizeHandler is the authorization endpoint. Users who are not
+// signed in are sent through the login page and brought back here; users who
+// have not yet agreed to the requested scopes see the consent screen.
+func (s *Service) OAuthAuthorizeHandler(c *gin.Context) {
+	request, err := s.parseAuthorizeRequest(c)
+	if err != nil {
+		authorizeFailed(c, request, err)
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		if request.Prompt == "none" {
+			authorizeFailed(c, request, oauthError("login_required", "The user is not signed in"))
+			return
+		}
+
+		session.Values[loginNextKey] = c.Request.URL.RequestURI()
+		if err := session.Save(c.Request, c.Writer); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+			return
+		}
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	consented, err := hasOAuthConsent(c.Request.Context(), s.DB, userID, request.Client.ID, request.Scopes)
+	if err != nil {
+		authorizeFailed(c, request, err)
+		return
+	}
+	if consented && request.Prompt != "consent" {
+		s.issueAuthorizationCode(c, request, userID)
+		return
+	}
+	if request.Prompt == "none" {
+		authorizeFailed(c, request, oauthError("consent_required", "The user has not agreed to the requested scopes"))
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "consent.html", gin.H{
+		"Client": request.Client,
+		"Scopes": request.Scopes,
+		"Fields": request.fields(),
+	})
+}
+
+// OAuthConsentHandler takes the answer to the consent screen.
+func (s *Service) OAuthConsentHandler(c *gin.Context) {
+	request, err := s.parseAuthorizeRequest(c)
+	if err != nil {
+		authorizeFailed(c, request, err)
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		authorizeFailed(c, request, oauthError("access_denied", "The user is not signed in"))
+		return
+	}
+
+	if c.PostForm("decision") != "approve" {
+		authorizeFailed(c, request, oauthError("access_denied", "The user denied the request"))
+		return
+	}
+
+	if err := saveOAuthConsent(c.Request.Context(), s.DB, userID, request.Client.ID, request.Scopes, time.Now()); err != nil {
+		authorizeFailed(c, request, err)
+		return
+	}
+
+	s.issueAuthorizationCode(c, request, userID)
+}
+
+func (s *Service) issueAuthorizationCode(c *gin.Context, request *authorizeRequest, userID int) {
+	session := c.MustGet("session").(*sessions.Session)
+	authTime, _ := session.Values[authTimeKey].(int64)
+
+	code, err := createAuthorizationCode(c.Request.Context(), s.DB, request, userID, authTime, time.Now())
+	if err != nil {
+		authorizeFailed(c, request, err)
+		return
+	}
+
+	redirectWithParams(c, request.RedirectURI, url.Values{"code": {code}, "state": {request.State}})
+}
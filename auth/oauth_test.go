@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+// testBrowser sends requests to router, keeping the cookies it is given like
+// a browser would.
+type testBrowser struct {
+	router  http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func newTestBrowser(router http.Handler) *testBrowser {
+	return &testBrowser{router: router, cookies: make(map[string]*http.Cookie)}
+}
+
+func (b *testBrowser) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range b.cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	b.router.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(b.cookies, cookie.Name)
+		} else {
+			b.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func (b *testBrowser) get(path string) *httptest.ResponseRecorder {
+	return b.do(httptest.NewRequest("GET", path, nil))
+}
+
+// post submits form with the CSRF token from the last page it was given.
+func (b *testBrowser) post(path, page string, form url.Values) *httptest.ResponseRecorder {
+	if match := regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`).FindStringSubmatch(page); match != nil {
+		form.Set(CSRFFormField, match[1])
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+// tokenRequest calls a token endpoint as client, with HTTP Basic
+// authentication when secret is set.
+func tokenRequest(router http.Handler, path, clientID, secret string, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	if secret == "" {
+		form.Set("client_id", clientID)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func pkcePair() (string, string) {
+	verifier := strings.Repeat("verifier-", 6)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestCreateOAuthClient(t *testing.T) {
+	s := newTestService(t, nil)
+	ctx := context.Background()
+
+	for _, uri := range []string{"http://app.example.com/cb", "https://app.example.com/cb#frag", "/cb", "https://app.example.com/a b"} {
+		if _, _, err := CreateOAuthClient(ctx, s.DB, "app", []string{uri}, nil, false, time.Now()); err == nil {
+			t.Errorf("Expected redirect URI %q to be rejected", uri)
+		}
+	}
+	if _, _, err := CreateOAuthClient(ctx, s.DB, " ", []string{"https://app.example.com/cb"}, nil, false, time.Now()); err != ErrOAuthClientName {
+		t.Errorf("Expected ErrOAuthClientName, got %v", err)
+	}
+
+	client, secret, err := CreateOAuthClient(ctx, s.DB, "native", []string{"http://127.0.0.1:8123/cb"}, []string{"profile profile", "email"}, true, time.Now())
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+	assert.Empty(t, secret)
+	assert.Equal(t, []string{"profile", "email"}, client.Scopes)
+
+	loaded, err := GetOAuthClient(ctx, s.DB, client.ID)
+	if err != nil {
+		t.Fatalf("GetOAuthClient failed: %v", err)
+	}
+	assert.True(t, loaded.Public)
+	assert.Equal(t, client.RedirectURIs, loaded.RedirectURIs)
+
+	if err := DeleteOAuthClient(ctx, s.DB, client.ID); err != nil {
+		t.Fatalf("DeleteOAuthClient failed: %v", err)
+	}
+	if _, err := GetOAuthClient(ctx, s.DB, client.ID); err != ErrOAuthClientNotFound {
+		t.Errorf("Expected ErrOAuthClientNotFound, got %v", err)
+	}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	ctx := context.Background()
+	if _, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "alice", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	const redirectURI = "https://app.example.com/callback"
+	client, secret, err := CreateOAuthClient(ctx, s.DB, "Wiki", []string{redirectURI}, []string{"profile", "email"}, false, time.Now())
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+	browser := newTestBrowser(router)
+
+	verifier, challenge := pkcePair()
+	authorize := "/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"profile"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	w := browser.get(strings.Replace(authorize, "response_type=code", "response_type=token", 1))
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=unsupported_response_type")
+
+	w = browser.get(authorize + "&prompt=none")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=login_required")
+
+	// Signing in through the normal login page leads back to the request.
+	w = browser.get(authorize)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/login", w.Header().Get("Location"))
+	w = browser.get("/login")
+	w = browser.post("/login", w.Body.String(), url.Values{"username": {"alice"}, "password": {"ValidP@ssw0rd"}})
+	assert.Equal(t, authorize, w.Header().Get("HX-Redirect"))
+
+	w = browser.get(authorize)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Authorize Wiki")
+	consentPage := w.Body.String()
+
+	form := url.Values{"decision": {"deny"}}
+	for _, field := range regexp.MustCompile(`<input type="hidden" name="([a-z_]+)" value="([^"]*)">`).FindAllStringSubmatch(consentPage, -1) {
+		form.Set(field[1], html.UnescapeString(field[2]))
+	}
+	w = browser.post("/oauth/authorize", consentPage, form)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=access_denied")
+
+	form.Set("decision", "approve")
+	w = browser.post("/oauth/authorize", consentPage, form)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+	assert.Equal(t, "app.example.com", location.Host)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("Expected a code in %s", location)
+	}
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}}
+	w, _ = tokenRequest(router, "/oauth/token", client.ID, "wrong-secret", exchange)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w, tokens := tokenRequest(router, "/oauth/token", client.ID, secret, exchange)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "Bearer", tokens["token_type"])
+	assert.Equal(t, "profile", tokens["scope"])
+	accessToken, _ := tokens["access_token"].(string)
+	refreshToken, _ := tokens["refresh_token"].(string)
+
+	_, info := tokenRequest(router, "/oauth/introspect", client.ID, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, true, info["active"])
+	assert.Equal(t, "alice", info["username"])
+	assert.Equal(t, client.ID, info["client_id"])
+
+	// A replayed code fails and takes the tokens issued from it along.
+	w, body := tokenRequest(router, "/oauth/token", client.ID, secret, exchange)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+	_, info = tokenRequest(router, "/oauth/introspect", client.ID, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, false, info["active"])
+	_, info = tokenRequest(router, "/oauth/introspect", client.ID, secret, url.Values{"token": {refreshToken}})
+	assert.Equal(t, false, info["active"])
+
+	// The consent is remembered, so the next request gets a code at once.
+	w = browser.get(authorize)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	location, _ = url.Parse(w.Header().Get("Location"))
+	code = location.Query().Get("code")
+
+	exchange.Set("code", code)
+	exchange.Set("code_verifier", strings.Repeat("x", 43))
+	w, body = tokenRequest(router, "/oauth/token", client.ID, secret, exchange)
+	assert.Equal(t, "invalid_grant", body["error"], "a wrong code verifier must be refused")
+
+	w = browser.get(authorize)
+	location, _ = url.Parse(w.Header().Get("Location"))
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Set("code_verifier", verifier)
+	_, tokens = tokenRequest(router, "/oauth/token", client.ID, secret, exchange)
+	refreshToken, _ = tokens["refresh_token"].(string)
+
+	w, refreshed := tokenRequest(router, "/oauth/token", client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	newAccess, _ := refreshed["access_token"].(string)
+	newRefresh, _ := refreshed["refresh_token"].(string)
+
+	w, body = tokenRequest(router, "/oauth/token", client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {newRefresh}, "scope": {"email"}})
+	assert.Equal(t, "invalid_scope", body["error"])
+
+	// Using the rotated-out refresh token again revokes the grant.
+	_, body = tokenRequest(router, "/oauth/token", client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, "invalid_grant", body["error"])
+	_, info = tokenRequest(router, "/oauth/introspect", client.ID, secret, url.Values{"token": {newAccess}})
+	assert.Equal(t, false, info["active"])
+}
+
+func TestOAuthRevocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	ctx := context.Background()
+	now := time.Now()
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "bobby", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	native, _, err := CreateOAuthClient(ctx, s.DB, "CLI", []string{"http://127.0.0.1/cb"}, []string{"profile"}, true, now)
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+	api, apiSecret, err := CreateOAuthClient(ctx, s.DB, "API", []string{"https://api.example.com/cb"}, nil, false, now)
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+
+	verifier, challenge := pkcePair()
+	request := &authorizeRequest{Client: native, RedirectURI: native.RedirectURIs[0], Scopes: []string{"profile"}, CodeChallenge: challenge}
+	code, err := createAuthorizationCode(ctx, s.DB, request, int(userID), 0, now)
+	if err != nil {
+		t.Fatalf("createAuthorizationCode failed: %v", err)
+	}
+
+	router := gin.New()
+	s.RegisterRoutes(router)
+
+	// A public client authenticates with its client_id alone.
+	w, tokens := tokenRequest(router, "/oauth/token", native.ID, "", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {verifier}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	accessToken, _ := tokens["access_token"].(string)
+	refreshToken, _ := tokens["refresh_token"].(string)
+
+	w, body := tokenRequest(router, "/oauth/introspect", native.ID, "", url.Values{"token": {accessToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_client", body["error"])
+
+	_, info := tokenRequest(router, "/oauth/introspect", api.ID, apiSecret, url.Values{"token": {accessToken}})
+	assert.Equal(t, true, info["active"])
+	assert.Equal(t, "Bearer", info["token_type"])
+
+	// Another client cannot revoke the token, and is not told so.
+	w, _ = tokenRequest(router, "/oauth/revoke", api.ID, apiSecret, url.Values{"token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, info = tokenRequest(router, "/oauth/introspect", api.ID, apiSecret, url.Values{"token": {accessToken}})
+	assert.Equal(t, true, info["active"])
+
+	w, _ = tokenRequest(router, "/oauth/revoke", native.ID, "", url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, info = tokenRequest(router, "/oauth/introspect", api.ID, apiSecret, url.Values{"token": {accessToken}})
+	assert.Equal(t, false, info["active"])
+
+	w, _ = tokenRequest(router, "/oauth/revoke", native.ID, "", url.Values{"token": {"never-issued"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestOAuthAuthorizeRejectsBadClients(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	client, _, err := CreateOAuthClient(context.Background(), s.DB, "Wiki", []string{"https://app.example.com/callback"}, []string{"profile"}, false, time.Now())
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	_, challenge := pkcePair()
+	for name, params := range map[string]url.Values{
+		"unknown client":        {"client_id": {"nope"}, "response_type": {"code"}},
+		"unregistered redirect": {"client_id": {client.ID}, "response_type": {"code"}, "redirect_uri": {"https://evil.example.com/callback"}},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/authorize?"+params.Encode(), nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		assert.Empty(t, w.Header().Get("Location"), name)
+	}
+
+	for name, params := range map[string]url.Values{
+		"no PKCE":      {"client_id": {client.ID}, "response_type": {"code"}},
+		"plain PKCE":   {"client_id": {client.ID}, "response_type": {"code"}, "code_challenge": {challenge}, "code_challenge_method": {"plain"}},
+		"extra scopes": {"client_id": {client.ID}, "response_type": {"code"}, "code_challenge": {challenge}, "code_challenge_method": {"S256"}, "scope": {"profile admin"}},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/authorize?"+params.Encode(), nil))
+		assert.Equal(t, http.StatusSeeOther, w.Code, name)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "https://app.example.com/callback?error="), name)
+	}
+}
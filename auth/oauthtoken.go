@@ -0,0 +1,493 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"auth_module/store"
+)
+
+const (
+	OAuthCodeTTL         = 5 * time.Minute
+	OAuthAccessTokenTTL  = time.Hour
+	OAuthRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// OAuthTokenResponse is what the token endpoint returns on success.
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+
+	// What addIDToken needs to know about the grant.
+	userID   int
+	nonce    string
+	authTime int64
+}
+
+// OAuthTokenInfo is an introspection response as defined by RFC 7662. Only
+// Active is set for tokens that are unknown, expired or revoked.
+type OAuthTokenInfo struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+// createAuthorizationCode stores a single-use code for request and returns
+// it. Each code starts a new grant that the tokens issued from it share.
+// authTime is when the user signed in, or 0 if that is not known.
+func createAuthorizationCode(ctx context.Context, db *sql.DB, request *authorizeRequest, userID int, authTime int64, now time.Time) (string, error) {
+	code, codeHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	grantID, _, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO oauth_authorization_codes (code_hash, grant_id, client_id, user_id, redirect_uri, scope, code_challenge, nonce, auth_time, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		codeHash, grantID, request.Client.ID, userID, request.RedirectURI, strings.Join(request.Scopes, " "), request.CodeChallenge, request.Nonce,
+		sql.NullInt64{Int64: authTime, Valid: authTime != 0}, now.Add(OAuthCodeTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// issueOAuthTokens adds an access token for accessScopes and a refresh token
+// for refreshScopes to the grant.
+func issueOAuthTokens(ctx context.Context, tx *sql.Tx, grantID, clientID string, userID int, accessScopes, refreshScopes []string, now time.Time) (*OAuthTokenResponse, error) {
+	accessToken, accessHash, err := newSecretToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := newSecretToken()
+	if err != nil {
+		return nil, err
+	}
+
+	insert := "INSERT INTO oauth_tokens (token_hash, kind, grant_id, client_id, user_id, scope, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err = tx.ExecContext(ctx, insert, accessHash, "access", grantID, clientID, userID, strings.Join(accessScopes, " "), now.Unix(), now.Add(OAuthAccessTokenTTL).Unix())
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, insert, refreshHash, "refresh", grantID, clientID, userID, strings.Join(refreshScopes, " "), now.Unix(), now.Add(OAuthRefreshTokenTTL).Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	return &OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(OAuthAccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(accessScopes, " "),
+		userID:       userID,
+	}, nil
+}
+
+func revokeOAuthGrant(ctx context.Context, tx *sql.Tx, grantID string, now time.Time) error {
+	_, err := tx.ExecContext(ctx, "UPDATE oauth_tokens SET revoked_at = ? WHERE grant_id = ? AND revoked_at IS NULL", now.Unix(), grantID)
+	return err
+}
+
+// userDisabled reports whether the user is disabled or gone, either of which
+// ends their grants.
+func userDisabled(ctx context.Context, users store.UserStore, userID int) (bool, error) {
+	user, err := users.ReadUser(ctx, userID)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Disabled, nil
+}
+
+var errInvalidGrant = oauthError("invalid_grant", "The authorization code or refresh token is invalid, expired or revoked")
+
+// ExchangeAuthorizationCode redeems a code for tokens. A code can only be used
+// once: presenting it again revokes every token issued from it, as RFC 6749
+// section 4.1.2 advises.
+func ExchangeAuthorizationCode(ctx context.Context, db *sql.DB, users store.UserStore, client *OAuthClient, code, redirectURI, verifier string, now time.Time) (*OAuthTokenResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		grantID, clientID, storedRedirectURI, scope, challenge, nonce string
+		userID                                                        int
+		expiresAt, authTime                                           int64
+	)
+	err = tx.QueryRowContext(ctx, "UPDATE oauth_authorization_codes SET used_at = ? WHERE code_hash = ? AND used_at IS NULL "+
+		"RETURNING grant_id, client_id, user_id, redirect_uri, scope, code_challenge, nonce, COALESCE(auth_time, 0), expires_at",
+		now.Unix(), hashSecretToken(code)).Scan(&grantID, &clientID, &userID, &storedRedirectURI, &scope, &challenge, &nonce, &authTime, &expiresAt)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, "SELECT grant_id FROM oauth_authorization_codes WHERE code_hash = ?", hashSecretToken(code)).Scan(&grantID)
+		if err == sql.ErrNoRows {
+			return nil, errInvalidGrant
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := revokeOAuthGrant(ctx, tx, grantID, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The code is spent from here on, even if the checks below fail.
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if clientID != client.ID || expiresAt <= now.Unix() {
+		return nil, errInvalidGrant
+	}
+	if redirectURI != storedRedirectURI && (redirectURI != "" || len(client.RedirectURIs) != 1) {
+		return nil, oauthError("invalid_grant", "The redirect URI does not match the authorization request")
+	}
+	if !verifyPKCE(challenge, verifier) {
+		return nil, oauthError("invalid_grant", "The code verifier does not match the code challenge")
+	}
+
+	disabled, err := userDisabled(ctx, users, userID)
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, errInvalidGrant
+	}
+
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scopes := strings.Fields(scope)
+	response, err := issueOAuthTokens(ctx, tx, grantID, client.ID, userID, scopes, scopes, now)
+	if err != nil {
+		return nil, err
+	}
+	response.nonce = nonce
+	response.authTime = authTime
+
+	return response, tx.Commit()
+}
+
+// RefreshOAuthTokens trades a refresh token for a new access and refresh
+// token. The old refresh token stops working; if it is presented again the
+// whole grant is revoked, since one of the two parties using it must have
+// stolen it. scopes, if not empty, narrows the new access token.
+func RefreshOAuthTokens(ctx context.Context, db *sql.DB, users store.UserStore, client *OAuthClient, refreshToken string, scopes []string, now time.Time) (*OAuthTokenResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		grantID, clientID, scope string
+		userID                   int
+		expiresAt                int64
+		revokedAt                sql.NullInt64
+	)
+	tokenHash := hashSecretToken(refreshToken)
+	err = tx.QueryRowContext(ctx, "SELECT grant_id, client_id, user_id, scope, expires_at, revoked_at FROM oauth_tokens WHERE token_hash = ? AND kind = 'refresh'",
+		tokenHash).Scan(&grantID, &clientID, &userID, &scope, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if clientID != client.ID {
+		return nil, errInvalidGrant
+	}
+	if revokedAt.Valid {
+		if err := revokeOAuthGrant(ctx, tx, grantID, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidGrant
+	}
+	if expiresAt <= now.Unix() {
+		return nil, errInvalidGrant
+	}
+
+	disabled, err := userDisabled(ctx, users, userID)
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, errInvalidGrant
+	}
+
+	granted := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	if !scopeSubset(scopes, granted) {
+		return nil, oauthError("invalid_scope", "The requested scope exceeds the scope of the grant")
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE oauth_tokens SET revoked_at = ? WHERE token_hash = ? AND revoked_at IS NULL", now.Unix(), tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, errInvalidGrant
+	}
+
+	response, err := issueOAuthTokens(ctx, tx, grantID, client.ID, userID, scopes, granted, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A refreshed ID token keeps the original auth_time but has no nonce.
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(auth_time, 0) FROM oauth_authorization_codes WHERE grant_id = ?", grantID).Scan(&response.authTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, tx.Commit()
+}
+
+// RevokeOAuthToken implements RFC 7009 for the client that owns token.
+// Revoking a refresh token also revokes the access tokens of its grant.
+// Tokens that are unknown or belong to another client are ignored, so the
+// endpoint does not reveal which tokens exist.
+func RevokeOAuthToken(ctx context.Context, db *sql.DB, client *OAuthClient, token string, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var kind, grantID string
+	tokenHash := hashSecretToken(token)
+	err = tx.QueryRowContext(ctx, "SELECT kind, grant_id FROM oauth_tokens WHERE token_hash = ? AND client_id = ?", tokenHash, client.ID).Scan(&kind, &grantID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if kind == "refresh" {
+		err = revokeOAuthGrant(ctx, tx, grantID, now)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE oauth_tokens SET revoked_at = ? WHERE token_hash = ? AND revoked_at IS NULL", now.Unix(), tokenHash)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IntrospectOAuthToken describes an access or refresh token. A token is
+// active until it expires or is revoked, or its user in users is disabled.
+func IntrospectOAuthToken(ctx context.Context, db *sql.DB, users store.UserStore, token string, now time.Time) (*OAuthTokenInfo, error) {
+	var (
+		info   OAuthTokenInfo
+		kind   string
+		userID int
+	)
+	err := db.QueryRowContext(ctx, "SELECT kind, client_id, user_id, scope, created_at, expires_at FROM oauth_tokens "+
+		"WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?",
+		hashSecretToken(token), now.Unix()).Scan(&kind, &info.ClientID, &userID, &info.Scope, &info.Iat, &info.Exp)
+	if err == sql.ErrNoRows {
+		return &OAuthTokenInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := users.ReadUser(ctx, userID)
+	if err == sql.ErrNoRows || (err == nil && user.Disabled) {
+		return &OAuthTokenInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.Active = true
+	info.Username = user.Username
+	info.Sub = strconv.Itoa(userID)
+	if kind == "access" {
+		info.TokenType = "Bearer"
+	}
+	return &info, nil
+}
+
+// authenticateOAuthClient identifies the caller of a token endpoint from HTTP
+// Basic credentials or the client_id and client_secret form fields. Public
+// clients identify themselves with client_id alone.
+func (s *Service) authenticateOAuthClient(c *gin.Context) (*OAuthClient, error) {
+	id, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes both before Basic encoding.
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, oauthError("invalid_client", "Malformed client credentials")
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, oauthError("invalid_client", "Malformed client credentials")
+		}
+	} else {
+		id = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, err := GetOAuthClient(c.Request.Context(), s.DB, id)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, oauthError("invalid_client", "Client authentication failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, oauthError("invalid_client", "Client authentication failed")
+		}
+		return client, nil
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(hashSecretToken(secret)), []byte(client.secretHash)) != 1 {
+		return nil, oauthError("invalid_client", "Client authentication failed")
+	}
+
+	return client, nil
+}
+
+// oauthFailed writes err as an RFC 6749 JSON error response.
+func oauthFailed(c *gin.Context, err error) {
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) {
+		log.Printf("OAuth request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	if oauthErr.Code == "invalid_client" {
+		status = http.StatusUnauthorized
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": oauthErr.Code, "error_description": oauthErr.Description})
+}
+
+// OAuthTokenHandler is the token endpoint, for the authorization_code and
+// refresh_token grants.
+func (s *Service) OAuthTokenHandler(c *gin.Context) {
+	client, err := s.authenticateOAuthClient(c)
+	if err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	now := time.Now()
+	var response *OAuthTokenResponse
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		response, err = ExchangeAuthorizationCode(c.Request.Context(), s.DB, s.Users, client, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"), now)
+	case "refresh_token":
+		response, err = RefreshOAuthTokens(c.Request.Context(), s.DB, s.Users, client, c.PostForm("refresh_token"), uniqueScopes([]string{c.PostForm("scope")}), now)
+	default:
+		err = oauthError("unsupported_grant_type", "Only the authorization_code and refresh_token grants are supported")
+	}
+	if err == nil {
+		err = s.addIDToken(c.Request.Context(), client, response, now)
+	}
+	if err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, response)
+}
+
+// OAuthRevokeHandler is the RFC 7009 revocation endpoint.
+func (s *Service) OAuthRevokeHandler(c *gin.Context) {
+	client, err := s.authenticateOAuthClient(c)
+	if err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthFailed(c, oauthError("invalid_request", "The token parameter is required"))
+		return
+	}
+
+	if err := RevokeOAuthToken(c.Request.Context(), s.DB, client, token, time.Now()); err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// OAuthIntrospectHandler is the RFC 7662 introspection endpoint. Resource
+// servers call it with credentials of a confidential client.
+func (s *Service) OAuthIntrospectHandler(c *gin.Context) {
+	client, err := s.authenticateOAuthClient(c)
+	if err == nil && client.Public {
+		err = oauthError("invalid_client", "Public clients cannot introspect tokens")
+	}
+	if err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthFailed(c, oauthError("invalid_request", "The token parameter is required"))
+		return
+	}
+
+	info, err := IntrospectOAuthToken(c.Request.Context(), s.DB, s.Users, token, time.Now())
+	if err != nil {
+		oauthFailed(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+// OIDCIDTokenTTL is how long the ID tokens we sign are valid.
+const OIDCIDTokenTTL = time.Hour
+
+// The scopes OpenID Connect gives a meaning to. A client has to be registered
+// with openid to get ID tokens.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OIDCConfig controls how ID tokens are signed. Signing keys are created and
+// rotated on their own; see Service.signingKeys.
+type OIDCConfig struct {
+	SigningAlg  string        `yaml:"signing_alg"`
+	KeyRotation time.Duration `yaml:"key_rotation"`
+	KeyOverlap  time.Duration `yaml:"key_overlap"`
+}
+
+func (c *OIDCConfig) applyDefaults() {
+	if c.SigningAlg == "" {
+		c.SigningAlg = AlgRS256
+	}
+	if c.KeyRotation == 0 {
+		c.KeyRotation = 30 * 24 * time.Hour
+	}
+	if c.KeyOverlap == 0 {
+		c.KeyOverlap = 24 * time.Hour
+	}
+}
+
+// OIDCDiscovery is the provider metadata of OpenID Connect Discovery 1.0.
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+}
+
+// Audience is the aud claim, which is either a single string or an array.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Contains reports whether aud is one of the audiences.
+func (a Audience) Contains(aud string) bool {
+	for _, value := range a {
+		if value == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// UserClaims are the claims about a user that the userinfo endpoint returns
+// and ID tokens carry.
+type UserClaims struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+// IDTokenClaims is the payload of an ID token.
+type IDTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Audience        Audience `json:"aud"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	AuthTime        int64    `json:"auth_time,omitempty"`
+	Nonce           string   `json:"nonce,omitempty"`
+	AccessTokenHash string   `json:"at_hash,omitempty"`
+	UserClaims
+}
+
+// userClaims returns what scopes allow a client to learn about user.
+func userClaims(user *store.User, scopes []string) UserClaims {
+	claims := UserClaims{Subject: strconv.Itoa(user.ID)}
+	if scopeSubset([]string{ScopeProfile}, scopes) {
+		claims.PreferredUsername = user.Username
+	}
+	if scopeSubset([]string{ScopeEmail}, scopes) && user.Email != "" {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+// addIDToken signs an ID token for response if its scope includes openid.
+func (s *Service) addIDToken(ctx context.Context, client *OAuthClient, response *OAuthTokenResponse, now time.Time) error {
+	scopes := strings.Fields(response.Scope)
+	if !scopeSubset([]string{ScopeOpenID}, scopes) {
+		return nil
+	}
+
+	user, err := s.Users.ReadUser(ctx, response.userID)
+	if err != nil {
+		return err
+	}
+
+	key, _, err := s.signingKeys(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	response.IDToken, err = key.sign(IDTokenClaims{
+		Issuer:          s.Config.BaseURL,
+		Audience:        Audience{client.ID},
+		Expiry:          now.Add(OIDCIDTokenTTL).Unix(),
+		IssuedAt:        now.Unix(),
+		AuthTime:        response.authTime,
+		Nonce:           response.nonce,
+		AccessTokenHash: tokenHash(response.AccessToken),
+		UserClaims:      userClaims(user, scopes),
+	})
+	return err
+}
+
+// verifyIDToken checks the signature and issuer of an ID token we signed and
+// returns its claims. Whether it has expired is left to the caller.
+func (s *Service) verifyIDToken(ctx context.Context, token string, now time.Time) (*IDTokenClaims, error) {
+	_, published, err := s.signingKeys(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims IDTokenClaims
+	err = parseJWT(token, func(header jwtHeader) (crypto.PublicKey, error) {
+		for _, key := range published {
+			if key.ID == header.Kid && key.Alg == header.Alg {
+				return key.private.Public(), nil
+			}
+		}
+		return nil, ErrInvalidJWT
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != s.Config.BaseURL {
+		return nil, ErrInvalidJWT
+	}
+
+	return &claims, nil
+}
+
+// OIDCDiscoveryHandler serves /.well-known/openid-configuration.
+func (s *Service) OIDCDiscoveryHandler(c *gin.Context) {
+	base := s.Config.BaseURL
+	c.JSON(http.StatusOK, OIDCDiscovery{
+		Issuer:                            base,
+		AuthorizationEndpoint:             base + "/oauth/authorize",
+		TokenEndpoint:                     base + "/oauth/token",
+		UserinfoEndpoint:                  base + "/userinfo",
+		JWKSURI:                           base + "/oauth/jwks",
+		EndSessionEndpoint:                base + "/oauth/logout",
+		RevocationEndpoint:                base + "/oauth/revoke",
+		IntrospectionEndpoint:             base + "/oauth/introspect",
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{AlgRS256, AlgES256},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "preferred_username", "email", "email_verified"},
+	})
+}
+
+// JWKSHandler publishes the public halves of the signing keys. Relying
+// parties may cache the set for half of key_overlap, so they always pick up
+// a new key before it signs anything.
+func (s *Service) JWKSHandler(c *gin.Context) {
+	_, published, err := s.signingKeys(c.Request.Context(), time.Now())
+	if err != nil {
+		log.Printf("Failed to load signing keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load signing keys"})
+		return
+	}
+
+	set := JWKSet{Keys: make([]JWK, 0, len(published))}
+	for _, key := range published {
+		jwk, err := newJWK(key.private.Public(), key.Alg, key.ID)
+		if err != nil {
+			log.Printf("Failed to encode signing key %s: %v", key.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load signing keys"})
+			return
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.Config.OIDC.KeyOverlap.Seconds()/2)))
+	c.JSON(http.StatusOK, set)
+}
+
+// UserInfoHandler is the userinfo endpoint. It takes an OAuth access token
+// that was granted the openid scope.
+func (s *Service) UserInfoHandler(c *gin.Context) {
+	token, ok := bearerToken(c.Request)
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_request", "error_description": "An access token is required"})
+		return
+	}
+
+	info, err := IntrospectOAuthToken(c.Request.Context(), s.DB, s.Users, token, time.Now())
+	if err != nil {
+		log.Printf("Failed to look up access token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	scopes := strings.Fields(info.Scope)
+	if !info.Active || info.TokenType != "Bearer" {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token", "error_description": "The access token is invalid, expired or revoked"})
+		return
+	}
+	if !scopeSubset([]string{ScopeOpenID}, scopes) {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient_scope", "error_description": "The access token was not granted the openid scope"})
+		return
+	}
+
+	userID, err := strconv.Atoi(info.Sub)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	user, err := s.Users.ReadUser(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to read user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, userClaims(user, scopes))
+}
+
+// EndSessionHandler implements RP-initiated logout. A client that proves with
+// id_token_hint that it signed in the current user logs them out right away;
+// anyone else gets a confirmation page first, so a link on another site
+// cannot sign people out. Afterwards the browser is sent to
+// post_logout_redirect_uri, if the client registered it, with state.
+func (s *Service) EndSessionHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	hint := c.Request.FormValue("id_token_hint")
+	clientID := c.Request.FormValue("client_id")
+	redirectURI := c.Request.FormValue("post_logout_redirect_uri")
+	state := c.Request.FormValue("state")
+
+	var claims *IDTokenClaims
+	if hint != "" {
+		var err error
+		claims, err = s.verifyIDToken(ctx, hint, time.Now())
+		if err != nil {
+			if !errors.Is(err, ErrInvalidJWT) {
+				log.Printf("Failed to verify ID token hint: %v", err)
+			}
+			renderHTML(c, http.StatusBadRequest, "end_session.html", gin.H{"ErrorMessage": "The ID token hint is not valid"})
+			return
+		}
+		switch {
+		case clientID == "" && len(claims.Audience) == 1:
+			clientID = claims.Audience[0]
+		case !claims.Audience.Contains(clientID):
+			renderHTML(c, http.StatusBadRequest, "end_session.html", gin.H{"ErrorMessage": "The ID token hint was not issued to this client"})
+			return
+		}
+	}
+
+	var client *OAuthClient
+	if clientID != "" {
+		var err error
+		client, err = GetOAuthClient(ctx, s.DB, clientID)
+		if errors.Is(err, ErrOAuthClientNotFound) {
+			renderHTML(c, http.StatusBadRequest, "end_session.html", gin.H{"ErrorMessage": "Unknown client"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load client"})
+			return
+		}
+	}
+
+	if redirectURI != "" && (client == nil || !slices.Contains(client.PostLogoutRedirectURIs, redirectURI)) {
+		renderHTML(c, http.StatusBadRequest, "end_session.html", gin.H{"ErrorMessage": "The post-logout redirect URI is not registered for this client"})
+		return
+	}
+
+	session := c.MustGet("session").(*sessions.Session)
+	userID, loggedIn := session.Values["user_id"].(int)
+	hinted := claims != nil && claims.Subject == strconv.Itoa(userID)
+	if loggedIn && !hinted && c.Request.Method != http.MethodPost {
+		renderHTML(c, http.StatusOK, "end_session.html", gin.H{
+			"Client": client,
+			"Fields": map[string]string{
+				"id_token_hint":            hint,
+				"client_id":                clientID,
+				"post_logout_redirect_uri": redirectURI,
+				"state":                    state,
+			},
+		})
+		return
+	}
+
+	if loggedIn {
+		if err := s.ClearSession(c.Writer, c.Request); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear session"})
+			return
+		}
+	}
+
+	if redirectURI != "" {
+		redirectWithParams(c, redirectURI, url.Values{"state": {state}})
+		return
+	}
+	renderHTML(c, http.StatusOK, "logout.html", nil)
+}
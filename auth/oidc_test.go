@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+// verifyWithJWKS checks token against the key set served by router, as a
+// relying party would.
+func verifyWithJWKS(t *testing.T, router http.Handler, token string) *IDTokenClaims {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/jwks", nil))
+	var set JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Failed to parse JWKS %q: %v", w.Body.String(), err)
+	}
+
+	var claims IDTokenClaims
+	err := parseJWT(token, func(header jwtHeader) (crypto.PublicKey, error) {
+		jwk, ok := set.Key(header.Kid)
+		if !ok || jwk.Alg != header.Alg {
+			return nil, ErrInvalidJWT
+		}
+		return jwk.PublicKey()
+	}, &claims)
+	if err != nil {
+		t.Fatalf("ID token does not verify against the JWKS: %v", err)
+	}
+	return &claims
+}
+
+func TestOIDCFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *Config) {
+		config.BaseURL = "https://id.example.com"
+		config.OIDC.SigningAlg = AlgES256
+	})
+	ctx := context.Background()
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "alice", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := store.SetUserEmail(ctx, s.DB, int(userID), "alice@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	const redirectURI = "https://app.example.com/callback"
+	client, secret, err := CreateOAuthClient(ctx, s.DB, "Wiki", []string{redirectURI}, []string{"openid", "profile", "email"}, false, time.Now())
+	if err != nil {
+		t.Fatalf("CreateOAuthClient failed: %v", err)
+	}
+	if err := SetPostLogoutRedirectURIs(ctx, s.DB, client.ID, []string{"https://app.example.com/bye"}); err != nil {
+		t.Fatalf("SetPostLogoutRedirectURIs failed: %v", err)
+	}
+
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+	browser := newTestBrowser(router)
+
+	w := browser.get("/.well-known/openid-configuration")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var discovery OIDCDiscovery
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatalf("Failed to parse discovery document: %v", err)
+	}
+	assert.Equal(t, "https://id.example.com", discovery.Issuer)
+	assert.Equal(t, "https://id.example.com/oauth/jwks", discovery.JWKSURI)
+	assert.Equal(t, "https://id.example.com/userinfo", discovery.UserinfoEndpoint)
+	assert.Equal(t, "https://id.example.com/oauth/logout", discovery.EndSessionEndpoint)
+
+	verifier, challenge := pkcePair()
+	authorize := "/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid profile email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	w = browser.get("/login")
+	browser.post("/login", w.Body.String(), url.Values{"username": {"alice"}, "password": {"ValidP@ssw0rd"}})
+	w = browser.get(authorize)
+	assert.Equal(t, http.StatusOK, w.Code)
+	consentPage := w.Body.String()
+	form := url.Values{"decision": {"approve"}}
+	for _, field := range regexp.MustCompile(`<input type="hidden" name="([a-z_]+)" value="([^"]*)">`).FindAllStringSubmatch(consentPage, -1) {
+		form.Set(field[1], html.UnescapeString(field[2]))
+	}
+	w = browser.post("/oauth/authorize", consentPage, form)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("Expected a code, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {location.Query().Get("code")}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}}
+	w, body := tokenRequest(router, "/oauth/token", client.ID, secret, exchange)
+	assert.Equal(t, http.StatusOK, w.Code)
+	idToken, _ := body["id_token"].(string)
+	accessToken, _ := body["access_token"].(string)
+	refreshToken, _ := body["refresh_token"].(string)
+	if idToken == "" {
+		t.Fatalf("Expected an ID token, got %v", body)
+	}
+
+	claims := verifyWithJWKS(t, router, idToken)
+	assert.Equal(t, "https://id.example.com", claims.Issuer)
+	assert.Equal(t, Audience{client.ID}, claims.Audience)
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(t, tokenHash(accessToken), claims.AccessTokenHash)
+	assert.NotZero(t, claims.AuthTime)
+	assert.Equal(t, "alice", claims.PreferredUsername)
+	assert.Equal(t, "alice@example.com", claims.Email)
+	if assert.NotNil(t, claims.EmailVerified) {
+		assert.False(t, *claims.EmailVerified)
+	}
+
+	userinfo := func(token string) (*httptest.ResponseRecorder, UserClaims) {
+		req := httptest.NewRequest("GET", "/userinfo", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var claims UserClaims
+		json.Unmarshal(w.Body.Bytes(), &claims)
+		return w, claims
+	}
+	w, info := userinfo(accessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, claims.Subject, info.Subject)
+	assert.Equal(t, "alice", info.PreferredUsername)
+	w, _ = userinfo("")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = userinfo(refreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	// A refreshed ID token keeps auth_time but not the nonce; narrowing the
+	// scope below openid means no ID token at all.
+	w, body = tokenRequest(router, "/oauth/token", client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshed := verifyWithJWKS(t, router, body["id_token"].(string))
+	assert.Equal(t, claims.AuthTime, refreshed.AuthTime)
+	assert.Empty(t, refreshed.Nonce)
+	w, body = tokenRequest(router, "/oauth/token", client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {body["refresh_token"].(string)}, "scope": {"profile"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, body, "id_token")
+	w, _ = userinfo(body["access_token"].(string))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Without a hint the user is asked first.
+	w = browser.get("/oauth/logout")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Log out?")
+	assert.Equal(t, http.StatusOK, browser.get("/dashboard").Code)
+
+	w = browser.get("/oauth/logout?" + url.Values{"id_token_hint": {idToken}, "post_logout_redirect_uri": {"https://evil.example.com/"}}.Encode())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = browser.get("/oauth/logout?" + url.Values{"id_token_hint": {idToken + "x"}}.Encode())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = browser.get("/oauth/logout?" + url.Values{"id_token_hint": {idToken}, "post_logout_redirect_uri": {"https://app.example.com/bye"}, "state": {"abc"}}.Encode())
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "https://app.example.com/bye?state=abc", w.Header().Get("Location"))
+	assert.NotEqual(t, http.StatusOK, browser.get("/dashboard").Code)
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	s := newTestService(t, func(config *Config) {
+		config.OIDC.KeyRotation = 10 * 24 * time.Hour
+		config.OIDC.KeyOverlap = 24 * time.Hour
+	})
+	ctx := context.Background()
+	day := 24 * time.Hour
+	start := time.Unix(1700000000, 0)
+
+	keyIDs := func(keys []*signingKey) []string {
+		var ids []string
+		for _, key := range keys {
+			ids = append(ids, key.ID)
+		}
+		return ids
+	}
+
+	first, published, err := s.signingKeys(ctx, start)
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, AlgRS256, first.Alg)
+	assert.Equal(t, []string{first.ID}, keyIDs(published))
+
+	token, err := first.sign(IDTokenClaims{Issuer: s.Config.BaseURL, UserClaims: UserClaims{Subject: "1"}})
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+
+	current, _, err := s.signingKeys(ctx, start.Add(9*day))
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, first.ID, current.ID)
+
+	// Once key_rotation has passed, the next key is published but not used
+	// until key_overlap later.
+	current, published, err = s.signingKeys(ctx, start.Add(10*day))
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, first.ID, current.ID)
+	if assert.Len(t, published, 2) {
+		assert.NotEqual(t, first.ID, published[0].ID)
+	}
+	second := published[0]
+
+	current, published, err = s.signingKeys(ctx, start.Add(11*day))
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, second.ID, current.ID)
+	assert.Equal(t, []string{second.ID, first.ID}, keyIDs(published))
+	if _, err := s.verifyIDToken(ctx, token, start.Add(11*day)); err != nil {
+		t.Errorf("Expected a token of the previous key to verify during the overlap: %v", err)
+	}
+
+	current, published, err = s.signingKeys(ctx, start.Add(12*day))
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, second.ID, current.ID)
+	assert.Equal(t, []string{second.ID}, keyIDs(published))
+	if _, err := s.verifyIDToken(ctx, token, start.Add(12*day)); err == nil {
+		t.Errorf("Expected a token of a retired key to be rejected")
+	}
+
+	// Keys survive a restart, encrypted with the session secret.
+	s.keys.parsed = make(map[string]*signingKey)
+	if err := s.RotateSigningKey(ctx, start.Add(12*day)); err != nil {
+		t.Fatalf("RotateSigningKey failed: %v", err)
+	}
+	current, published, err = s.signingKeys(ctx, start.Add(12*day))
+	if err != nil {
+		t.Fatalf("signingKeys failed: %v", err)
+	}
+	assert.Equal(t, second.ID, current.ID)
+	assert.Len(t, published, 2)
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// providerMetadataTTL is how long discovery documents and key sets of
+	// external providers are cached.
+	providerMetadataTTL = time.Hour
+	// providerKeysRefetch limits how often an unknown key ID makes us fetch
+	// a provider's key set again.
+	providerKeysRefetch = time.Minute
+	// idTokenLeeway allows for clock skew between us and the provider.
+	idTokenLeeway = time.Minute
+)
+
+// OIDCProviderConfig describes an external OpenID Connect provider users can
+// log in with. We are registered there as a confidential client, or a public
+// one when ClientSecret is empty, with redirect URI
+// <base_url>/login/oidc/<name>/callback.
+type OIDCProviderConfig struct {
+	DisplayName  string   `yaml:"display_name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret" secret:"true"`
+	Scopes       []string `yaml:"scopes"`
+
+	// UsernameClaim names the claim new users' usernames are derived from.
+	UsernameClaim string `yaml:"username_claim"`
+	// CreateUsers creates a local user the first time someone without a
+	// linked account logs in. Otherwise they have to link the identity to
+	// an existing account first.
+	CreateUsers bool `yaml:"create_users"`
+}
+
+func (c *OIDCProviderConfig) applyDefaults(name string) {
+	if c.DisplayName == "" {
+		c.DisplayName = name
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "preferred_username"
+	}
+}
+
+// oidcProvider is a configured provider together with what we fetched from
+// it.
+type oidcProvider struct {
+	Name   string
+	Config OIDCProviderConfig
+
+	mu              sync.Mutex
+	metadata        *OIDCDiscovery
+	metadataFetched time.Time
+	keys            *JWKSet
+	keysFetched     time.Time
+}
+
+func newOIDCProviders(configs map[string]OIDCProviderConfig) map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider, len(configs))
+	for name, config := range configs {
+		providers[name] = &oidcProvider{Name: name, Config: config}
+	}
+	return providers
+}
+
+// getJSON fetches uri and decodes the JSON body into v.
+func getJSON(ctx context.Context, client *http.Client, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's metadata, fetching it from the issuer's
+// well-known location when the cached copy is missing or stale.
+func (p *oidcProvider) discover(ctx context.Context, client *http.Client, now time.Time) (*OIDCDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil && now.Before(p.metadataFetched.Add(providerMetadataTTL)) {
+		return p.metadata, nil
+	}
+
+	var metadata OIDCDiscovery
+	if err := getJSON(ctx, client, p.Config.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("discovery for %s: %w", p.Name, err)
+	}
+	// OpenID Connect Discovery 1.0 section 4.3.
+	if metadata.Issuer != p.Config.Issuer {
+		return nil, fmt.Errorf("discovery for %s: issuer %q does not match the configured %q", p.Name, metadata.Issuer, p.Config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery for %s: the authorization, token and JWKS endpoints are required", p.Name)
+	}
+
+	p.metadata = &metadata
+	p.metadataFetched = now
+	return p.metadata, nil
+}
+
+// publicKey finds the key a provider signed an ID token with, fetching the
+// key set again if the key is unknown, as happens after the provider rotated.
+func (p *oidcProvider) publicKey(ctx context.Context, client *http.Client, metadata *OIDCDiscovery, header jwtHeader, now time.Time) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		stale := p.keys == nil || !now.Before(p.keysFetched.Add(providerMetadataTTL))
+		if stale || (attempt > 0 && !now.Before(p.keysFetched.Add(providerKeysRefetch))) {
+			var keys JWKSet
+			if err := getJSON(ctx, client, metadata.JWKSURI, &keys); err != nil {
+				return nil, fmt.Errorf("keys of %s: %w", p.Name, err)
+			}
+			p.keys = &keys
+			p.keysFetched = now
+		}
+
+		jwk, ok := p.keys.Key(header.Kid)
+		if !ok && header.Kid == "" && len(p.keys.Keys) == 1 {
+			jwk, ok = p.keys.Keys[0], true
+		}
+		if ok {
+			if jwk.Alg != "" && jwk.Alg != header.Alg || jwk.Use != "" && jwk.Use != "sig" {
+				return nil, ErrInvalidJWT
+			}
+			return jwk.PublicKey()
+		}
+	}
+
+	return nil, ErrInvalidJWT
+}
+
+// redirectURI is where the provider sends users back to.
+func (p *oidcProvider) redirectURI(baseURL string) string {
+	return baseURL + "/login/oidc/" + p.Name + "/callback"
+}
+
+// externalTokens is the part of a token response we use.
+type externalTokens struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeCode redeems an authorization code at the provider's token
+// endpoint.
+func (p *oidcProvider) exchangeCode(ctx context.Context, client *http.Client, metadata *OIDCDiscovery, baseURL, code, verifier string) (*externalTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI(baseURL)},
+		"code_verifier": {verifier},
+	}
+	if p.Config.ClientSecret == "" {
+		form.Set("client_id", p.Config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens externalTokens
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token response of %s: %s: %w", p.Name, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request to %s failed: %s: %s %s", p.Name, resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response of %s has no ID token", p.Name)
+	}
+
+	return &tokens, nil
+}
+
+// externalClaims is a verified ID token from a provider: the standard claims,
+// and all of them for looking up the configured username claim.
+type externalClaims struct {
+	IDTokenClaims
+	AuthorizedParty string `json:"azp,omitempty"`
+	raw             map[string]interface{}
+}
+
+// stringClaim returns the named claim if it is a string.
+func (c *externalClaims) stringClaim(name string) string {
+	value, _ := c.raw[name].(string)
+	return value
+}
+
+// verifiedEmail returns the email address if the provider vouches for it.
+func (c *externalClaims) verifiedEmail() string {
+	if c.EmailVerified == nil || !*c.EmailVerified {
+		return ""
+	}
+	return c.Email
+}
+
+// verifyIDToken checks an ID token from the provider as OpenID Connect Core
+// section 3.1.3.7 requires of a client using the code flow.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, client *http.Client, metadata *OIDCDiscovery, tokens *externalTokens, nonce string, now time.Time) (*externalClaims, error) {
+	var payload json.RawMessage
+	err := parseJWT(tokens.IDToken, func(header jwtHeader) (crypto.PublicKey, error) {
+		return p.publicKey(ctx, client, metadata, header, now)
+	}, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims externalClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if err := json.Unmarshal(payload, &claims.raw); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	switch {
+	case claims.Issuer != metadata.Issuer:
+		return nil, errors.New("ID token issuer does not match")
+	case !claims.Audience.Contains(p.Config.ClientID):
+		return nil, errors.New("ID token was not issued to us")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.Config.ClientID:
+		return nil, errors.New("ID token was issued to another party")
+	case claims.Expiry == 0 || !now.Before(time.Unix(claims.Expiry, 0).Add(idTokenLeeway)):
+		return nil, errors.New("ID token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)):
+		return nil, errors.New("ID token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce does not match")
+	case claims.AccessTokenHash != "" && claims.AccessTokenHash != tokenHash(tokens.AccessToken):
+		return nil, errors.New("ID token at_hash does not match the access token")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return &claims, nil
+}
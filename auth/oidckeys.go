@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// signingKey is one of the keys ID tokens are signed with.
+type signingKey struct {
+	ID        string
+	Alg       string
+	CreatedAt time.Time
+	private   crypto.Signer
+}
+
+func (k *signingKey) sign(claims interface{}) (string, error) {
+	return signJWT(k.private, k.Alg, k.ID, claims)
+}
+
+// keyCache remembers decrypted signing keys by ID. Its mutex also keeps two
+// requests from rotating at the same time.
+type keyCache struct {
+	mu     sync.Mutex
+	parsed map[string]*signingKey
+}
+
+// generateSigningKey stores a new key for alg.
+func (s *Service) generateSigningKey(ctx context.Context, alg string, now time.Time) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(s.signingKeysKey, der)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _, err := newSecretToken()
+	if err != nil {
+		return nil, err
+	}
+	kid = kid[:16]
+
+	_, err = s.DB.ExecContext(ctx, "INSERT INTO oidc_signing_keys (kid, alg, private_key, created_at) VALUES (?, ?, ?, ?)",
+		kid, alg, encrypted, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{ID: kid, Alg: alg, CreatedAt: time.Unix(now.Unix(), 0), private: private}
+	s.keys.parsed[kid] = key
+	return key, nil
+}
+
+// loadSigningKeys returns the stored keys, newest first. Keys are only
+// decrypted and parsed the first time they are seen.
+func (s *Service) loadSigningKeys(ctx context.Context) ([]*signingKey, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT kid, alg, private_key, created_at FROM oidc_signing_keys ORDER BY created_at DESC, kid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*signingKey
+	for rows.Next() {
+		var (
+			kid, alg, encrypted string
+			createdAt           int64
+		)
+		if err := rows.Scan(&kid, &alg, &encrypted, &createdAt); err != nil {
+			return nil, err
+		}
+
+		key, ok := s.keys.parsed[kid]
+		if !ok {
+			der, err := decryptSecret(s.signingKeysKey, encrypted)
+			if err != nil {
+				return nil, fmt.Errorf("signing key %s: %w", kid, err)
+			}
+			private, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, fmt.Errorf("signing key %s: %w", kid, err)
+			}
+			signer, ok := private.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("signing key %s: unsupported key type %T", kid, private)
+			}
+			key = &signingKey{ID: kid, Alg: alg, CreatedAt: time.Unix(createdAt, 0), private: signer}
+			s.keys.parsed[kid] = key
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// signingKeys returns the key to sign ID tokens with and the keys to publish,
+// rotating and pruning as the clock demands.
+//
+// A new key is created once the newest one is key_rotation old, or when
+// signing_alg changes, but it is only published at first: tokens are still
+// signed with its predecessor until the new key is key_overlap old, so
+// relying parties that cache the JWKS have seen it before they meet it. The
+// predecessor stays published for another key_overlap after that, which is
+// at least as long as the last tokens it signed are valid.
+func (s *Service) signingKeys(ctx context.Context, now time.Time) (*signingKey, []*signingKey, error) {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	cfg := s.Config.OIDC
+	keys, err := s.loadSigningKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(keys) == 0 || keys[0].Alg != cfg.SigningAlg || !now.Before(keys[0].CreatedAt.Add(cfg.KeyRotation)) {
+		key, err := s.generateSigningKey(ctx, cfg.SigningAlg, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append([]*signingKey{key}, keys...)
+	}
+
+	// Sign with the newest key that has been published for long enough,
+	// or with the oldest one while none has.
+	current := len(keys) - 1
+	for i, key := range keys {
+		if !now.Before(key.CreatedAt.Add(cfg.KeyOverlap)) {
+			current = i
+			break
+		}
+	}
+
+	published := keys[:current+1]
+	for i := current + 1; i < len(keys); i++ {
+		// keys[i-1] took over from keys[i] once it was key_overlap old.
+		if now.Before(keys[i-1].CreatedAt.Add(2 * cfg.KeyOverlap)) {
+			published = keys[:i+1]
+			continue
+		}
+
+		for _, retired := range keys[i:] {
+			if _, err := s.DB.ExecContext(ctx, "DELETE FROM oidc_signing_keys WHERE kid = ?", retired.ID); err != nil {
+				return nil, nil, err
+			}
+			delete(s.keys.parsed, retired.ID)
+		}
+		break
+	}
+
+	return keys[current], published, nil
+}
+
+// RotateSigningKey creates a new ID token signing key right away instead of
+// waiting for key_rotation to pass, for instance after a leak. The new key is
+// published at once and takes over signing after key_overlap.
+func (s *Service) RotateSigningKey(ctx context.Context, now time.Time) error {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	_, err := s.generateSigningKey(ctx, s.Config.OIDC.SigningAlg, now)
+	return err
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"auth_module/sessionstore"
+	"auth_module/store"
+)
+
+const PasswordResetTokenTTL = time.Hour
+
+var (
+	ErrInvalidResetToken = errors.New("password reset link is invalid or has expired")
+	ErrDirectoryPassword = errors.New("this account's password is managed by the directory")
+)
+
+// CreatePasswordResetToken returns a new single-use reset token for the user.
+// Only a SHA-256 hash of the token is stored, and any tokens issued to the
+// user before are discarded.
+func CreatePasswordResetToken(ctx context.Context, db *sql.DB, userID int, now time.Time) (string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_reset_tokens WHERE user_id = ?", userID); err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		tokenHash, userID, now.Add(PasswordResetTokenTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// RequestPasswordReset mails a reset link to the user's email address. It
+// returns nil without sending anything when the user does not exist, has no
+// email address or shadows a directory user, whose password is changed in the
+// directory, so callers cannot be used to probe for accounts.
+func (s *Service) RequestPasswordReset(ctx context.Context, username string) error {
+	db := s.DB
+
+	user, err := s.Users.GetUserByUsername(ctx, username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+	directoryUser, err := isDirectoryUser(ctx, db, user.ID)
+	if err != nil {
+		return err
+	}
+	if directoryUser {
+		return nil
+	}
+
+	token, err := CreatePasswordResetToken(ctx, db, user.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	link := s.Config.BaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	return s.Mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Reset your nope.tools password",
+		Body: fmt.Sprintf("Someone asked to reset the password for %s.\n\n"+
+			"Open this link within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If this wasn't you, you can ignore this email.\n",
+			user.Username, int(PasswordResetTokenTTL.Minutes()), link),
+	})
+}
+
+// ResetPassword consumes token, sets a new password in users for its owner
+// and revokes all of the user's sessions. Users shadowing a directory entry
+// get ErrDirectoryPassword instead, as a local password would let them log
+// in once the directory no longer lets them.
+func ResetPassword(ctx context.Context, db *sql.DB, users store.UserStore, hasher *store.PasswordHasher, token, password string, now time.Time) (int, error) {
+	if err := hasher.ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "UPDATE password_reset_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id",
+		now.Unix(), hashSecretToken(token), now.Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// users may share db, so the token is consumed before the password is
+	// written rather than in one transaction with it.
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	directoryUser, err := isDirectoryUser(ctx, db, userID)
+	if err != nil {
+		return 0, err
+	}
+	if directoryUser {
+		return 0, ErrDirectoryPassword
+	}
+
+	if err := users.UpdateUser(ctx, userID, "", password); err != nil {
+		return 0, err
+	}
+
+	if err := sessionstore.RevokeUserSessions(db, userID); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// newSecretToken returns a random URL-safe token for emailed links together
+// with the hash that is stored in its place.
+func newSecretToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func ForgotPasswordPageHandler(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "forgot_password.html", nil)
+}
+
+func (s *Service) ForgotPasswordHandler(c *gin.Context) {
+	username := c.PostForm("username")
+
+	if err := s.RequestPasswordReset(c.Request.Context(), username); err != nil {
+		log.Printf("Failed to send password reset email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send password reset email"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "forgot_password.html", gin.H{"Sent": true})
+}
+
+func ResetPasswordPageHandler(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "reset_password.html", gin.H{"Token": c.Query("token")})
+}
+
+func (s *Service) ResetPasswordHandler(c *gin.Context) {
+	token := c.PostForm("token")
+	password := c.PostForm("password")
+
+	if err := s.Hasher.ValidatePassword(password); err != nil {
+		renderHTML(c, http.StatusOK, "reset_password.html", gin.H{"Token": token, "ErrorMessage": err.Error()})
+		return
+	}
+
+	_, err := ResetPassword(c.Request.Context(), s.DB, s.Users, s.Hasher, token, password, time.Now())
+	if errors.Is(err, ErrInvalidResetToken) || errors.Is(err, ErrDirectoryPassword) {
+		renderHTML(c, http.StatusOK, "reset_password.html", gin.H{"Token": token, "ErrorMessage": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.Header("HX-Redirect", "/login")
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func resetTokenFromMessage(t *testing.T, s *Service, msg Message) string {
+	for _, field := range strings.Fields(msg.Body) {
+		if strings.HasPrefix(field, s.Config.BaseURL+"/reset-password?") {
+			link, err := url.Parse(field)
+			if err != nil {
+				t.Fatalf("Failed to parse reset link: %v", err)
+			}
+			return link.Query().Get("token")
+		}
+	}
+	t.Fatalf("No reset link in message: %q", msg.Body)
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+	m := s.Mailer.(*MemoryMailer)
+
+	username := "forgetful"
+	password := "ValidP@ssw0rd"
+	newPassword := "N3wP@ssw0rd!"
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	if err := s.RequestPasswordReset(context.Background(), username); err != nil {
+		t.Fatalf("RequestPasswordReset failed: %v", err)
+	}
+	if err := s.RequestPasswordReset(context.Background(), "nosuchuser"); err != nil {
+		t.Fatalf("RequestPasswordReset failed for unknown user: %v", err)
+	}
+	if len(m.Messages()) != 0 {
+		t.Fatalf("Expected no email for accounts without an address, got %d", len(m.Messages()))
+	}
+
+	if err := store.SetUserEmail(context.Background(), db, int(userID), "forgetful@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	if err := s.RequestPasswordReset(context.Background(), username); err != nil {
+		t.Fatalf("RequestPasswordReset failed: %v", err)
+	}
+	messages := m.Messages()
+	if len(messages) != 1 || messages[0].To != "forgetful@example.com" {
+		t.Fatalf("Expected one email to forgetful@example.com, got %+v", messages)
+	}
+	token := resetTokenFromMessage(t, s, messages[0])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+	if _, err := s.LoginUser(w, r, username, password); err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	if _, err := ResetPassword(context.Background(), db, s.Users, s.Hasher, token, "weak", time.Now()); err == nil {
+		t.Errorf("Expected a password failing ValidatePassword to be rejected")
+	}
+	if _, err := ResetPassword(context.Background(), db, s.Users, s.Hasher, token, newPassword, time.Now().Add(PasswordResetTokenTTL+time.Second)); err != ErrInvalidResetToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+
+	resetUserID, err := ResetPassword(context.Background(), db, s.Users, s.Hasher, token, newPassword, time.Now())
+	if err != nil {
+		t.Fatalf("ResetPassword failed: %v", err)
+	}
+	if resetUserID != int(userID) {
+		t.Errorf("Expected user ID %d, got %d", userID, resetUserID)
+	}
+
+	if _, err := ResetPassword(context.Background(), db, s.Users, s.Hasher, token, newPassword, time.Now()); err != ErrInvalidResetToken {
+		t.Errorf("Expected reused token to be rejected, got %v", err)
+	}
+
+	activeSessions, err := s.Sessions.ListUserSessions(int(userID), "")
+	if err != nil {
+		t.Fatalf("ListUserSessions failed: %v", err)
+	}
+	if len(activeSessions) != 0 {
+		t.Errorf("Expected all sessions to be revoked, got %d", len(activeSessions))
+	}
+
+	w = httptest.NewRecorder()
+	if _, err := s.LoginUser(w, r, username, password); err != ErrInvalidCredentials {
+		t.Errorf("Expected old password to stop working, got %v", err)
+	}
+	if _, err := s.LoginUser(w, r, username, newPassword); err != nil {
+		t.Errorf("LoginUser with new password failed: %v", err)
+	}
+}
+
+func TestPasswordResetHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+	m := s.Mailer.(*MemoryMailer)
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, "resetuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := store.SetUserEmail(context.Background(), db, int(userID), "resetuser@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+
+	router := gin.Default()
+	router.SetHTMLTemplate(web.Templates())
+	router.POST("/forgot-password", s.ForgotPasswordHandler)
+	router.POST("/reset-password", s.ResetPasswordHandler)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.PostForm = form
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/forgot-password", url.Values{"username": {"resetuser"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "reset link is on its way")
+	if len(m.Messages()) != 1 {
+		t.Fatalf("Expected one reset email, got %d", len(m.Messages()))
+	}
+	token := resetTokenFromMessage(t, s, m.Messages()[0])
+
+	w = post("/reset-password", url.Values{"token": {"bogus"}, "password": {"N3wP@ssw0rd!"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), ErrInvalidResetToken.Error())
+
+	w = post("/reset-password", url.Values{"token": {token}, "password": {"N3wP@ssw0rd!"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/login", w.Header().Get("HX-Redirect"))
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+
+	err := m.Send(Message{To: "someone@example.com", Subject: "Hello\r\nBcc: evil@example.com", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one .eml file, got %v (%v)", files, err)
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	message := string(data)
+	if !strings.Contains(message, "To: someone@example.com\r\n") {
+		t.Errorf("Expected To header, got %q", message)
+	}
+	if strings.Contains(message, "\r\nBcc:") {
+		t.Errorf("Expected header injection to be stripped, got %q", message)
+	}
+	if !strings.HasSuffix(message, "line one\r\nline two") {
+		t.Errorf("Expected CRLF body, got %q", message)
+	}
+}
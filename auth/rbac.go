@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+func (s *Service) DeleteRole(ctx context.Context, name string) error {
+	if err := store.DeleteRole(ctx, s.DB, name); err != nil {
+		return err
+	}
+	s.Grants.InvalidateAll()
+	return nil
+}
+
+func (s *Service) GrantPermission(ctx context.Context, role, permission string) error {
+	if err := store.GrantPermission(ctx, s.DB, role, permission); err != nil {
+		return err
+	}
+	s.Grants.InvalidateAll()
+	return nil
+}
+
+func (s *Service) RevokePermission(ctx context.Context, role, permission string) error {
+	if err := store.RevokePermission(ctx, s.DB, role, permission); err != nil {
+		return err
+	}
+	s.Grants.InvalidateAll()
+	return nil
+}
+
+func (s *Service) AssignRole(ctx context.Context, userID int, role string) error {
+	if err := store.AssignRole(ctx, s.DB, userID, role); err != nil {
+		return err
+	}
+	s.Grants.Invalidate(userID)
+	return nil
+}
+
+func (s *Service) UnassignRole(ctx context.Context, userID int, role string) error {
+	if err := store.UnassignRole(ctx, s.DB, userID, role); err != nil {
+		return err
+	}
+	s.Grants.Invalidate(userID)
+	return nil
+}
+
+// SetUserAdmin sets the admin flag that opens the admin console to the user,
+// and assigns or unassigns the admin role to match, whose permissions the
+// console's user pages check.
+func (s *Service) SetUserAdmin(ctx context.Context, userID int, admin bool) error {
+	if err := s.Users.SetUserAdmin(ctx, userID, admin); err != nil {
+		return err
+	}
+	if admin {
+		return s.AssignRole(ctx, userID, store.RoleAdmin)
+	}
+	return s.UnassignRole(ctx, userID, store.RoleAdmin)
+}
+
+// DeleteUser deletes the user together with everything the database keeps
+// about them, and forgets their cached grants, so a new account that reuses
+// the ID does not inherit any of it.
+func (s *Service) DeleteUser(ctx context.Context, userID int) error {
+	if err := s.Users.DeleteUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := store.DeleteUserData(ctx, s.DB, userID); err != nil {
+		return err
+	}
+	s.Grants.Invalidate(userID)
+	return nil
+}
+
+// SetUserDisabled disables or re-enables the user. Disabling also signs them
+// out of every session.
+func (s *Service) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	if err := s.Users.SetUserDisabled(ctx, userID, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		return s.Sessions.RevokeUserSessions(userID)
+	}
+	return nil
+}
+
+// RequireRole only lets users holding role through. It must run after
+// AuthMiddleware.
+func (s *Service) RequireRole(role string) gin.HandlerFunc {
+	return s.requireGrant(func(g *store.Grants) bool { return g.HasRole(role) })
+}
+
+// RequirePermission only lets users whose roles carry permission through. It
+// must run after AuthMiddleware.
+func (s *Service) RequirePermission(permission string) gin.HandlerFunc {
+	return s.requireGrant(func(g *store.Grants) bool { return g.HasPermission(permission) })
+}
+
+// RequireAdmin only lets users with the admin flag on their account through.
+// It must run after AuthMiddleware.
+func (s *Service) RequireAdmin() gin.HandlerFunc {
+	return s.requireCaller(func(ctx context.Context, userID int) (bool, error) {
+		user, err := s.Users.ReadUser(ctx, userID)
+		if err != nil {
+			return false, err
+		}
+		return user.Admin, nil
+	})
+}
+
+// requireGrant checks the caller's roles and permissions with allowed.
+func (s *Service) requireGrant(allowed func(*store.Grants) bool) gin.HandlerFunc {
+	return s.requireCaller(func(ctx context.Context, userID int) (bool, error) {
+		grants, err := s.Grants.Get(ctx, s.DB, userID)
+		if err != nil {
+			return false, err
+		}
+		return allowed(grants), nil
+	})
+}
+
+// requireCaller asks allowed whether the signed-in user may go on. API
+// tokens only get that far if they carry the admin scope.
+func (s *Service) requireCaller(allowed func(ctx context.Context, userID int) (bool, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := c.MustGet("session").(*sessions.Session)
+
+		userID, ok := session.Values["user_id"].(int)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User ID not found in session"})
+			c.Abort()
+			return
+		}
+
+		if token, ok := c.Get(apiTokenContextKey); ok && !token.(*APIToken).HasScope(ScopeAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: API token lacks the admin scope"})
+			c.Abort()
+			return
+		}
+
+		ok, err := allowed(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to check permissions of user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			c.Abort()
+			return
+		}
+
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+)
+
+func TestRequirePermission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+
+	ctx := context.Background()
+	adminID, err := store.CreateUserIfNotExists(ctx, db, testHasher, "adminuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := store.AssignRole(ctx, db, int(adminID), store.RoleAdmin); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+	userID, err := store.CreateUserIfNotExists(ctx, db, testHasher, "plainuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	var sessionUserID interface{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		session := sessions.NewSession(s.Sessions, "session-name")
+		if sessionUserID != nil {
+			session.Values["user_id"] = sessionUserID
+		}
+		c.Set("session", session)
+		c.Next()
+	})
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	router.GET("/admin", s.RequirePermission(store.PermissionAdminAccess), ok)
+	router.GET("/admin/roles", s.RequireRole(store.RoleAdmin), ok)
+
+	get := func(path string, id interface{}) int {
+		sessionUserID = id
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/admin", nil))
+	assert.Equal(t, http.StatusForbidden, get("/admin", int(userID)))
+	assert.Equal(t, http.StatusOK, get("/admin", int(adminID)))
+	assert.Equal(t, http.StatusForbidden, get("/admin/roles", int(userID)))
+	assert.Equal(t, http.StatusOK, get("/admin/roles", int(adminID)))
+
+	if err := s.UnassignRole(ctx, int(adminID), store.RoleAdmin); err != nil {
+		t.Fatalf("UnassignRole failed: %v", err)
+	}
+	assert.Equal(t, http.StatusForbidden, get("/admin", int(adminID)))
+}
@@ -0,0 +1,266 @@
+// Package auth is the login, registration, MFA, password reset, admin,
+// OAuth 2.0 and OpenID Connect layer on top of store and sessionstore. A
+// program creates a Service from a Config and mounts its pages with
+// RegisterRoutes:
+//
+//	s, err := auth.NewService(config)
+//	...
+//	r := gin.Default()
+//	web.Mount(r)
+//	s.RegisterRoutes(r)
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/sessionstore"
+	"auth_module/store"
+)
+
+// Service is one configured instance of the module. It owns the
+// connection pool, the user store, the session store, the login throttler, the mailer and the
+// grant cache its handlers use, and shares none of them with other services,
+// so a program can embed it next to its own routes and tests can run several
+// instances with different settings side by side.
+type Service struct {
+	Config    *Config
+	DB        *sql.DB
+	Sessions  *sessionstore.SQLiteStore
+	Throttler *LoginThrottler
+	Mailer    Mailer
+	Grants    *store.GrantCache
+	Hasher    *store.PasswordHasher
+
+	// Users holds the accounts, in DB or wherever user_store says.
+	// Everything else about a user stays in DB.
+	Users store.UserStore
+
+	// Authenticators check passwords for LoginUser, in order. NewService
+	// sets up Users, followed by the directory if ldap.url is configured;
+	// programs may add their own.
+	Authenticators []Authenticator
+
+	totpKey        []byte
+	signingKeysKey []byte
+	keys           *keyCache
+	providers      map[string]*oidcProvider
+	httpClient     *http.Client
+	trustedProxies []netip.Prefix
+}
+
+// NewService applies defaults to a copy of config, validates it, opens
+// the database and migrates it to the latest schema. Configs returned by
+// LoadConfig pass validation; hand-built ones only need SessionSecretKey.
+func NewService(config *Config) (*Service, error) {
+	cfg := *config
+	cfg.applyDefaults()
+	if err := errors.Join(cfg.validate()...); err != nil {
+		return nil, err
+	}
+
+	db, err := store.OpenDB(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// validate has already rejected entries that do not parse.
+	trustedProxies, _ := parseTrustedProxies(cfg.TrustedProxies)
+
+	s := &Service{
+		Config:         &cfg,
+		DB:             db,
+		Grants:         store.NewGrantCache(store.GrantCacheTTL),
+		Hasher:         store.NewPasswordHasher(cfg.Argon2, cfg.Password),
+		totpKey:        deriveSecretKey("totp-secret", cfg.SessionSecretKey),
+		signingKeysKey: deriveSecretKey("oidc-signing-key", cfg.SessionSecretKey),
+		keys:           &keyCache{parsed: make(map[string]*signingKey)},
+		providers:      newOIDCProviders(cfg.OIDCProviders),
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		trustedProxies: trustedProxies,
+	}
+
+	switch cfg.UserStore {
+	case UserStoreSQLite:
+		s.Users = store.NewSQLiteUserStore(db, s.Hasher)
+	case UserStorePostgres:
+		users, err := store.OpenPostgresUserStore(context.Background(), cfg.PostgresDSN, s.Hasher)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		s.Users = users
+	}
+
+	s.Authenticators = []Authenticator{NewLocalAuthenticator(s.Users, db, s.Hasher)}
+	if cfg.LDAP.URL != "" {
+		directory, err := NewLDAPAuthenticator(cfg.LDAP, s.Users, db, s.Grants)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Authenticators = append(s.Authenticators, directory)
+	}
+
+	switch cfg.Mailer {
+	case MailerFile:
+		s.Mailer = &FileMailer{Dir: cfg.MailDir, From: cfg.MailFrom}
+	case MailerSMTP:
+		s.Mailer = &SMTPMailer{Addr: cfg.SMTPAddr, From: cfg.MailFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	case MailerMemory:
+		s.Mailer = NewMemoryMailer()
+	}
+
+	switch cfg.LoginThrottle {
+	case ThrottleStoreMemory:
+		s.Throttler = NewLoginThrottler(NewMemoryAttemptTracker())
+	case ThrottleStoreSQLite:
+		s.Throttler = NewLoginThrottler(NewSQLiteAttemptTracker(db))
+	}
+
+	s.Sessions = sessionstore.NewSQLiteStore(db, []byte(cfg.SessionSecretKey))
+	s.Sessions.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(cfg.SessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   cfg.CookieSecure,
+	}
+
+	return s, nil
+}
+
+// Close closes the database and the user store, if it has a connection of
+// its own. Stop any session sweeper first.
+func (s *Service) Close() error {
+	err := s.DB.Close()
+	if users, ok := s.Users.(io.Closer); ok {
+		err = errors.Join(err, users.Close())
+	}
+	return err
+}
+
+// RegisterRoutes adds the login, registration, account and admin pages and
+// the OAuth 2.0 and OpenID Connect endpoints to router, the pages behind
+// RequireCSRF. The engine router belongs to must render the templates from
+// package web and serve its static files under /static; web.Mount does both.
+func (s *Service) RegisterRoutes(router gin.IRouter) {
+	r := router.Group("/", s.SessionMiddleware(), s.RequireCSRF())
+
+	r.GET("/login", s.LoginPageHandler)
+	r.POST("/login", s.LoginHandler)
+
+	r.GET("/login/oidc/:provider", s.ExternalLoginHandler)
+	r.GET("/login/oidc/:provider/callback", s.ExternalCallbackHandler)
+
+	r.GET("/login/mfa", MFAPageHandler)
+	r.POST("/login/mfa", s.MFAHandler)
+
+	r.POST("/webauthn/login/begin", s.WebAuthnLoginBeginHandler)
+	r.POST("/webauthn/login/finish", s.WebAuthnLoginFinishHandler)
+
+	r.GET("/register", s.RegisterPageHandler)
+	r.POST("/register", s.RegisterHandler)
+
+	r.GET("/forgot-password", ForgotPasswordPageHandler)
+	r.POST("/forgot-password", s.ForgotPasswordHandler)
+	r.GET("/reset-password", ResetPasswordPageHandler)
+	r.POST("/reset-password", s.ResetPasswordHandler)
+
+	r.GET("/verify-email", s.VerifyEmailHandler)
+	r.POST("/verify-email/resend", s.ResendVerificationHandler)
+
+	r.GET("/logout", LogoutHandler)
+
+	r.GET("/oauth/authorize", s.OAuthAuthorizeHandler)
+	r.POST("/oauth/authorize", s.OAuthConsentHandler)
+	r.GET("/oauth/logout", s.EndSessionHandler)
+	r.POST("/oauth/logout", s.EndSessionHandler)
+
+	// Clients call these directly, authenticating themselves rather than
+	// a browser session, so they sit outside the session and CSRF checks.
+	router.POST("/oauth/token", s.OAuthTokenHandler)
+	router.POST("/oauth/revoke", s.OAuthRevokeHandler)
+	router.POST("/oauth/introspect", s.OAuthIntrospectHandler)
+	router.GET("/.well-known/openid-configuration", s.OIDCDiscoveryHandler)
+	router.GET("/oauth/jwks", s.JWKSHandler)
+	router.GET("/userinfo", s.UserInfoHandler)
+	router.POST("/userinfo", s.UserInfoHandler)
+
+	protected := r.Group("/")
+	protected.Use(s.AuthMiddleware())
+	{
+		protected.GET("/dashboard", func(c *gin.Context) {
+			session := c.MustGet("session").(*sessions.Session)
+			userID := session.Values["user_id"]
+			user, err := s.Users.ReadUser(c.Request.Context(), userID.(int))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+				return
+			}
+			renderHTML(c, http.StatusOK, "dashboard.html", gin.H{"UserID": userID, "Admin": user.Admin})
+		})
+	}
+
+	// The pages that change how the account signs in or who is signed in
+	// are for its owner only. A leaked token must not be able to swap the
+	// email for a password reset, enroll its own second factor or passkey,
+	// or sign the owner out.
+	account := protected.Group("/", sessionOnly())
+	{
+		account.GET("/account/email", s.EmailPageHandler)
+		account.POST("/account/email", s.UpdateEmailHandler)
+		account.GET("/mfa/setup", s.TOTPSetupPageHandler)
+		account.POST("/mfa/setup", s.TOTPSetupHandler)
+		account.GET("/passkeys", s.PasskeysPageHandler)
+		account.POST("/passkeys/:id/delete", s.DeletePasskeyHandler)
+		account.POST("/webauthn/register/begin", s.WebAuthnRegisterBeginHandler)
+		account.POST("/webauthn/register/finish", s.WebAuthnRegisterFinishHandler)
+		account.GET("/sessions", s.SessionsHandler)
+		account.POST("/sessions/:handle/revoke", s.RevokeSessionHandler)
+		account.POST("/sessions/revoke-others", s.RevokeOtherSessionsHandler)
+	}
+
+	tokens := protected.Group("/tokens", sessionOnly())
+	{
+		tokens.GET("", s.TokensPageHandler)
+		tokens.POST("", s.CreateTokenHandler)
+		tokens.POST("/:id/revoke", s.RevokeTokenHandler)
+	}
+
+	identities := protected.Group("/account/identities", sessionOnly())
+	{
+		identities.GET("", s.IdentitiesPageHandler)
+		identities.POST("/:provider/link", s.LinkIdentityHandler)
+		identities.POST("/:provider/unlink", s.UnlinkIdentityHandler)
+	}
+
+	admin := protected.Group("/admin")
+	admin.Use(s.RequireAdmin())
+	{
+		admin.GET("", s.AdminPageHandler)
+		users := admin.Group("/users", s.RequirePermission(store.PermissionManageUsers))
+		users.GET("", s.AdminUsersHandler)
+		users.POST("", s.AdminCreateUserHandler)
+		users.POST("/:id/rename", s.AdminRenameUserHandler)
+		users.POST("/:id/password", s.AdminResetPasswordHandler)
+		users.POST("/:id/admin", s.AdminSetAdminHandler)
+		users.POST("/:id/disable", s.AdminDisableUserHandler)
+		users.POST("/:id/enable", s.AdminEnableUserHandler)
+		users.POST("/:id/delete", s.AdminDeleteUserHandler)
+		lockouts := admin.Group("/lockouts", s.RequirePermission(store.PermissionManageUsers))
+		lockouts.GET("", s.AdminLockoutsHandler)
+		lockouts.POST("/unlock", s.AdminUnlockHandler)
+	}
+}
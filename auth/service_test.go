@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"auth_module/store"
+)
+
+// testHasher uses the default costs and policy, like a service whose config
+// leaves them unset.
+var testHasher = store.NewPasswordHasher(store.Argon2Config{}, store.PasswordPolicy{})
+
+// newTestService returns a service with a database of its own and an
+// in-memory mailer. configure, if not nil, adjusts the config first.
+func newTestService(t *testing.T, configure func(*Config)) *Service {
+	config := &Config{
+		SessionSecretKey: "test-secret-key",
+		Mailer:           MailerMemory,
+		Database:         store.DatabaseConfig{Path: filepath.Join(t.TempDir(), "users_test.db")},
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	s, err := NewService(config)
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestServicesAreIndependent(t *testing.T) {
+	t.Parallel()
+
+	strict := newTestService(t, func(config *Config) {
+		config.RegistrationMode = RegistrationOpen
+		config.Password.MinLength = 16
+	})
+	closed := newTestService(t, nil)
+
+	t.Run("Strict", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", nil)
+		if _, err := strict.RegisterUser(w, r, "shared", "ValidP@ssw0rd", "", ""); err == nil {
+			t.Errorf("Expected the stricter password policy to reject a 13 character password")
+		}
+		if _, err := strict.RegisterUser(w, r, "shared", "ValidP@ssw0rd!!!", "", ""); err != nil {
+			t.Fatalf("RegisterUser failed: %v", err)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", nil)
+		if _, err := closed.RegisterUser(w, r, "shared", "ValidP@ssw0rd!!!", "", ""); err != ErrRegistrationClosed {
+			t.Errorf("Expected ErrRegistrationClosed, got %v", err)
+		}
+		if _, err := store.CreateUserIfNotExists(context.Background(), closed.DB, closed.Hasher, "shared", "ValidP@ssw0rd"); err != nil {
+			t.Fatalf("Expected the default policy to accept the password, got %v", err)
+		}
+	})
+}
+
+func TestNewServiceRejectsInvalidConfig(t *testing.T) {
+	if _, err := NewService(&Config{}); err == nil {
+		t.Errorf("Expected a config without a session secret to be rejected")
+	}
+}
+
+// TestSeparateUserStore runs a service whose accounts live outside its
+// database, as with user_store: postgres, which turns foreign keys off.
+func TestSeparateUserStore(t *testing.T) {
+	s := newTestService(t, func(config *Config) {
+		foreignKeys := false
+		config.Database.ForeignKeys = &foreignKeys
+		config.RegistrationMode = RegistrationOpen
+	})
+	users := store.NewMemoryUserStore(s.Hasher)
+	s.Users = users
+	s.Authenticators = []Authenticator{NewLocalAuthenticator(users, s.DB, s.Hasher)}
+	ctx := context.Background()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/register", nil)
+	userID, err := s.RegisterUser(w, r, "separate", "ValidP@ssw0rd", "separate@example.com", "")
+	if err != nil {
+		t.Fatalf("RegisterUser failed: %v", err)
+	}
+	if exists, _ := store.UserExists(ctx, s.DB, "separate"); exists {
+		t.Errorf("Expected the user to be kept out of the database")
+	}
+	if _, err := s.RegisterUser(w, r, "another", "ValidP@ssw0rd", "separate@example.com", ""); err != store.ErrEmailExists {
+		t.Errorf("Expected ErrEmailExists from the user store, got %v", err)
+	}
+	if exists, _ := users.UserExists(ctx, "another"); exists {
+		t.Errorf("Expected a failed registration to leave no user behind")
+	}
+
+	token := verificationTokenFromMessage(t, s, s.Mailer.(*MemoryMailer).Messages()[0])
+	if _, err := VerifyEmail(ctx, s.DB, s.Users, token, time.Now()); err != nil {
+		t.Fatalf("VerifyEmail failed: %v", err)
+	}
+	if user, _ := users.ReadUser(ctx, userID); !user.EmailVerified {
+		t.Errorf("Expected the email to be verified in the user store, got %+v", user)
+	}
+
+	w = httptest.NewRecorder()
+	if _, err := s.LoginUser(w, r, "separate", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	now := time.Now()
+	secret, _, err := CreateAPIToken(ctx, s.DB, userID, "script", []string{ScopeRead}, time.Time{}, now)
+	if err != nil {
+		t.Fatalf("CreateAPIToken failed: %v", err)
+	}
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, secret, now); err != nil {
+		t.Fatalf("LookupAPIToken failed: %v", err)
+	}
+	if err := s.SetUserDisabled(ctx, userID, true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if _, err := LookupAPIToken(ctx, s.DB, s.Users, secret, now); err != ErrInvalidAPIToken {
+		t.Errorf("Expected the token of a disabled user to be rejected, got %v", err)
+	}
+
+	if err := s.DeleteUser(ctx, userID); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	tokens, err := ListAPITokens(ctx, s.DB, userID)
+	if err != nil {
+		t.Fatalf("ListAPITokens failed: %v", err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("Expected the user's tokens to be deleted with them, got %+v", tokens)
+	}
+}
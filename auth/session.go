@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+func (s *Service) SetSession(w http.ResponseWriter, r *http.Request, name string, value interface{}) error {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+	session.Values[name] = value
+	return session.Save(r, w)
+}
+
+func (s *Service) GetSession(r *http.Request, name string) (interface{}, error) {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return nil, err
+	}
+	return session.Values[name], nil
+}
+
+func (s *Service) ClearSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	for key := range session.Values {
+		delete(session.Values, key)
+	}
+
+	session.Options.MaxAge = -1
+
+	err = session.Save(r, w)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Service) SessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := s.Sessions.Get(c.Request, "session-name")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get session"})
+			return
+		}
+
+		c.Set("session", session)
+
+		c.Next()
+	}
+}
+
+// AuthMiddleware lets through requests from a signed-in session or with an
+// "Authorization: Bearer" API token. Either way the handlers that follow find
+// the caller's user_id in the "session" context value.
+func (s *Service) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := bearerToken(c.Request); ok {
+			s.authenticateAPIToken(c, token)
+			return
+		}
+
+		// Attempt to retrieve the session
+		session, exists := c.Get("session")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Session not found"})
+			c.Abort()
+			return
+		}
+
+		if _, pending := session.(*sessions.Session).Values["mfa_pending_user_id"]; pending {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Second factor verification pending"})
+			c.Abort()
+			return
+		}
+
+		userID, ok := session.(*sessions.Session).Values["user_id"]
+		if !ok || userID == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User ID not found in session"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,6 +1,7 @@
-package main
+package auth
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -9,28 +10,34 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
 )
 
 func TestSetSession(t *testing.T) {
+	s := newTestService(t, nil)
+
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/", nil)
 
-	err := SetSession(w, r, "username", "testuser")
+	err := s.SetSession(w, r, "username", "testuser")
 	if err != nil {
 		t.Fatalf("SetSession failed: %v", err)
 	}
 
-	session, _ := sessionStore.Get(r, "session-name")
+	session, _ := s.Sessions.Get(r, "session-name")
 	if session.Values["username"] != "testuser" {
 		t.Errorf("Expected session value 'testuser', got '%v'", session.Values["username"])
 	}
 }
 
 func TestGetSession(t *testing.T) {
+	s := newTestService(t, nil)
+
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/", nil)
 
-	session, _ := sessionStore.Get(r, "session-name")
+	session, _ := s.Sessions.Get(r, "session-name")
 	session.Values["username"] = "testuser"
 	session.Save(r, w)
 
@@ -38,7 +45,7 @@ func TestGetSession(t *testing.T) {
 	r = httptest.NewRequest("GET", "/", nil)
 	r.AddCookie(cookie)
 
-	value, err := GetSession(r, "username")
+	value, err := s.GetSession(r, "username")
 	if err != nil {
 		t.Fatalf("GetSession failed: %v", err)
 	}
@@ -49,17 +56,19 @@ func TestGetSession(t *testing.T) {
 }
 
 func TestClearSession(t *testing.T) {
+	s := newTestService(t, nil)
+
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/", nil)
 
-	session, _ := sessionStore.Get(r, "session-name")
+	session, _ := s.Sessions.Get(r, "session-name")
 	session.Values["username"] = "testuser"
 	err := session.Save(r, w)
 	if err != nil {
 		t.Fatalf("Failed to save session: %v", err)
 	}
 
-	err = ClearSession(w, r)
+	err = s.ClearSession(w, r)
 	if err != nil {
 		t.Fatalf("ClearSession failed: %v", err)
 	}
@@ -67,7 +76,7 @@ func TestClearSession(t *testing.T) {
 	r = httptest.NewRequest("GET", "/", nil)
 	r.Header.Del("Cookie")
 
-	session, err = sessionStore.Get(r, "session-name")
+	session, err = s.Sessions.Get(r, "session-name")
 	if err != nil {
 		t.Fatalf("Failed to get session: %v", err)
 	}
@@ -80,11 +89,18 @@ func TestClearSession(t *testing.T) {
 func TestAuthMiddleware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
+	s := newTestService(t, nil)
+
+	// Sessions reference users, so user 1 has to exist.
+	if _, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, "testuser", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
 	router := gin.Default()
-	router.Use(SessionMiddleware())
+	router.Use(s.SessionMiddleware())
 
 	protected := router.Group("/")
-	protected.Use(AuthMiddleware())
+	protected.Use(s.AuthMiddleware())
 	{
 		protected.GET("/dashboard", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": "Welcome to the dashboard"})
@@ -108,7 +124,7 @@ func TestAuthMiddleware(t *testing.T) {
 		w := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", "/dashboard", nil)
 
-		session := sessions.NewSession(sessionStore, "session-name")
+		session := sessions.NewSession(s.Sessions, "session-name")
 		session.Values["user_id"] = 1
 		session.Save(req, w)
 
@@ -122,3 +138,45 @@ func TestAuthMiddleware(t *testing.T) {
 		assert.Equal(t, "Welcome to the dashboard", response["message"])
 	})
 }
+
+func TestAuthMiddlewareRevokedSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+
+	// Sessions reference users, so user 1 has to exist.
+	if _, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, "testuser", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	router := gin.Default()
+	router.Use(s.SessionMiddleware())
+
+	protected := router.Group("/")
+	protected.Use(s.AuthMiddleware())
+	{
+		protected.GET("/dashboard", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"message": "Welcome to the dashboard"})
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/dashboard", nil)
+
+	session := sessions.NewSession(s.Sessions, "session-name")
+	session.Values["user_id"] = 1
+	session.Save(req, w)
+	cookie := w.Header().Get("Set-Cookie")
+
+	err := s.Sessions.RevokeOtherSessions(1, "")
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions failed: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/dashboard", nil)
+	req.Header.Set("Cookie", cookie)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
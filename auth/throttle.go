@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ThrottleFreeAttempts      = 3
+	ThrottleBaseDelay         = time.Second
+	ThrottleMaxDelay          = 15 * time.Minute
+	ThrottleWindow            = time.Hour
+	LockoutThreshold          = 10
+	LockoutDuration           = 30 * time.Minute
+	ThrottleStoreMemory       = "memory"
+	ThrottleStoreSQLite       = "sqlite"
+	throttleUsernameKeyPrefix = "user:"
+	throttleIPKeyPrefix       = "ip:"
+)
+
+var ErrAccountNotLocked = errors.New("account is not locked")
+
+// Lockout records an account that was locked after too many failed logins.
+type Lockout struct {
+	Username    string
+	LockedAt    time.Time
+	LockedUntil time.Time
+}
+
+// AttemptTracker stores failed login counters and account lockouts.
+// RecordFailure increments the counter for key, starting over from one when
+// the previous failure is older than window, and returns the new count.
+// Prune deletes counters whose last failure is older than window, which
+// would start over anyway, and lockouts that have ended.
+type AttemptTracker interface {
+	RecordFailure(key string, now time.Time, window time.Duration) (int, error)
+	Failures(key string) (int, time.Time, error)
+	Reset(key string) error
+	Lock(username string, now, until time.Time) error
+	LockedUntil(username string) (time.Time, error)
+	Unlock(username string) error
+	Lockouts(now time.Time) ([]Lockout, error)
+	Prune(now time.Time, window time.Duration) (int64, error)
+}
+
+// LoginThrottler applies exponential backoff to failed logins per username
+// and per client IP, and locks accounts that keep failing.
+type LoginThrottler struct {
+	Tracker AttemptTracker
+}
+
+func NewLoginThrottler(tracker AttemptTracker) *LoginThrottler {
+	return &LoginThrottler{Tracker: tracker}
+}
+
+// Check returns how long the caller has to wait before another login attempt
+// for username from ip is allowed. Zero means the attempt may proceed. An
+// empty username only checks the IP.
+func (t *LoginThrottler) Check(username, ip string, now time.Time) (time.Duration, error) {
+	var retryAfter time.Duration
+
+	if username != "" {
+		lockedUntil, err := t.Tracker.LockedUntil(username)
+		if err != nil {
+			return 0, err
+		}
+		if now.Before(lockedUntil) {
+			retryAfter = lockedUntil.Sub(now)
+		}
+	}
+
+	for _, key := range throttleKeys(username, ip) {
+		failures, lastFailure, err := t.Tracker.Failures(key)
+		if err != nil {
+			return 0, err
+		}
+		if now.Sub(lastFailure) > ThrottleWindow {
+			continue
+		}
+
+		wait := lastFailure.Add(backoffDelay(failures)).Sub(now)
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	return retryAfter, nil
+}
+
+func (t *LoginThrottler) Failure(username, ip string, now time.Time) error {
+	for _, key := range throttleKeys(username, ip) {
+		failures, err := t.Tracker.RecordFailure(key, now, ThrottleWindow)
+		if err != nil {
+			return err
+		}
+
+		if key == throttleUsernameKeyPrefix+username && failures >= LockoutThreshold {
+			if err := t.Tracker.Lock(username, now, now.Add(LockoutDuration)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Success clears the per-account counter. The per-IP counter is left alone so
+// that logging into one's own account does not reset guessing elsewhere.
+func (t *LoginThrottler) Success(username string) error {
+	if username == "" {
+		return nil
+	}
+	return t.Tracker.Reset(throttleUsernameKeyPrefix + username)
+}
+
+// UnlockAccount lifts a lockout and clears the account's failure counter.
+func (t *LoginThrottler) UnlockAccount(username string) error {
+	if err := t.Tracker.Unlock(username); err != nil {
+		return err
+	}
+	return t.Tracker.Reset(throttleUsernameKeyPrefix + username)
+}
+
+// StartSweeper prunes stale counters and ended lockouts every interval until
+// the returned function is called. Without it every username and IP that
+// ever failed a login stays in the tracker.
+func (t *LoginThrottler) StartSweeper(interval time.Duration) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pruned, err := t.Tracker.Prune(time.Now(), ThrottleWindow)
+				if err != nil {
+					log.Printf("Failed to prune login attempts: %v", err)
+				} else if pruned > 0 {
+					log.Printf("Pruned %d stale login attempts and lockouts", pruned)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func throttleKeys(username, ip string) []string {
+	keys := make([]string, 0, 2)
+	if username != "" {
+		keys = append(keys, throttleUsernameKeyPrefix+username)
+	}
+	if ip != "" {
+		keys = append(keys, throttleIPKeyPrefix+ip)
+	}
+	return keys
+}
+
+func backoffDelay(failures int) time.Duration {
+	if failures <= ThrottleFreeAttempts {
+		return 0
+	}
+
+	delay := ThrottleBaseDelay
+	for i := ThrottleFreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= ThrottleMaxDelay {
+			return ThrottleMaxDelay
+		}
+	}
+	return delay
+}
+
+type memoryAttempt struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// MemoryAttemptTracker keeps counters in process memory. State is lost on
+// restart and not shared between instances.
+type MemoryAttemptTracker struct {
+	mu       sync.Mutex
+	attempts map[string]memoryAttempt
+	lockouts map[string]Lockout
+}
+
+func NewMemoryAttemptTracker() *MemoryAttemptTracker {
+	return &MemoryAttemptTracker{
+		attempts: make(map[string]memoryAttempt),
+		lockouts: make(map[string]Lockout),
+	}
+}
+
+func (m *MemoryAttemptTracker) RecordFailure(key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt := m.attempts[key]
+	if now.Sub(attempt.lastFailure) > window {
+		attempt.failures = 0
+	}
+	attempt.failures++
+	attempt.lastFailure = now
+	m.attempts[key] = attempt
+
+	return attempt.failures, nil
+}
+
+func (m *MemoryAttemptTracker) Failures(key string) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt := m.attempts[key]
+	return attempt.failures, attempt.lastFailure, nil
+}
+
+func (m *MemoryAttemptTracker) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemoryAttemptTracker) Lock(username string, now, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lockouts[username] = Lockout{Username: username, LockedAt: now, LockedUntil: until}
+	return nil
+}
+
+func (m *MemoryAttemptTracker) LockedUntil(username string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lockouts[username].LockedUntil, nil
+}
+
+func (m *MemoryAttemptTracker) Unlock(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.lockouts[username]; !ok {
+		return ErrAccountNotLocked
+	}
+	delete(m.lockouts, username)
+	return nil
+}
+
+func (m *MemoryAttemptTracker) Lockouts(now time.Time) ([]Lockout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lockouts := make([]Lockout, 0, len(m.lockouts))
+	for _, lockout := range m.lockouts {
+		if now.Before(lockout.LockedUntil) {
+			lockouts = append(lockouts, lockout)
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].LockedAt.Before(lockouts[j].LockedAt) })
+
+	return lockouts, nil
+}
+
+func (m *MemoryAttemptTracker) Prune(now time.Time, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pruned int64
+	for key, attempt := range m.attempts {
+		if now.Sub(attempt.lastFailure) > window {
+			delete(m.attempts, key)
+			pruned++
+		}
+	}
+	for username, lockout := range m.lockouts {
+		if !now.Before(lockout.LockedUntil) {
+			delete(m.lockouts, username)
+			pruned++
+		}
+	}
+
+	return pruned, nil
+}
+
+// SQLiteAttemptTracker keeps counters in the login_attempts and
+// account_lockouts tables so they survive restarts.
+type SQLiteAttemptTracker struct {
+	db *sql.DB
+}
+
+func NewSQLiteAttemptTracker(db *sql.DB) *SQLiteAttemptTracker {
+	return &SQLiteAttemptTracker{db: db}
+}
+
+func (s *SQLiteAttemptTracker) RecordFailure(key string, now time.Time, window time.Duration) (int, error) {
+	var failures int
+	err := s.db.QueryRow(`
+		INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 1, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END,
+			last_failure = excluded.last_failure
+		RETURNING failures`,
+		key, now.UnixNano(), now.Add(-window).UnixNano()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return failures, nil
+}
+
+func (s *SQLiteAttemptTracker) Failures(key string) (int, time.Time, error) {
+	var failures int
+	var lastFailure int64
+	err := s.db.QueryRow("SELECT failures, last_failure FROM login_attempts WHERE key = ?", key).Scan(&failures, &lastFailure)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failures, time.Unix(0, lastFailure), nil
+}
+
+func (s *SQLiteAttemptTracker) Reset(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE key = ?", key)
+	return err
+}
+
+func (s *SQLiteAttemptTracker) Lock(username string, now, until time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO account_lockouts (username, locked_at, locked_until) VALUES (?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET locked_at = excluded.locked_at, locked_until = excluded.locked_until`,
+		username, now.Unix(), until.Unix())
+	return err
+}
+
+func (s *SQLiteAttemptTracker) LockedUntil(username string) (time.Time, error) {
+	var lockedUntil int64
+	err := s.db.QueryRow("SELECT locked_until FROM account_lockouts WHERE username = ?", username).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(lockedUntil, 0), nil
+}
+
+func (s *SQLiteAttemptTracker) Unlock(username string) error {
+	result, err := s.db.Exec("DELETE FROM account_lockouts WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAccountNotLocked
+	}
+	return nil
+}
+
+func (s *SQLiteAttemptTracker) Lockouts(now time.Time) ([]Lockout, error) {
+	rows, err := s.db.Query("SELECT username, locked_at, locked_until FROM account_lockouts WHERE locked_until > ? ORDER BY locked_at", now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []Lockout
+	for rows.Next() {
+		var lockout Lockout
+		var lockedAt, lockedUntil int64
+		if err := rows.Scan(&lockout.Username, &lockedAt, &lockedUntil); err != nil {
+			return nil, err
+		}
+		lockout.LockedAt = time.Unix(lockedAt, 0)
+		lockout.LockedUntil = time.Unix(lockedUntil, 0)
+		lockouts = append(lockouts, lockout)
+	}
+
+	return lockouts, rows.Err()
+}
+
+func (s *SQLiteAttemptTracker) Prune(now time.Time, window time.Duration) (int64, error) {
+	attempts, err := s.db.Exec("DELETE FROM login_attempts WHERE last_failure < ?", now.Add(-window).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	lockouts, err := s.db.Exec("DELETE FROM account_lockouts WHERE locked_until <= ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	prunedAttempts, err := attempts.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	prunedLockouts, err := lockouts.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return prunedAttempts + prunedLockouts, nil
+}
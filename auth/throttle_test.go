@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	testCases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{ThrottleFreeAttempts, 0},
+		{ThrottleFreeAttempts + 1, ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 2, 2 * ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 4, 8 * ThrottleBaseDelay},
+		{1000, ThrottleMaxDelay},
+	}
+
+	for _, tc := range testCases {
+		if delay := backoffDelay(tc.failures); delay != tc.delay {
+			t.Errorf("Expected delay %v after %d failures, got %v", tc.delay, tc.failures, delay)
+		}
+	}
+}
+
+func TestLoginThrottler(t *testing.T) {
+	db := newTestService(t, nil).DB
+
+	trackers := map[string]AttemptTracker{
+		"Memory": NewMemoryAttemptTracker(),
+		"SQLite": NewSQLiteAttemptTracker(db),
+	}
+
+	for name, tracker := range trackers {
+		t.Run(name, func(t *testing.T) {
+			throttler := NewLoginThrottler(tracker)
+			now := time.Now()
+
+			for i := 0; i < ThrottleFreeAttempts; i++ {
+				if err := throttler.Failure("victim", "198.51.100.1", now); err != nil {
+					t.Fatalf("Failure failed: %v", err)
+				}
+			}
+
+			retryAfter, err := throttler.Check("victim", "198.51.100.1", now)
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if retryAfter != 0 {
+				t.Errorf("Expected no delay within the free attempts, got %v", retryAfter)
+			}
+
+			throttler.Failure("victim", "198.51.100.1", now)
+
+			retryAfter, _ = throttler.Check("victim", "198.51.100.2", now)
+			if retryAfter != ThrottleBaseDelay {
+				t.Errorf("Expected per-account delay %v from another IP, got %v", ThrottleBaseDelay, retryAfter)
+			}
+
+			retryAfter, _ = throttler.Check("someoneelse", "198.51.100.1", now)
+			if retryAfter != ThrottleBaseDelay {
+				t.Errorf("Expected per-IP delay %v for another account, got %v", ThrottleBaseDelay, retryAfter)
+			}
+
+			retryAfter, _ = throttler.Check("victim", "198.51.100.2", now.Add(ThrottleBaseDelay))
+			if retryAfter != 0 {
+				t.Errorf("Expected delay to elapse, got %v", retryAfter)
+			}
+
+			for i := ThrottleFreeAttempts + 1; i < LockoutThreshold; i++ {
+				throttler.Failure("victim", "", now)
+			}
+
+			lockouts, err := tracker.Lockouts(now)
+			if err != nil {
+				t.Fatalf("Lockouts failed: %v", err)
+			}
+			if len(lockouts) != 1 || lockouts[0].Username != "victim" {
+				t.Fatalf("Expected victim to be locked out, got %+v", lockouts)
+			}
+
+			retryAfter, _ = throttler.Check("victim", "", now.Add(ThrottleMaxDelay+time.Second))
+			if retryAfter <= 0 {
+				t.Errorf("Expected locked account to stay throttled until the lockout ends")
+			}
+
+			if err := throttler.UnlockAccount("victim"); err != nil {
+				t.Fatalf("UnlockAccount failed: %v", err)
+			}
+			if err := throttler.UnlockAccount("victim"); err != ErrAccountNotLocked {
+				t.Errorf("Expected ErrAccountNotLocked, got %v", err)
+			}
+
+			retryAfter, _ = throttler.Check("victim", "", now)
+			if retryAfter != 0 {
+				t.Errorf("Expected unlocked account to be allowed, got %v", retryAfter)
+			}
+
+			// Only the counter of 198.51.100.1 and the ended lockout are
+			// stale an hour later.
+			throttler.Failure("", "198.51.100.3", now.Add(ThrottleWindow))
+			tracker.Lock("expired", now, now.Add(time.Minute))
+			pruned, err := tracker.Prune(now.Add(ThrottleWindow+time.Second), ThrottleWindow)
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+			if pruned != 2 {
+				t.Errorf("Expected 2 entries to be pruned, got %d", pruned)
+			}
+			if failures, _, _ := tracker.Failures(throttleIPKeyPrefix + "198.51.100.3"); failures != 1 {
+				t.Errorf("Expected the recent failure to be kept, got %d", failures)
+			}
+		})
+	}
+}
+
+func TestLoginHandlerThrottling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+
+	router := gin.Default()
+	router.POST("/login", s.LoginHandler)
+
+	attempt := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", "nosuchuser")
+		form.Add("password", "wrongpassword")
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.PostForm = form
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i <= ThrottleFreeAttempts; i++ {
+		w := attempt()
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w := attempt()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestMFAHandlerThrottling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	router := gin.New()
+	web.Mount(router)
+	s.RegisterRoutes(router)
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, "mfauser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	secret, err := s.BeginTOTPEnrollment(int(userID))
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+	if _, err := s.ConfirmTOTPEnrollment(int(userID), GenerateTOTP(secret, time.Now())); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment failed: %v", err)
+	}
+
+	browser := newTestBrowser(router)
+	w := browser.post("/login", browser.get("/login").Body.String(), url.Values{"username": {"mfauser"}, "password": {"ValidP@ssw0rd"}})
+	assert.Equal(t, "/login/mfa", w.Header().Get("HX-Redirect"))
+
+	page := browser.get("/login/mfa").Body.String()
+	for i := 0; i <= ThrottleFreeAttempts; i++ {
+		w = browser.post("/login/mfa", page, url.Values{"code": {"000000"}})
+		assert.Contains(t, w.Body.String(), "Invalid authentication code")
+	}
+	w = browser.post("/login/mfa", page, url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// The failures count against the account, not just the IP they came from.
+	retryAfter, err := s.Throttler.Check("mfauser", "203.0.113.9", time.Now())
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	assert.Positive(t, retryAfter)
+}
+
+func TestLoginThrottleIgnoresForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	attempt := func(router http.Handler, i int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.PostForm = url.Values{"username": {fmt.Sprintf("nosuchuser%d", i)}, "password": {"wrongpassword"}}
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// gin.Default believes X-Forwarded-For from anyone; the throttler must
+	// not, or every attempt would count against a different address.
+	s := newTestService(t, nil)
+	router := gin.Default()
+	router.POST("/login", s.LoginHandler)
+	for i := 0; i <= ThrottleFreeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt(router, i).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, attempt(router, ThrottleFreeAttempts+1).Code)
+
+	// Behind a trusted proxy the forwarded addresses are the clients.
+	proxied := newTestService(t, func(config *Config) {
+		config.TrustedProxies = []string{"192.0.2.0/24"}
+	})
+	router = gin.Default()
+	router.POST("/login", proxied.LoginHandler)
+	for i := 0; i <= ThrottleFreeAttempts+1; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt(router, i).Code)
+	}
+
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9, 192.0.2.5")
+	assert.Equal(t, "203.0.113.9", proxied.clientIP(req))
+	assert.Equal(t, "192.0.2.1", s.clientIP(req))
+}
@@ -0,0 +1,593 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	qrcode "github.com/skip2/go-qrcode"
+
+	"auth_module/store"
+)
+
+const (
+	TOTPIssuer        = "nope.tools"
+	TOTPDigits        = 6
+	TOTPPeriod        = 30
+	TOTPSecretLen     = 20
+	TOTPSkew          = 1
+	RecoveryCodeCount = 10
+	MFAPendingTimeout = 5 * time.Minute
+)
+
+var (
+	ErrMFARequired        = errors.New("second factor required")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("two-factor enrollment has not been started")
+	ErrInvalidTOTPCode    = errors.New("invalid authentication code")
+	ErrMFANotPending      = errors.New("no login is waiting for a second factor")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTP computes the RFC 6238 code for secret at time t using
+// HMAC-SHA1, TOTPPeriod second steps and TOTPDigits digits.
+func GenerateTOTP(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(t.Unix()/TOTPPeriod))
+}
+
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
+
+// matchTOTP returns the time step code was generated for, allowing TOTPSkew
+// steps of clock drift in either direction.
+func matchTOTP(secret []byte, code string, t time.Time) (int64, bool) {
+	step := t.Unix() / TOTPPeriod
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		candidate := hotp(secret, uint64(step+int64(i)))
+		if hmac.Equal([]byte(candidate), []byte(code)) {
+			return step + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+func TOTPURI(username string, secret []byte) string {
+	label := url.PathEscape(TOTPIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", totpEncoding.EncodeToString(secret))
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(TOTPPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// deriveSecretKey turns the session secret into an AES key for encrypting
+// secrets at rest. purpose keeps the keys for TOTP secrets and signing keys
+// apart.
+func deriveSecretKey(purpose, sessionSecret string) []byte {
+	key := sha256.Sum256([]byte(purpose + ":" + sessionSecret))
+	return key[:]
+}
+
+func encryptSecret(key, secret []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, secret, nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(key []byte, encoded string) ([]byte, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func TOTPEnabled(db *sql.DB, userID int) (bool, error) {
+	var enabled bool
+	query := "SELECT COUNT(1) FROM user_totp WHERE user_id = ? AND confirmed = 1"
+	err := db.QueryRow(query, userID).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// BeginTOTPEnrollment stores a fresh, unconfirmed secret for the user and
+// returns it. Starting over replaces any previous unconfirmed secret.
+func (s *Service) BeginTOTPEnrollment(userID int) ([]byte, error) {
+	db := s.DB
+
+	enabled, err := TOTPEnabled(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret := make([]byte, TOTPSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	encrypted, err := encryptSecret(s.totpKey, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_totp (user_id, secret, confirmed, last_used_step) VALUES (?, ?, 0, 0)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, confirmed = 0, last_used_step = 0`,
+		userID, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication once the user
+// proves their authenticator works, and returns newly issued recovery codes.
+// The plain codes are only ever available here.
+func (s *Service) ConfirmTOTPEnrollment(userID int, code string) ([]string, error) {
+	db := s.DB
+
+	var encrypted string
+	var confirmed bool
+	err := db.QueryRow("SELECT secret, confirmed FROM user_totp WHERE user_id = ?", userID).Scan(&encrypted, &confirmed)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := decryptSecret(s.totpKey, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	codes, err := generateRecoveryCodes(db, s.Hasher, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("UPDATE user_totp SET confirmed = 1, last_used_step = ? WHERE user_id = ?", step, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyTOTP checks code against the user's confirmed secret. A code is only
+// accepted once so it cannot be replayed within its validity window.
+func (s *Service) VerifyTOTP(userID int, code string) (bool, error) {
+	db := s.DB
+
+	var encrypted string
+	var lastUsedStep int64
+	query := "SELECT secret, last_used_step FROM user_totp WHERE user_id = ? AND confirmed = 1"
+	err := db.QueryRow(query, userID).Scan(&encrypted, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := decryptSecret(s.totpKey, encrypted)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok || step <= lastUsedStep {
+		return false, nil
+	}
+
+	result, err := db.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func generateRecoveryCodes(db *sql.DB, hasher *store.PasswordHasher, userID int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		buf := make([]byte, 6)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		code := raw[:5] + "-" + raw[5:]
+
+		hashedCode, err := hasher.HashPassword(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashedCode)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes.
+func UseRecoveryCode(db *sql.DB, userID int, code string) (bool, error) {
+	rows, err := db.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return false, err
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	matchedID := 0
+	for rows.Next() {
+		var id int
+		var codeHash string
+		if err := rows.Scan(&id, &codeHash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if store.CheckPasswordHash(normalized, codeHash) {
+			matchedID = id
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if matchedID == 0 {
+		return false, nil
+	}
+
+	result, err := db.Exec("UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", matchedID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(strings.ReplaceAll(code, "-", ""), " ", "")
+}
+
+// beginMFALogin records that the password check passed and a second factor
+// is still outstanding. The session carries no user_id until
+// CompleteMFALogin succeeds, so AuthMiddleware keeps refusing it. Like
+// finishLogin it renews the session ID and drops the CSRF token.
+func (s *Service) beginMFALogin(w http.ResponseWriter, r *http.Request, userID int) error {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Sessions.Renew(session); err != nil {
+		return err
+	}
+	delete(session.Values, "user_id")
+	delete(session.Values, csrfSessionKey)
+	session.Values["mfa_pending_user_id"] = userID
+	session.Values["mfa_pending_at"] = time.Now().Unix()
+	return session.Save(r, w)
+}
+
+func (s *Service) CompleteMFALogin(w http.ResponseWriter, r *http.Request, code, recoveryCode string) (int, error) {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return 0, err
+	}
+
+	userID, ok := session.Values["mfa_pending_user_id"].(int)
+	if !ok {
+		return 0, ErrMFANotPending
+	}
+	pendingAt, _ := session.Values["mfa_pending_at"].(int64)
+	if time.Since(time.Unix(pendingAt, 0)) > MFAPendingTimeout {
+		delete(session.Values, "mfa_pending_user_id")
+		delete(session.Values, "mfa_pending_at")
+		if err := session.Save(r, w); err != nil {
+			return 0, err
+		}
+		return 0, ErrMFANotPending
+	}
+
+	var verified bool
+	if recoveryCode != "" {
+		verified, err = UseRecoveryCode(s.DB, userID, recoveryCode)
+	} else {
+		verified, err = s.VerifyTOTP(userID, code)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !verified {
+		return 0, ErrInvalidTOTPCode
+	}
+
+	user, err := s.Users.ReadUser(r.Context(), userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.admitLogin(w, r, user, user.Username, false); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// finishLogin marks the session as authenticated for userID under a new
+// session ID, dropping any pending second-factor state. The CSRF token goes
+// too: one seen before login must not be good for the signed-in session, so
+// RequireCSRF mints a fresh one on the next page.
+func (s *Service) finishLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, userID int) error {
+	if err := s.Sessions.Renew(session); err != nil {
+		return err
+	}
+	delete(session.Values, "mfa_pending_user_id")
+	delete(session.Values, "mfa_pending_at")
+	delete(session.Values, csrfSessionKey)
+	session.Values["user_id"] = userID
+	session.Values[authTimeKey] = time.Now().Unix()
+	return session.Save(r, w)
+}
+
+// MFAEnabled reports whether the user must present a second factor (a TOTP
+// code or a registered security key) after their password.
+func MFAEnabled(db *sql.DB, userID int) (bool, error) {
+	enabled, err := TOTPEnabled(db, userID)
+	if err != nil || enabled {
+		return enabled, err
+	}
+	return HasWebAuthnCredentials(db, userID)
+}
+
+// pendingMFAUsername returns the username of the account waiting for its
+// second factor in the request's session, or "" if there is none. Wrong codes
+// count against that account like wrong passwords, so guessing codes ends in
+// a lockout rather than only slowing down one IP.
+func (s *Service) pendingMFAUsername(r *http.Request) (string, error) {
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return "", err
+	}
+	userID, ok := session.Values["mfa_pending_user_id"].(int)
+	if !ok {
+		return "", nil
+	}
+
+	user, err := s.Users.ReadUser(r.Context(), userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+func MFAPageHandler(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "mfa.html", nil)
+}
+
+func (s *Service) MFAHandler(c *gin.Context) {
+	username, err := s.pendingMFAUsername(c.Request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify authentication code"})
+		return
+	}
+	if s.throttled(c, username) {
+		return
+	}
+
+	_, err = s.CompleteMFALogin(c.Writer, c.Request, c.PostForm("code"), c.PostForm("recovery_code"))
+	switch {
+	case errors.Is(err, ErrMFANotPending):
+		c.Header("HX-Redirect", "/login")
+		c.Status(http.StatusOK)
+		return
+	case errors.Is(err, ErrInvalidTOTPCode):
+		s.recordLoginFailure(c.Request, username)
+		renderHTML(c, http.StatusOK, "mfa.html", gin.H{"ErrorMessage": "Invalid authentication code"})
+		return
+	case errors.Is(err, store.ErrUserDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	case errors.Is(err, ErrEmailNotVerified):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify authentication code"})
+		return
+	}
+
+	c.Header("HX-Redirect", loginRedirect(c))
+	c.Status(http.StatusOK)
+}
+
+func (s *Service) TOTPSetupPageHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	secret, err := s.BeginTOTPEnrollment(userID)
+	if errors.Is(err, ErrTOTPAlreadyEnabled) {
+		renderHTML(c, http.StatusOK, "mfa_setup.html", gin.H{"Enabled": true})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor enrollment"})
+		return
+	}
+
+	renderTOTPSetup(c, s.Users, userID, secret, "")
+}
+
+func (s *Service) TOTPSetupHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	codes, err := s.ConfirmTOTPEnrollment(userID, c.PostForm("code"))
+	switch {
+	case errors.Is(err, ErrInvalidTOTPCode):
+		secret, err := s.pendingTOTPSecret(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor enrollment"})
+			return
+		}
+		renderTOTPSetup(c, s.Users, userID, secret, "Invalid authentication code")
+		return
+	case errors.Is(err, ErrTOTPNotEnrolled):
+		c.Header("HX-Redirect", "/mfa/setup")
+		c.Status(http.StatusOK)
+		return
+	case errors.Is(err, ErrTOTPAlreadyEnabled):
+		renderHTML(c, http.StatusOK, "mfa_setup.html", gin.H{"Enabled": true})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm two-factor enrollment"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "mfa_setup.html", gin.H{"Enabled": true, "RecoveryCodes": codes})
+}
+
+func (s *Service) pendingTOTPSecret(userID int) ([]byte, error) {
+	var encrypted string
+	err := s.DB.QueryRow("SELECT secret FROM user_totp WHERE user_id = ? AND confirmed = 0", userID).Scan(&encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return decryptSecret(s.totpKey, encrypted)
+}
+
+func renderTOTPSetup(c *gin.Context, users store.UserStore, userID int, secret []byte, errorMessage string) {
+	user, err := users.ReadUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	uri := TOTPURI(user.Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "mfa_setup.html", gin.H{
+		"ErrorMessage": errorMessage,
+		"URI":          uri,
+		"Secret":       totpEncoding.EncodeToString(secret),
+		"QRCode":       template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	})
+}
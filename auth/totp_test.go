@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth_module/store"
+)
+
+func TestGenerateTOTP(t *testing.T) {
+	// RFC 6238 appendix B SHA1 vectors, truncated to six digits.
+	secret := []byte("12345678901234567890")
+
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tc := range testCases {
+		code := GenerateTOTP(secret, time.Unix(tc.unix, 0))
+		if code != tc.code {
+			t.Errorf("Expected code %s at %d, got %s", tc.code, tc.unix, code)
+		}
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, "totpuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	secret, err := s.BeginTOTPEnrollment(int(userID))
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+
+	enabled, _ := TOTPEnabled(db, int(userID))
+	if enabled {
+		t.Errorf("Expected TOTP to stay disabled until confirmed")
+	}
+
+	var stored string
+	db.QueryRow("SELECT secret FROM user_totp WHERE user_id = ?", userID).Scan(&stored)
+	if stored == totpEncoding.EncodeToString(secret) {
+		t.Errorf("Expected TOTP secret to be stored encrypted")
+	}
+
+	_, err = s.ConfirmTOTPEnrollment(int(userID), "000000")
+	if err != ErrInvalidTOTPCode && GenerateTOTP(secret, time.Now()) != "000000" {
+		t.Errorf("Expected ErrInvalidTOTPCode, got %v", err)
+	}
+
+	codes, err := s.ConfirmTOTPEnrollment(int(userID), GenerateTOTP(secret, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment failed: %v", err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", RecoveryCodeCount, len(codes))
+	}
+
+	enabled, _ = TOTPEnabled(db, int(userID))
+	if !enabled {
+		t.Errorf("Expected TOTP to be enabled after confirmation")
+	}
+
+	ok, err := s.VerifyTOTP(int(userID), GenerateTOTP(secret, time.Now()))
+	if err != nil {
+		t.Fatalf("VerifyTOTP failed: %v", err)
+	}
+	if ok {
+		t.Errorf("Expected the code used for confirmation to be rejected as a replay")
+	}
+
+	ok, err = s.VerifyTOTP(int(userID), GenerateTOTP(secret, time.Now().Add(TOTPPeriod*time.Second)))
+	if err != nil {
+		t.Fatalf("VerifyTOTP failed: %v", err)
+	}
+	if !ok {
+		t.Errorf("Expected the next code to be accepted")
+	}
+
+	_, err = s.BeginTOTPEnrollment(int(userID))
+	if err != ErrTOTPAlreadyEnabled {
+		t.Errorf("Expected ErrTOTPAlreadyEnabled, got %v", err)
+	}
+}
+
+func TestLoginUserWithMFA(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "mfauser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	secret, err := s.BeginTOTPEnrollment(int(userID))
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment failed: %v", err)
+	}
+	codes, err := s.ConfirmTOTPEnrollment(int(userID), GenerateTOTP(secret, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	_, err = s.LoginUser(w, r, username, password)
+	if err != ErrMFARequired {
+		t.Fatalf("Expected ErrMFARequired, got %v", err)
+	}
+
+	session, _ := s.Sessions.Get(r, "session-name")
+	if session.Values["user_id"] != nil {
+		t.Errorf("Expected no user_id in session before the second factor, got %v", session.Values["user_id"])
+	}
+
+	_, err = s.CompleteMFALogin(w, r, "", "wrong-code")
+	if err != ErrInvalidTOTPCode {
+		t.Errorf("Expected ErrInvalidTOTPCode, got %v", err)
+	}
+
+	loggedInUserID, err := s.CompleteMFALogin(w, r, "", codes[0])
+	if err != nil {
+		t.Fatalf("CompleteMFALogin failed: %v", err)
+	}
+	if loggedInUserID != int(userID) {
+		t.Errorf("Expected user ID %d, got %d", userID, loggedInUserID)
+	}
+	if session.Values["user_id"] != int(userID) {
+		t.Errorf("Expected session user_id to be %d, but got %v", userID, session.Values["user_id"])
+	}
+	if session.Values["mfa_pending_user_id"] != nil {
+		t.Errorf("Expected pending MFA state to be cleared")
+	}
+
+	used, err := UseRecoveryCode(db, int(userID), codes[0])
+	if err != nil {
+		t.Fatalf("UseRecoveryCode failed: %v", err)
+	}
+	if used {
+		t.Errorf("Expected recovery code to be single-use")
+	}
+}
@@ -0,0 +1,462 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/sessionstore"
+	"auth_module/store"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// LoginUser checks the password with the service's Authenticators and
+// starts a session, or an MFA challenge if the user has a second factor.
+func (s *Service) LoginUser(w http.ResponseWriter, r *http.Request, username, password string) (int, error) {
+	user, err := s.authenticate(r.Context(), username, password)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.admitLogin(w, r, user, username, true)
+	switch {
+	case err == nil, errors.Is(err, ErrEmailNotVerified), errors.Is(err, ErrMFARequired):
+		return user.ID, err
+	default:
+		return 0, err
+	}
+}
+
+// admitLogin is where every way of logging in ends once the user has proven
+// who they are, be it with a password, a second factor, a passkey or an
+// identity provider. It refuses disabled accounts and, when
+// require_verified_email is set, unverified email addresses. Otherwise it
+// starts the session, unless checkMFA is set and the user has a second
+// factor, in which case it starts that step and returns ErrMFARequired.
+//
+// throttleName is the name the login was throttled under. Its failure
+// counter is cleared once the user is let in, or only lacks a verified
+// address; with a second factor still outstanding it is left alone, so that
+// re-entering the password does not buy more guesses.
+func (s *Service) admitLogin(w http.ResponseWriter, r *http.Request, user *store.User, throttleName string, checkMFA bool) error {
+	if user.Disabled {
+		return store.ErrUserDisabled
+	}
+
+	if s.Config.RequireVerifiedEmail && !user.EmailVerified {
+		s.recordLoginSuccess(throttleName)
+		return ErrEmailNotVerified
+	}
+
+	if checkMFA {
+		mfaEnabled, err := MFAEnabled(s.DB, user.ID)
+		if err != nil {
+			return err
+		}
+		if mfaEnabled {
+			if err := s.beginMFALogin(w, r, user.ID); err != nil {
+				return err
+			}
+			return ErrMFARequired
+		}
+	}
+
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return err
+	}
+	if err := s.finishLogin(w, r, session, user.ID); err != nil {
+		return err
+	}
+
+	s.recordLoginSuccess(throttleName)
+	return nil
+}
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrEmailRequired      = errors.New("an email address is required")
+)
+
+// RegisterUser creates an account and logs it in. email is optional unless
+// require_verified_email is set, in which case a verification link is mailed
+// and ErrEmailNotVerified is returned instead of starting a session.
+func (s *Service) RegisterUser(w http.ResponseWriter, r *http.Request, username, password, email, inviteCode string) (int, error) {
+	db := s.DB
+
+	email = store.NormalizeEmail(email)
+	if email == "" && s.Config.RequireVerifiedEmail {
+		return 0, ErrEmailRequired
+	}
+	if email != "" {
+		if err := store.ValidateEmail(email); err != nil {
+			return 0, err
+		}
+	}
+
+	switch s.Config.RegistrationMode {
+	case RegistrationOpen:
+	case RegistrationInviteOnly:
+		valid, err := store.InviteValid(r.Context(), db, inviteCode)
+		if err != nil {
+			return 0, err
+		}
+		if !valid {
+			return 0, store.ErrInvalidInvite
+		}
+	default:
+		return 0, ErrRegistrationClosed
+	}
+
+	userID, err := s.Users.CreateUser(r.Context(), username, password)
+	if err != nil {
+		return 0, err
+	}
+
+	// The email is claimed before the invite, so that an address already
+	// in use does not cost the invite.
+	if email != "" {
+		err = s.Users.SetUserEmail(r.Context(), int(userID), email)
+		if err != nil {
+			if deleteErr := s.Users.DeleteUser(r.Context(), int(userID)); deleteErr != nil {
+				return 0, deleteErr
+			}
+			return 0, err
+		}
+	}
+
+	if s.Config.RegistrationMode == RegistrationInviteOnly {
+		err = store.ConsumeInvite(r.Context(), db, inviteCode, userID)
+		if err != nil {
+			// Another registration claimed the invite in the meantime.
+			if deleteErr := s.Users.DeleteUser(r.Context(), int(userID)); deleteErr != nil {
+				return 0, deleteErr
+			}
+			return 0, err
+		}
+	}
+
+	if email != "" {
+		if err := s.SendVerificationEmail(r.Context(), int(userID), time.Now()); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", userID, err)
+		}
+	}
+
+	if s.Config.RequireVerifiedEmail {
+		return int(userID), ErrEmailNotVerified
+	}
+
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		return 0, err
+	}
+	if err := s.finishLogin(w, r, session, int(userID)); err != nil {
+		return 0, err
+	}
+
+	return int(userID), nil
+}
+
+func (s *Service) LogoutUser(w http.ResponseWriter, r *http.Request) error {
+	return s.ClearSession(w, r)
+}
+
+func (s *Service) LoginHandler(c *gin.Context) {
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+
+	if s.throttled(c, username) {
+		return
+	}
+
+	_, err := s.LoginUser(c.Writer, c.Request, username, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		s.recordLoginFailure(c.Request, username)
+	}
+
+	if errors.Is(err, ErrMFARequired) {
+		c.Header("HX-Redirect", "/login/mfa")
+		c.Status(http.StatusOK)
+		return
+	}
+	if errors.Is(err, ErrEmailNotVerified) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified"})
+		return
+	}
+	if errors.Is(err, store.ErrUserDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+	if err != nil {
+		log.Printf("Login failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	c.Header("HX-Redirect", loginRedirect(c))
+	c.Status(http.StatusOK)
+}
+
+// loginNextKey holds the page that sent the user to log in, such as an OAuth
+// authorization request.
+const loginNextKey = "login_next"
+
+// authTimeKey holds the Unix time the user last signed in, which ID tokens
+// report as auth_time.
+const authTimeKey = "auth_time"
+
+// loginRedirect returns where to send the user after a successful login: the
+// page recorded under loginNextKey, which it forgets, or the dashboard.
+func loginRedirect(c *gin.Context) string {
+	value, ok := c.Get("session")
+	if !ok {
+		return "/dashboard"
+	}
+	session := value.(*sessions.Session)
+	next, ok := session.Values[loginNextKey].(string)
+	if !ok {
+		return "/dashboard"
+	}
+
+	delete(session.Values, loginNextKey)
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+	return next
+}
+
+// throttled aborts the request with 429 and a Retry-After header when the
+// login throttler wants the client to back off.
+func (s *Service) throttled(c *gin.Context, username string) bool {
+	retryAfter, err := s.Throttler.Check(username, s.clientIP(c.Request), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return true
+	}
+	if retryAfter <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts, try again later", "retry_after": seconds})
+	return true
+}
+
+// recordLoginFailure counts a wrong password, code or passkey against
+// username, if known, and the client's IP.
+func (s *Service) recordLoginFailure(r *http.Request, username string) {
+	if err := s.Throttler.Failure(username, s.clientIP(r), time.Now()); err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	}
+}
+
+// recordLoginSuccess clears the failure counter of username.
+func (s *Service) recordLoginSuccess(username string) {
+	if err := s.Throttler.Success(username); err != nil {
+		log.Printf("Failed to reset login failures: %v", err)
+	}
+}
+
+func (s *Service) RegisterPageHandler(c *gin.Context) {
+	renderHTML(c, http.StatusOK, "register.html", s.registerTemplateData(""))
+}
+
+func (s *Service) RegisterHandler(c *gin.Context) {
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+	email := store.NormalizeEmail(c.PostForm("email"))
+	inviteCode := c.PostForm("invite_code")
+
+	if err := store.ValidateUsername(username); err != nil {
+		renderHTML(c, http.StatusOK, "register.html", s.registerTemplateData(err.Error()))
+		return
+	}
+	if err := s.Hasher.ValidatePassword(password); err != nil {
+		renderHTML(c, http.StatusOK, "register.html", s.registerTemplateData(err.Error()))
+		return
+	}
+	if email != "" {
+		if err := store.ValidateEmail(email); err != nil {
+			renderHTML(c, http.StatusOK, "register.html", s.registerTemplateData(err.Error()))
+			return
+		}
+	}
+
+	_, err := s.RegisterUser(c.Writer, c.Request, username, password, email, inviteCode)
+	if errors.Is(err, ErrEmailNotVerified) {
+		data := s.registerTemplateData("")
+		data["VerificationSent"] = true
+		renderHTML(c, http.StatusOK, "register.html", data)
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRegistrationClosed), errors.Is(err, store.ErrInvalidInvite), errors.Is(err, store.ErrUserExists),
+			errors.Is(err, store.ErrEmailExists), errors.Is(err, ErrEmailRequired):
+			renderHTML(c, http.StatusOK, "register.html", s.registerTemplateData(err.Error()))
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		}
+		return
+	}
+
+	c.Header("HX-Redirect", loginRedirect(c))
+	c.Status(http.StatusOK)
+}
+
+func (s *Service) registerTemplateData(errorMessage string) gin.H {
+	return gin.H{
+		"ErrorMessage": errorMessage,
+		"Closed":       s.Config.RegistrationMode == RegistrationClosed,
+		"InviteOnly":   s.Config.RegistrationMode == RegistrationInviteOnly,
+		"RequireEmail": s.Config.RequireVerifiedEmail,
+	}
+}
+
+func LogoutHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	session.Options.MaxAge = -1
+	err := session.Save(c.Request, c.Writer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear session"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "logout.html", nil)
+}
+
+func DashboardHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Welcome to the dashboard, User %d!", userID),
+		"user_id": userID,
+	})
+}
+
+func (s *Service) SessionsHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	s.renderSessions(c, userID, session.ID)
+}
+
+func (s *Service) RevokeSessionHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	err := s.Sessions.RevokeSession(userID, c.Param("handle"))
+	if errors.Is(err, sessionstore.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	s.renderSessions(c, userID, session.ID)
+}
+
+func (s *Service) RevokeOtherSessionsHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	err := s.Sessions.RevokeOtherSessions(userID, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	s.renderSessions(c, userID, session.ID)
+}
+
+func (s *Service) renderSessions(c *gin.Context, userID int, currentID string) {
+	activeSessions, err := s.Sessions.ListUserSessions(userID, currentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "sessions.html", gin.H{"Sessions": activeSessions})
+}
+
+// clientIP returns the address the login throttler knows the client by. That
+// is the peer of the connection, unless the peer is one of trusted_proxies:
+// then it is the last address in X-Forwarded-For that is not a trusted proxy
+// itself. It does not rely on gin's ClientIP, which believes the header from
+// anyone unless the engine was told otherwise.
+func (s *Service) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (s *Service) trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,532 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func TestLoginUser(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "loginuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	loggedInUserID, err := s.LoginUser(w, r, username, password)
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	if loggedInUserID != int(userID) {
+		t.Errorf("Expected user ID %d, got %d", userID, loggedInUserID)
+	}
+
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+
+	if session.Values["user_id"] != int(userID) {
+		t.Errorf("Expected session user_id to be %d, but got %v", userID, session.Values["user_id"])
+	}
+}
+
+func TestLoginUserWithSession(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "loginuser"
+	password := "ValidP@ssw0rd"
+
+	_, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	_, err = s.LoginUser(w, r, username, password)
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+
+	if session.Values["user_id"] == nil {
+		t.Errorf("Expected session to contain user_id, but it was nil")
+	}
+}
+
+func TestLogoutUser(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "logoutuser"
+	password := "ValidP@ssw0rd"
+
+	_, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	_, err = s.LoginUser(w, r, username, password)
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	err = s.LogoutUser(w, r)
+	if err != nil {
+		t.Fatalf("LogoutUser failed: %v", err)
+	}
+
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+
+	if session.Values["user_id"] != nil {
+		t.Errorf("Expected session to be cleared, but got '%v'", session.Values["user_id"])
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "testuser"
+	password := "ValidP@ssw0rd"
+	_, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.PostForm = url.Values{}
+	r.PostForm.Set("username", username)
+	r.PostForm.Set("password", password)
+
+	router := gin.Default()
+	router.POST("/login", s.LoginHandler)
+	router.ServeHTTP(w, r)
+
+	r = httptest.NewRequest("GET", "/logout", nil)
+	w = httptest.NewRecorder()
+	router.GET("/logout", LogoutHandler)
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, got %d", w.Code)
+	}
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+
+	if response["message"] != "Logout successful" {
+		t.Errorf("Expected message 'Logout successful', got '%v'", response["message"])
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "testuser"
+	password := "ValidP@ssw0rd"
+
+	_, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	t.Logf("Created user with ID: 1")
+
+	t.Run("Successful Login", func(t *testing.T) {
+		router := gin.Default()
+		router.POST("/login", s.LoginHandler)
+
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", username)
+		form.Add("password", password)
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Logf("Received status: %d, Body: %s", w.Code, w.Body.String())
+		}
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Login successful", response["message"])
+		assert.NotNil(t, response["user_id"])
+	})
+
+	t.Run("Invalid Credentials", func(t *testing.T) {
+		router := gin.Default()
+		router.POST("/login", s.LoginHandler)
+
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", "wronguser")
+		form.Add("password", "wrongpassword")
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		var response map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Invalid username or password", response["error"])
+	})
+
+	t.Run("Database Connection Failure", func(t *testing.T) {
+		closedDB, err := sql.Open("sqlite", "./users_test.db")
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		closedDB.Close()
+
+		broken := *s
+		broken.DB = closedDB
+
+		router := gin.Default()
+		router.POST("/login", broken.LoginHandler)
+
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", username)
+		form.Add("password", password)
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		var response map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Failed to log in", response["error"])
+	})
+}
+
+func TestDashboardHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+
+	// Sessions reference users, so user 1 has to exist.
+	if _, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, "testuser", "ValidP@ssw0rd"); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	router := gin.Default()
+	router.Use(s.SessionMiddleware())
+
+	protected := router.Group("/")
+	protected.Use(s.AuthMiddleware())
+	{
+		protected.GET("/dashboard", DashboardHandler)
+	}
+
+	t.Run("Authorized Access", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/dashboard", nil)
+
+		session := sessions.NewSession(s.Sessions, "session-name")
+		session.Values["user_id"] = 1
+		session.Save(req, w)
+
+		req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Welcome to the dashboard, User 1!", response["message"])
+		assert.Equal(t, 1, int(response["user_id"].(float64)))
+	})
+
+	t.Run("Unauthorized Access", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/dashboard", nil)
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		var response map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Unauthorized", response["error"])
+	})
+}
+
+func TestRegisterUser(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	t.Run("Closed", func(t *testing.T) {
+		s.Config.RegistrationMode = RegistrationClosed
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", nil)
+
+		_, err := s.RegisterUser(w, r, "closeduser", "ValidP@ssw0rd", "", "")
+		if err != ErrRegistrationClosed {
+			t.Errorf("Expected ErrRegistrationClosed, got %v", err)
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		s.Config.RegistrationMode = RegistrationOpen
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", nil)
+
+		userID, err := s.RegisterUser(w, r, "openuser", "ValidP@ssw0rd", "", "")
+		if err != nil {
+			t.Fatalf("RegisterUser failed: %v", err)
+		}
+
+		session, err := s.Sessions.Get(r, "session-name")
+		if err != nil {
+			t.Fatalf("Failed to get session: %v", err)
+		}
+		if session.Values["user_id"] != userID {
+			t.Errorf("Expected session user_id to be %d, but got %v", userID, session.Values["user_id"])
+		}
+	})
+
+	t.Run("Invite Only", func(t *testing.T) {
+		s.Config.RegistrationMode = RegistrationInviteOnly
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", nil)
+
+		_, err := s.RegisterUser(w, r, "inviteuser", "ValidP@ssw0rd", "", "bogus")
+		if err != store.ErrInvalidInvite {
+			t.Errorf("Expected ErrInvalidInvite, got %v", err)
+		}
+
+		code, err := store.CreateInvite(context.Background(), db)
+		if err != nil {
+			t.Fatalf("CreateInvite failed: %v", err)
+		}
+
+		_, err = s.RegisterUser(w, r, "inviteuser", "ValidP@ssw0rd", "", code)
+		if err != nil {
+			t.Fatalf("RegisterUser failed: %v", err)
+		}
+
+		_, err = s.RegisterUser(w, r, "inviteuser2", "ValidP@ssw0rd", "", code)
+		if err != store.ErrInvalidInvite {
+			t.Errorf("Expected ErrInvalidInvite when reusing invite, got %v", err)
+		}
+	})
+}
+
+func TestRegisterHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *Config) { config.RegistrationMode = RegistrationOpen })
+
+	router := gin.Default()
+	router.SetHTMLTemplate(web.Templates())
+	router.POST("/register", s.RegisterHandler)
+
+	t.Run("Invalid Password", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", "newuser")
+		form.Add("password", "short")
+		req := httptest.NewRequest("POST", "/register", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "password must be at least 8 characters long")
+		assert.Empty(t, w.Header().Get("HX-Redirect"))
+	})
+
+	t.Run("Successful Registration", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", "newuser")
+		form.Add("password", "ValidP@ssw0rd")
+		req := httptest.NewRequest("POST", "/register", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "/dashboard", w.Header().Get("HX-Redirect"))
+	})
+
+	t.Run("Duplicate Username", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		form := url.Values{}
+		form.Add("username", "newuser")
+		form.Add("password", "ValidP@ssw0rd")
+		req := httptest.NewRequest("POST", "/register", nil)
+		req.PostForm = form
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), store.ErrUserExists.Error())
+	})
+}
+
+func TestLoginUserRehashesLegacyHash(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	username := "legacyuser"
+	password := "ValidP@ssw0rd"
+
+	result, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, legacyPasswordHash(password))
+	if err != nil {
+		t.Fatalf("Failed to insert legacy user: %v", err)
+	}
+	userID, _ := result.LastInsertId()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	_, err = s.LoginUser(w, r, username, password)
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	user, err := store.ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if s.Hasher.NeedsRehash(user.PasswordHash) {
+		t.Errorf("Expected stored hash to be upgraded, got %s", user.PasswordHash)
+	}
+	if !store.CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Upgraded hash did not match the original password")
+	}
+}
+
+func TestLoginUserUpgradesImportedHash(t *testing.T) {
+	s := newTestService(t, nil)
+
+	// Deliberately weak: imported passwords skip ValidatePassword.
+	password := "oldpassword"
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to generate bcrypt hash: %v", err)
+	}
+
+	users := []store.ImportedUser{{Username: "imported", PasswordHash: string(bcryptHash)}}
+	if _, err := store.ImportUsers(context.Background(), s.DB, users); err != nil {
+		t.Fatalf("ImportUsers failed: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	userID, err := s.LoginUser(httptest.NewRecorder(), r, "imported", password)
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	stored, err := store.ReadUser(context.Background(), s.DB, userID)
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+	if !strings.HasPrefix(stored.PasswordHash, "$argon2id$") {
+		t.Errorf("Expected the imported hash to be upgraded to argon2id, got %s", stored.PasswordHash)
+	}
+}
+
+// legacyPasswordHash builds a hash in the salt$hash format used before the
+// PHC string format, with the old fixed costs.
+func legacyPasswordHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
+	return base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash)
+}
+
+// A session ID planted in the browser before login, e.g. one minted by
+// visiting the login page, must not become an authenticated session.
+func TestLoginUserRenewsSession(t *testing.T) {
+	s := newTestService(t, nil)
+
+	username := "loginuser"
+	password := "ValidP@ssw0rd"
+	if _, err := store.CreateUserIfNotExists(context.Background(), s.DB, testHasher, username, password); err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login", nil)
+	anonymous, _ := s.Sessions.Get(r, "session-name")
+	if err := anonymous.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	planted := w.Result().Cookies()[0]
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/login", nil)
+	r.AddCookie(planted)
+	if _, err := s.LoginUser(w, r, username, password); err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+	assert.NotEqual(t, planted.Value, w.Result().Cookies()[0].Value)
+
+	r = httptest.NewRequest("GET", "/dashboard", nil)
+	r.AddCookie(planted)
+	session, err := s.Sessions.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	assert.Nil(t, session.Values["user_id"], "planted session after login")
+}
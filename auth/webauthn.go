@@ -0,0 +1,690 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"auth_module/store"
+)
+
+const (
+	WebAuthnChallengeLen     = 32
+	WebAuthnChallengeTimeout = 5 * time.Minute
+	WebAuthnRPName           = "nope.tools"
+
+	coseKeyTypeEC2   = 2
+	coseAlgES256     = -7
+	coseCurveP256    = 1
+	authDataFlagUP   = 0x01
+	authDataFlagUV   = 0x04
+	authDataFlagAT   = 0x40
+	authDataMinLen   = 37
+	aaguidLen        = 16
+	credentialIDSize = 2
+)
+
+var (
+	ErrWebAuthnVerification = errors.New("webauthn verification failed")
+	ErrWebAuthnNoChallenge  = errors.New("no webauthn ceremony in progress")
+	ErrCredentialNotFound   = errors.New("credential not found")
+	ErrCredentialExists     = errors.New("credential is already registered")
+)
+
+type WebAuthnCredential struct {
+	ID           int
+	UserID       int
+	CredentialID []byte
+	PublicKey    []byte
+	SignCount    uint32
+	Name         string
+	CreatedAt    time.Time
+}
+
+func (c WebAuthnCredential) EncodedID() string {
+	return base64.RawURLEncoding.EncodeToString(c.CredentialID)
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func NewWebAuthnChallenge() ([]byte, error) {
+	challenge := make([]byte, WebAuthnChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// VerifyRegistration checks an attestation produced by
+// navigator.credentials.create against the expected challenge and returns the
+// new credential. Only the "none" attestation format and ES256 keys are
+// accepted.
+func (s *Service) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, error) {
+	if err := s.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnVerification
+	}
+
+	if format, _ := attestation["fmt"].(string); format != "none" {
+		return nil, errors.New("unsupported attestation format")
+	}
+	if statement, _ := attestation["attStmt"].(map[interface{}]interface{}); len(statement) != 0 {
+		return nil, ErrWebAuthnVerification
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnVerification
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if authData.Flags&authDataFlagAT == 0 {
+		return nil, ErrWebAuthnVerification
+	}
+
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		CredentialID: authData.CredentialID,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.SignCount,
+	}, nil
+}
+
+// VerifyAssertion checks an assertion produced by navigator.credentials.get
+// against the stored credential and advances its signature counter. It
+// returns the ID of the user owning the credential. When requireUV is set
+// the authenticator must also have verified the user (PIN or biometric),
+// not just their presence.
+func (s *Service) VerifyAssertion(challenge, credentialID, clientDataJSON, rawAuthData, signature []byte, requireUV bool) (int, error) {
+	db := s.DB
+
+	credential, err := GetWebAuthnCredential(db, credentialID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.verifyAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+	if requireUV && authData.Flags&authDataFlagUV == 0 {
+		return 0, ErrWebAuthnVerification
+	}
+
+	publicKey, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), rawAuthData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(publicKey, signed[:], signature) {
+		return 0, ErrWebAuthnVerification
+	}
+
+	// Authenticators that keep a counter must increase it on every use; a
+	// counter that goes backwards suggests a cloned authenticator.
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return 0, errors.New("webauthn signature counter did not increase")
+	}
+
+	_, err = db.Exec("UPDATE webauthn_credentials SET sign_count = ?, last_used_at = CURRENT_TIMESTAMP WHERE id = ?", authData.SignCount, credential.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return credential.UserID, nil
+}
+
+func (s *Service) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var clientData collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return err
+	}
+
+	if clientData.Type != ceremony {
+		return ErrWebAuthnVerification
+	}
+
+	received, err := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return ErrWebAuthnVerification
+	}
+
+	if clientData.Origin != s.Config.WebAuthnOrigin {
+		return ErrWebAuthnVerification
+	}
+
+	return nil
+}
+
+func (s *Service) verifyAuthenticatorData(authData *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(s.Config.WebAuthnRPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return ErrWebAuthnVerification
+	}
+	if authData.Flags&authDataFlagUP == 0 {
+		return ErrWebAuthnVerification
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < authDataMinLen {
+		return nil, ErrWebAuthnVerification
+	}
+
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.Flags&authDataFlagAT == 0 {
+		return authData, nil
+	}
+
+	rest := data[authDataMinLen:]
+	if len(rest) < aaguidLen+credentialIDSize {
+		return nil, ErrWebAuthnVerification
+	}
+	rest = rest[aaguidLen:]
+
+	idLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[credentialIDSize:]
+	if len(rest) < idLen {
+		return nil, ErrWebAuthnVerification
+	}
+	authData.CredentialID = append([]byte(nil), rest[:idLen]...)
+	rest = rest[idLen:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	authData.PublicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+
+	return authData, nil
+}
+
+func parseCOSEKey(data []byte) (*ecdsa.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnVerification
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+	y, _ := key[int64(-3)].([]byte)
+	if kty != coseKeyTypeEC2 || alg != coseAlgES256 || crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("unsupported credential public key")
+	}
+
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+func SaveWebAuthnCredential(db *sql.DB, userID int, credential *WebAuthnCredential, name string) error {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(1) FROM webauthn_credentials WHERE credential_id = ?", credential.CredentialID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrCredentialExists
+	}
+
+	_, err = db.Exec("INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name) VALUES (?, ?, ?, ?, ?)",
+		userID, credential.CredentialID, credential.PublicKey, credential.SignCount, name)
+	return err
+}
+
+func GetWebAuthnCredential(db *sql.DB, credentialID []byte) (*WebAuthnCredential, error) {
+	row := db.QueryRow("SELECT id, user_id, credential_id, public_key, sign_count, name, created_at FROM webauthn_credentials WHERE credential_id = ?", credentialID)
+	credential := &WebAuthnCredential{}
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.CredentialID, &credential.PublicKey, &credential.SignCount, &credential.Name, &credential.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCredentialNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func ListWebAuthnCredentials(db *sql.DB, userID int) ([]WebAuthnCredential, error) {
+	rows, err := db.Query("SELECT id, user_id, credential_id, public_key, sign_count, name, created_at FROM webauthn_credentials WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []WebAuthnCredential
+	for rows.Next() {
+		credential := WebAuthnCredential{}
+		err := rows.Scan(&credential.ID, &credential.UserID, &credential.CredentialID, &credential.PublicKey, &credential.SignCount, &credential.Name, &credential.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func DeleteWebAuthnCredential(db *sql.DB, userID, id int) error {
+	result, err := db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCredentialNotFound
+	}
+
+	return nil
+}
+
+func HasWebAuthnCredentials(db *sql.DB, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(1) FROM webauthn_credentials WHERE user_id = ?", userID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func storeWebAuthnChallenge(c *gin.Context, ceremony string, challenge []byte) error {
+	session := c.MustGet("session").(*sessions.Session)
+	session.Values["webauthn_ceremony"] = ceremony
+	session.Values["webauthn_challenge"] = challenge
+	session.Values["webauthn_challenge_at"] = time.Now().Unix()
+	return session.Save(c.Request, c.Writer)
+}
+
+// takeWebAuthnChallenge returns the pending challenge for ceremony and removes
+// it from the session so that it can only be answered once.
+func takeWebAuthnChallenge(c *gin.Context, ceremony string) ([]byte, error) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	storedCeremony, _ := session.Values["webauthn_ceremony"].(string)
+	challenge, _ := session.Values["webauthn_challenge"].([]byte)
+	issuedAt, _ := session.Values["webauthn_challenge_at"].(int64)
+
+	delete(session.Values, "webauthn_ceremony")
+	delete(session.Values, "webauthn_challenge")
+	delete(session.Values, "webauthn_challenge_at")
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		return nil, err
+	}
+
+	if storedCeremony != ceremony || challenge == nil || time.Since(time.Unix(issuedAt, 0)) > WebAuthnChallengeTimeout {
+		return nil, ErrWebAuthnNoChallenge
+	}
+
+	return challenge, nil
+}
+
+func credentialDescriptors(credentials []WebAuthnCredential) []gin.H {
+	descriptors := make([]gin.H, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, gin.H{"type": "public-key", "id": credential.EncodedID()})
+	}
+	return descriptors
+}
+
+func (s *Service) WebAuthnRegisterBeginHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	db := s.DB
+
+	user, err := s.Users.ReadUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	existing, err := ListWebAuthnCredentials(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credentials"})
+		return
+	}
+
+	challenge, err := NewWebAuthnChallenge()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate challenge"})
+		return
+	}
+
+	if err := storeWebAuthnChallenge(c, "register", challenge); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": gin.H{
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"rp":        gin.H{"id": s.Config.WebAuthnRPID, "name": WebAuthnRPName},
+		"user": gin.H{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(user.ID))),
+			"name":        user.Username,
+			"displayName": user.Username,
+		},
+		"pubKeyCredParams":       []gin.H{{"type": "public-key", "alg": coseAlgES256}},
+		"attestation":            "none",
+		"excludeCredentials":     credentialDescriptors(existing),
+		"authenticatorSelection": gin.H{"residentKey": "preferred", "userVerification": "preferred"},
+		"timeout":                WebAuthnChallengeTimeout.Milliseconds(),
+	}})
+}
+
+func (s *Service) WebAuthnRegisterFinishHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	var request struct {
+		Name     string `json:"name"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AttestationObject string `json:"attestationObject"`
+		} `json:"response"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(request.Response.ClientDataJSON)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	attestationObject, err := base64.RawURLEncoding.DecodeString(request.Response.AttestationObject)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	challenge, err := takeWebAuthnChallenge(c, "register")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No registration in progress"})
+		return
+	}
+
+	credential, err := s.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to verify credential"})
+		return
+	}
+
+	db := s.DB
+
+	name := request.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	err = SaveWebAuthnCredential(db, userID, credential, name)
+	if errors.Is(err, ErrCredentialExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Credential is already registered"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save credential"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Credential registered"})
+}
+
+// WebAuthnLoginBeginHandler starts an assertion ceremony. While a password
+// login waits for its second factor only that user's credentials are allowed;
+// otherwise the browser may offer any discoverable credential, which makes
+// this a passwordless login. A passkey is then the only factor, so the
+// authenticator has to verify the user rather than just their presence.
+func (s *Service) WebAuthnLoginBeginHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	allowCredentials := []gin.H{}
+	userVerification := "required"
+	if pendingUserID, ok := session.Values["mfa_pending_user_id"].(int); ok {
+		userVerification = "preferred"
+		credentials, err := ListWebAuthnCredentials(s.DB, pendingUserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credentials"})
+			return
+		}
+		allowCredentials = credentialDescriptors(credentials)
+	}
+
+	challenge, err := NewWebAuthnChallenge()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate challenge"})
+		return
+	}
+
+	if err := storeWebAuthnChallenge(c, "login", challenge); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": gin.H{
+		"challenge":        base64.RawURLEncoding.EncodeToString(challenge),
+		"rpId":             s.Config.WebAuthnRPID,
+		"allowCredentials": allowCredentials,
+		"userVerification": userVerification,
+		"timeout":          WebAuthnChallengeTimeout.Milliseconds(),
+	}})
+}
+
+func (s *Service) WebAuthnLoginFinishHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	// A passwordless login names no account until the assertion is
+	// verified, so only the client's IP is throttled then.
+	username, err := s.pendingMFAUsername(c.Request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify credential"})
+		return
+	}
+	if s.throttled(c, username) {
+		return
+	}
+
+	var request struct {
+		RawID    string `json:"rawId"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AuthenticatorData string `json:"authenticatorData"`
+			Signature         string `json:"signature"`
+		} `json:"response"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var fields [4][]byte
+	for i, encoded := range []string{request.RawID, request.Response.ClientDataJSON, request.Response.AuthenticatorData, request.Response.Signature} {
+		decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		fields[i] = decoded
+	}
+
+	challenge, err := takeWebAuthnChallenge(c, "login")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No login in progress"})
+		return
+	}
+
+	pendingUserID, pending := session.Values["mfa_pending_user_id"].(int)
+
+	userID, err := s.VerifyAssertion(challenge, fields[0], fields[1], fields[2], fields[3], !pending)
+	if err == nil && pending && pendingUserID != userID {
+		err = ErrWebAuthnVerification
+	}
+	if err != nil {
+		s.recordLoginFailure(c.Request, username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify credential"})
+		return
+	}
+
+	user, err := s.Users.ReadUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	err = s.admitLogin(c.Writer, c.Request, user, user.Username, false)
+	if errors.Is(err, store.ErrUserDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+	if errors.Is(err, ErrEmailNotVerified) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": loginRedirect(c)})
+}
+
+func (s *Service) PasskeysPageHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	db := s.DB
+
+	renderPasskeys(c, db, userID)
+}
+
+func (s *Service) DeletePasskeyHandler(c *gin.Context) {
+	session := c.MustGet("session").(*sessions.Session)
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user ID from session"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	db := s.DB
+
+	err = DeleteWebAuthnCredential(db, userID, id)
+	if errors.Is(err, ErrCredentialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credential not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete credential"})
+		return
+	}
+
+	renderPasskeys(c, db, userID)
+}
+
+func renderPasskeys(c *gin.Context, db *sql.DB, userID int) {
+	credentials, err := ListWebAuthnCredentials(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credentials"})
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "passkeys.html", gin.H{"Credentials": credentials})
+}
@@ -0,0 +1,474 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"auth_module/store"
+)
+
+// cborPair and cborMap let tests build CBOR maps with a fixed key order.
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+type cborMap []cborPair
+
+func encodeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		if v >= 0 {
+			encodeCBORHead(buf, 0, uint64(v))
+		} else {
+			encodeCBORHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		encodeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		encodeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case cborMap:
+		encodeCBORHead(buf, 5, uint64(len(v)))
+		for _, pair := range v {
+			encodeCBOR(buf, pair.key)
+			encodeCBOR(buf, pair.value)
+		}
+	default:
+		panic("unsupported CBOR test value")
+	}
+}
+
+// softAuthenticator is an in-process stand-in for a security key: it holds
+// an ES256 key pair and produces "none" attestations and assertions.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	origin       string
+	rpID         string
+}
+
+func newSoftAuthenticator(t *testing.T, config *Config) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &softAuthenticator{key: key, credentialID: credentialID, origin: config.WebAuthnOrigin, rpID: config.WebAuthnRPID}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	clientDataJSON, _ := json.Marshal(collectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	return clientDataJSON
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	buf := &bytes.Buffer{}
+	buf.Write(rpIDHash[:])
+	buf.WriteByte(flags)
+	binary.Write(buf, binary.BigEndian, a.signCount)
+	return buf.Bytes()
+}
+
+func (a *softAuthenticator) create(challenge []byte) ([]byte, []byte) {
+	authData := bytes.NewBuffer(a.authData(authDataFlagUP | authDataFlagAT))
+	authData.Write(make([]byte, aaguidLen))
+	binary.Write(authData, binary.BigEndian, uint16(len(a.credentialID)))
+	authData.Write(a.credentialID)
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	encodeCBOR(authData, cborMap{
+		{1, coseKeyTypeEC2},
+		{3, coseAlgES256},
+		{-1, coseCurveP256},
+		{-2, x},
+		{-3, y},
+	})
+
+	attestationObject := &bytes.Buffer{}
+	encodeCBOR(attestationObject, cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authData.Bytes()},
+	})
+
+	return a.clientData("webauthn.create", challenge), attestationObject.Bytes()
+}
+
+func (a *softAuthenticator) get(challenge []byte) ([]byte, []byte, []byte) {
+	return a.getWithFlags(challenge, authDataFlagUP|authDataFlagUV)
+}
+
+func (a *softAuthenticator) getWithFlags(challenge []byte, flags byte) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authData(flags)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+
+	return clientDataJSON, authData, signature
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	s := newTestService(t, nil)
+	db := s.DB
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, "passkeyuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	authenticator := newSoftAuthenticator(t, s.Config)
+
+	challenge, _ := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := authenticator.create(challenge)
+
+	otherChallenge, _ := NewWebAuthnChallenge()
+	if _, err := s.VerifyRegistration(otherChallenge, clientDataJSON, attestationObject); err == nil {
+		t.Errorf("Expected registration with a different challenge to fail")
+	}
+
+	credential, err := s.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+	if !bytes.Equal(credential.CredentialID, authenticator.credentialID) {
+		t.Errorf("Unexpected credential ID")
+	}
+
+	err = SaveWebAuthnCredential(db, int(userID), credential, "test key")
+	if err != nil {
+		t.Fatalf("SaveWebAuthnCredential failed: %v", err)
+	}
+	if err := SaveWebAuthnCredential(db, int(userID), credential, "test key"); err != ErrCredentialExists {
+		t.Errorf("Expected ErrCredentialExists, got %v", err)
+	}
+
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature := authenticator.get(challenge)
+
+	assertedUserID, err := s.VerifyAssertion(challenge, authenticator.credentialID, clientDataJSON, authData, signature, true)
+	if err != nil {
+		t.Fatalf("VerifyAssertion failed: %v", err)
+	}
+	if assertedUserID != int(userID) {
+		t.Errorf("Expected user ID %d, got %d", userID, assertedUserID)
+	}
+
+	if _, err := s.VerifyAssertion(challenge, authenticator.credentialID, clientDataJSON, authData, signature, true); err == nil {
+		t.Errorf("Expected replayed assertion to fail the signature counter check")
+	}
+
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature = authenticator.getWithFlags(challenge, authDataFlagUP)
+	if _, err := s.VerifyAssertion(challenge, authenticator.credentialID, clientDataJSON, authData, signature, true); err == nil {
+		t.Errorf("Expected assertion without user verification to fail when it is required")
+	}
+	if _, err := s.VerifyAssertion(challenge, authenticator.credentialID, clientDataJSON, authData, signature, false); err != nil {
+		t.Errorf("Expected assertion with user presence only to pass as a second factor: %v", err)
+	}
+
+	authenticator.origin = "https://evil.example"
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authData, signature = authenticator.get(challenge)
+	if _, err := s.VerifyAssertion(challenge, authenticator.credentialID, clientDataJSON, authData, signature, true); err == nil {
+		t.Errorf("Expected assertion from a foreign origin to fail")
+	}
+
+	mfaEnabled, err := MFAEnabled(db, int(userID))
+	if err != nil {
+		t.Fatalf("MFAEnabled failed: %v", err)
+	}
+	if !mfaEnabled {
+		t.Errorf("Expected a registered passkey to require a second factor")
+	}
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, "passwordless", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	authenticator := newSoftAuthenticator(t, s.Config)
+	challenge, _ := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := authenticator.create(challenge)
+	credential, err := s.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+	if err := SaveWebAuthnCredential(db, int(userID), credential, "test key"); err != nil {
+		t.Fatalf("SaveWebAuthnCredential failed: %v", err)
+	}
+
+	router := gin.Default()
+	router.Use(s.SessionMiddleware())
+	router.POST("/webauthn/login/begin", s.WebAuthnLoginBeginHandler)
+	router.POST("/webauthn/login/finish", s.WebAuthnLoginFinishHandler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/webauthn/login/begin", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to parse options: %v", err)
+	}
+	cookie := w.Header().Get("Set-Cookie")
+
+	challenge, _ = base64.RawURLEncoding.DecodeString(options.PublicKey.Challenge)
+	clientDataJSON, authData, signature := authenticator.get(challenge)
+
+	body, _ := json.Marshal(gin.H{
+		"rawId": base64.RawURLEncoding.EncodeToString(authenticator.credentialID),
+		"response": gin.H{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		},
+	})
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/webauthn/login/finish", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", cookie)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	session, err := s.Sessions.Get(req, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if session.Values["user_id"] != int(userID) {
+		t.Errorf("Expected session user_id to be %d, but got %v", userID, session.Values["user_id"])
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/webauthn/login/finish", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", cookie)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "challenge must not be reusable")
+}
+
+func TestWebAuthnPasswordlessLoginRequiresUserVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, nil)
+	db := s.DB
+
+	userID, err := store.CreateUserIfNotExists(context.Background(), db, testHasher, "presenceonly", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	authenticator := newSoftAuthenticator(t, s.Config)
+	challenge, _ := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := authenticator.create(challenge)
+	credential, err := s.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+	if err := SaveWebAuthnCredential(db, int(userID), credential, "test key"); err != nil {
+		t.Fatalf("SaveWebAuthnCredential failed: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(s.SessionMiddleware())
+	router.POST("/webauthn/login/begin", s.WebAuthnLoginBeginHandler)
+	router.POST("/webauthn/login/finish", s.WebAuthnLoginFinishHandler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/webauthn/login/begin", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var options struct {
+		PublicKey struct {
+			Challenge        string `json:"challenge"`
+			UserVerification string `json:"userVerification"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to parse options: %v", err)
+	}
+	assert.Equal(t, "required", options.PublicKey.UserVerification)
+	cookie := w.Header().Get("Set-Cookie")
+
+	challenge, _ = base64.RawURLEncoding.DecodeString(options.PublicKey.Challenge)
+	clientDataJSON, authData, signature := authenticator.getWithFlags(challenge, authDataFlagUP)
+
+	body, _ := json.Marshal(gin.H{
+		"rawId": base64.RawURLEncoding.EncodeToString(authenticator.credentialID),
+		"response": gin.H{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		},
+	})
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/webauthn/login/finish", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", cookie)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	session, err := s.Sessions.Get(req, "session-name")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if _, ok := session.Values["user_id"]; ok {
+		t.Errorf("Expected no login from an assertion without user verification")
+	}
+}
+
+func TestWebAuthnLoginChecks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *Config) {
+		config.RequireVerifiedEmail = true
+	})
+	ctx := context.Background()
+
+	userID, err := store.CreateUserIfNotExists(ctx, s.DB, testHasher, "passkeyuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+	if err := s.Users.SetUserEmail(ctx, int(userID), "passkey@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+
+	authenticator := newSoftAuthenticator(t, s.Config)
+	challenge, _ := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := authenticator.create(challenge)
+	credential, err := s.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+	if err := SaveWebAuthnCredential(s.DB, int(userID), credential, "test key"); err != nil {
+		t.Fatalf("SaveWebAuthnCredential failed: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(s.SessionMiddleware())
+	router.POST("/webauthn/login/begin", s.WebAuthnLoginBeginHandler)
+	router.POST("/webauthn/login/finish", s.WebAuthnLoginFinishHandler)
+
+	// login runs a passwordless login, breaking the signature if forge is
+	// set, and returns the status of the finish request.
+	login := func(forge bool) int {
+		b := newTestBrowser(router)
+		w := b.do(httptest.NewRequest("POST", "/webauthn/login/begin", nil))
+		var options struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+			t.Fatalf("Failed to parse options: %v", err)
+		}
+
+		challenge, _ := base64.RawURLEncoding.DecodeString(options.PublicKey.Challenge)
+		clientDataJSON, authData, signature := authenticator.get(challenge)
+		if forge {
+			signature[len(signature)-1] ^= 0xff
+		}
+		body, _ := json.Marshal(gin.H{
+			"rawId": base64.RawURLEncoding.EncodeToString(authenticator.credentialID),
+			"response": gin.H{
+				"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+				"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+				"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			},
+		})
+		req := httptest.NewRequest("POST", "/webauthn/login/finish", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return b.do(req).Code
+	}
+	failures := func(key string) int {
+		count, _, err := s.Throttler.Tracker.Failures(key)
+		if err != nil {
+			t.Fatalf("Failures failed: %v", err)
+		}
+		return count
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login(true))
+	assert.Equal(t, 1, failures(throttleIPKeyPrefix+"192.0.2.1"), "a failed assertion counts against the IP")
+
+	assert.Equal(t, http.StatusForbidden, login(false), "email address not verified")
+
+	if _, err := s.Users.MarkEmailVerified(ctx, int(userID), "passkey@example.com", time.Now()); err != nil {
+		t.Fatalf("MarkEmailVerified failed: %v", err)
+	}
+	if err := s.Throttler.Failure("passkeyuser", "", time.Now()); err != nil {
+		t.Fatalf("Failure failed: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, login(false))
+	assert.Equal(t, 0, failures(throttleUsernameKeyPrefix+"passkeyuser"), "a passkey login clears the account's failures")
+
+	if err := s.SetUserDisabled(ctx, int(userID), true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	assert.Equal(t, http.StatusForbidden, login(false), "account disabled")
+}
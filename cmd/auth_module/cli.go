@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+
+	"auth_module/auth"
+	"auth_module/store"
+)
+
+const usage = `usage: auth_module <command> [arguments]
+
+commands:
+  serve [-addr host:port]                  run the web server (the default)
+  user create [-admin] [-email addr] name  create a user, prompting for the password
+  user list [-q search] [-limit n] [-offset n]
+  user show name|id
+  user passwd name|id                      set a new password and sign the user out
+  user delete name|id
+  user disable name|id
+  user enable name|id
+  user import file                         import users and their password hashes from a
+                                           JSON list of {"username", "password_hash"}
+  user unlock name|id                      lift a lockout after too many failed logins
+  client add [-public] -redirect-uri uri [-post-logout-redirect-uri uri] [-scope scope] ... name
+                                           register an OAuth client, printing its secret once
+  client list
+  client remove client_id
+  migrate status|up|down                   manage the database schema
+  config check                             print the effective configuration, secrets redacted
+  hash-bench [-memory KiB] [-time n] [-threads n] [-runs n]
+
+user, client and hash-bench commands accept -json for machine-readable output.`
+
+var ErrPasswordMismatch = errors.New("passwords do not match")
+
+// passwordPrompter reads a password after showing prompt. With confirm set,
+// an interactive prompter asks twice and fails if the answers differ.
+type passwordPrompter func(prompt string, confirm bool) (string, error)
+
+// stdinPasswordPrompter reads passwords from the terminal without echo, or one
+// line per password when stdin is a pipe so the commands can be scripted.
+// Prompts go to stderr to keep stdout clean for -json.
+func stdinPasswordPrompter() passwordPrompter {
+	reader := bufio.NewReader(os.Stdin)
+	fd := int(os.Stdin.Fd())
+
+	return func(prompt string, confirm bool) (string, error) {
+		if !term.IsTerminal(fd) {
+			line, err := reader.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", err
+			}
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+
+		read := func(prompt string) (string, error) {
+			fmt.Fprint(os.Stderr, prompt)
+			password, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			return string(password), err
+		}
+
+		password, err := read(prompt)
+		if err != nil || !confirm {
+			return password, err
+		}
+		repeated, err := read("Repeat " + strings.ToLower(prompt[:1]) + prompt[1:])
+		if err != nil {
+			return "", err
+		}
+		if repeated != password {
+			return "", ErrPasswordMismatch
+		}
+		return password, nil
+	}
+}
+
+// userRecord is how the user commands print a user with -json.
+type userRecord struct {
+	ID            int      `json:"id"`
+	Username      string   `json:"username"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified"`
+	Disabled      bool     `json:"disabled"`
+	Admin         bool     `json:"admin"`
+	Roles         []string `json:"roles"`
+}
+
+// runUserCommand implements "auth_module user ...".
+func runUserCommand(ctx context.Context, s *auth.Service, args []string, out io.Writer, prompt passwordPrompter) error {
+	db := s.DB
+
+	if len(args) == 0 {
+		return errors.New("usage: user create|list|show|passwd|delete|disable|enable|unlock|import [-json] ...")
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	jsonOutput := flags.Bool("json", false, "print JSON instead of text")
+	admin := flags.Bool("admin", false, "make the new user an admin (create only)")
+	email := flags.String("email", "", "email address of the new user (create only)")
+	search := flags.String("q", "", "only list users whose username or email contains this (list only)")
+	limit := flags.Int("limit", 100, "maximum number of users to list (list only)")
+	offset := flags.Int("offset", 0, "number of users to skip (list only)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		users, total, err := s.Users.ListUsers(ctx, *search, *offset, *limit)
+		if err != nil {
+			return err
+		}
+
+		records := make([]userRecord, 0, len(users))
+		for _, user := range users {
+			record, err := newUserRecord(ctx, db, &user)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+
+		if *jsonOutput {
+			return json.NewEncoder(out).Encode(records)
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tROLES\tSTATUS")
+		for _, record := range records {
+			status := "active"
+			if record.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", record.ID, record.Username, record.Email, strings.Join(record.Roles, ","), status)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(records) < total {
+			fmt.Fprintf(out, "showing %d of %d users\n", len(records), total)
+		}
+		return nil
+	}
+
+	if args[0] == "import" {
+		if flags.NArg() != 1 {
+			return errors.New("usage: user import [-json] file")
+		}
+		data, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		var users []store.ImportedUser
+		if err := json.Unmarshal(data, &users); err != nil {
+			return fmt.Errorf("%s: %w", flags.Arg(0), err)
+		}
+
+		// ImportUsers checks every row, hash parameters included, before
+		// inserting any, so a bad file leaves the user store untouched.
+		imported, err := s.Users.ImportUsers(ctx, users)
+		if err != nil {
+			return err
+		}
+
+		if *jsonOutput {
+			return json.NewEncoder(out).Encode(map[string]int{"imported": imported})
+		}
+		fmt.Fprintf(out, "imported %d users\n", imported)
+		return nil
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: user %s [flags] name", args[0])
+	}
+	name := flags.Arg(0)
+
+	var user *store.User
+	var message string
+	switch args[0] {
+	case "create":
+		if *email != "" {
+			if err := store.ValidateEmail(store.NormalizeEmail(*email)); err != nil {
+				return err
+			}
+		}
+		password, err := prompt("Password: ", true)
+		if err != nil {
+			return err
+		}
+		userID, err := s.Users.CreateUser(ctx, name, password)
+		if err != nil {
+			return err
+		}
+		if *email != "" {
+			if err := s.Users.SetUserEmail(ctx, int(userID), *email); err != nil {
+				if deleteErr := s.DeleteUser(ctx, int(userID)); deleteErr != nil {
+					return deleteErr
+				}
+				return err
+			}
+		}
+		if *admin {
+			if err := s.SetUserAdmin(ctx, int(userID), true); err != nil {
+				return err
+			}
+		}
+		user, err = s.Users.ReadUser(ctx, int(userID))
+		if err != nil {
+			return err
+		}
+		message = fmt.Sprintf("created user %s (id %d)", user.Username, user.ID)
+	case "show":
+		found, err := lookupUser(ctx, s.Users, name)
+		if err != nil {
+			return err
+		}
+		user = found
+	case "passwd":
+		found, err := lookupUser(ctx, s.Users, name)
+		if err != nil {
+			return err
+		}
+		user = found
+		password, err := prompt("New password: ", true)
+		if err != nil {
+			return err
+		}
+		if err := s.Hasher.ValidatePassword(password); err != nil {
+			return err
+		}
+		if err := s.Users.UpdateUser(ctx, user.ID, "", password); err != nil {
+			return err
+		}
+		if err := s.Sessions.RevokeUserSessions(user.ID); err != nil {
+			return err
+		}
+		message = fmt.Sprintf("updated the password of %s", user.Username)
+	case "delete":
+		found, err := lookupUser(ctx, s.Users, name)
+		if err != nil {
+			return err
+		}
+		// Build the record first so it still lists the user's roles.
+		record, err := newUserRecord(ctx, db, found)
+		if err != nil {
+			return err
+		}
+		if err := s.DeleteUser(ctx, found.ID); err != nil {
+			return err
+		}
+		return printUserRecord(out, *jsonOutput, record, fmt.Sprintf("deleted user %s", found.Username))
+	case "disable", "enable":
+		found, err := lookupUser(ctx, s.Users, name)
+		if err != nil {
+			return err
+		}
+		disabled := args[0] == "disable"
+		if err := s.SetUserDisabled(ctx, found.ID, disabled); err != nil {
+			return err
+		}
+		found.Disabled = disabled
+		user = found
+		message = fmt.Sprintf("%sd user %s", args[0], user.Username)
+	case "unlock":
+		found, err := lookupUser(ctx, s.Users, name)
+		if err != nil {
+			return err
+		}
+		if err := s.Throttler.UnlockAccount(found.Username); err != nil {
+			return err
+		}
+		user = found
+		message = fmt.Sprintf("unlocked user %s", user.Username)
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+
+	record, err := newUserRecord(ctx, db, user)
+	if err != nil {
+		return err
+	}
+
+	return printUserRecord(out, *jsonOutput, record, message)
+}
+
+// printUserRecord prints record as JSON, or message if there is one, or
+// otherwise the record's fields.
+func printUserRecord(out io.Writer, jsonOutput bool, record userRecord, message string) error {
+	if jsonOutput {
+		return json.NewEncoder(out).Encode(record)
+	}
+	if message != "" {
+		fmt.Fprintln(out, message)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%d\n", record.ID)
+	fmt.Fprintf(w, "username:\t%s\n", record.Username)
+	fmt.Fprintf(w, "email:\t%s\n", record.Email)
+	fmt.Fprintf(w, "email verified:\t%t\n", record.EmailVerified)
+	fmt.Fprintf(w, "disabled:\t%t\n", record.Disabled)
+	fmt.Fprintf(w, "admin:\t%t\n", record.Admin)
+	fmt.Fprintf(w, "roles:\t%s\n", strings.Join(record.Roles, ", "))
+	return w.Flush()
+}
+
+// lookupUser finds a user by username, or by ID when name is a number;
+// usernames always start with a letter, so the two cannot be confused.
+func lookupUser(ctx context.Context, users store.UserStore, name string) (*store.User, error) {
+	var user *store.User
+	var err error
+	if id, convErr := strconv.Atoi(name); convErr == nil {
+		user, err = users.ReadUser(ctx, id)
+	} else {
+		user, err = users.GetUserByUsername(ctx, name)
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no such user %q", name)
+	}
+	return user, err
+}
+
+// newUserRecord reads the user's roles from the database rather than the
+// grant cache, since the record may be printed right after they changed.
+func newUserRecord(ctx context.Context, db *sql.DB, user *store.User) (userRecord, error) {
+	grants, err := store.LoadGrants(ctx, db, user.ID)
+	if err != nil {
+		return userRecord{}, err
+	}
+
+	roles := make([]string, 0, len(grants.Roles))
+	for role := range grants.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return userRecord{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Disabled:      user.Disabled,
+		Admin:         user.Admin,
+		Roles:         roles,
+	}, nil
+}
+
+// hashBenchResult is how hash-bench prints its measurement with -json.
+type hashBenchResult struct {
+	Memory  uint32        `json:"memory_kib"`
+	Time    uint32        `json:"time"`
+	Threads uint8         `json:"threads"`
+	Runs    int           `json:"runs"`
+	PerHash time.Duration `json:"per_hash_ns"`
+	Current bool          `json:"current"`
+	Params  string        `json:"params"`
+}
+
+// runHashBench implements "auth_module hash-bench", which times argon2id with
+// the hasher's or the given parameters to help pick costs for new hardware.
+func runHashBench(hasher *store.PasswordHasher, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("hash-bench", flag.ContinueOnError)
+	flags.SetOutput(out)
+	costs := hasher.Costs()
+	memory := flags.Uint("memory", uint(costs.Memory), "memory in KiB")
+	iterations := flags.Uint("time", uint(costs.Time), "number of passes")
+	threads := flags.Uint("threads", uint(costs.Threads), "degree of parallelism")
+	runs := flags.Int("runs", 5, "number of hashes to average over")
+	jsonOutput := flags.Bool("json", false, "print JSON instead of text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *memory == 0 || *iterations == 0 || *threads == 0 || *threads > 255 || *runs <= 0 {
+		return errors.New("-memory, -time and -runs must be positive and -threads between 1 and 255")
+	}
+
+	params := store.Argon2Config{Memory: uint32(*memory), Time: uint32(*iterations), Threads: uint8(*threads)}
+	salt, err := store.GenerateSalt()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for i := 0; i < *runs; i++ {
+		argon2.IDKey([]byte("hash-bench password"), salt, params.Time, params.Memory, params.Threads, store.ArgonKeyLen)
+	}
+	perHash := time.Since(start) / time.Duration(*runs)
+
+	result := hashBenchResult{
+		Memory:  params.Memory,
+		Time:    params.Time,
+		Threads: params.Threads,
+		Runs:    *runs,
+		PerHash: perHash,
+		Current: params == costs,
+		Params:  fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Time, params.Threads),
+	}
+
+	if *jsonOutput {
+		return json.NewEncoder(out).Encode(result)
+	}
+
+	current := ""
+	if result.Current {
+		current = " (current parameters)"
+	}
+	fmt.Fprintf(out, "argon2id %s%s: %s per hash over %d runs\n", result.Params, current, perHash.Round(time.Millisecond), *runs)
+	return nil
+}
+
+func userMain(args []string) {
+	s := mustNewService()
+	err := runUserCommand(context.Background(), s, args, os.Stdout, stdinPasswordPrompter())
+	s.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func hashBenchMain(args []string) {
+	config := mustLoadConfig()
+	if err := runHashBench(store.NewPasswordHasher(config.Argon2, config.Password), args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
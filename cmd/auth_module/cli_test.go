@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"auth_module/auth"
+	"auth_module/store"
+)
+
+// newTestService returns a service with a database of its own in a
+// temporary directory.
+func newTestService(t *testing.T) *auth.Service {
+	s, err := auth.NewService(&auth.Config{
+		SessionSecretKey: "test-secret-key",
+		Mailer:           auth.MailerMemory,
+		Database:         store.DatabaseConfig{Path: filepath.Join(t.TempDir(), "users_test.db")},
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func fixedPassword(password string) passwordPrompter {
+	return func(prompt string, confirm bool) (string, error) {
+		return password, nil
+	}
+}
+
+func TestRunUserCommand(t *testing.T) {
+	s := newTestService(t)
+	db := s.DB
+
+	ctx := context.Background()
+	var out bytes.Buffer
+	run := func(password string, args ...string) error {
+		out.Reset()
+		return runUserCommand(ctx, s, args, &out, fixedPassword(password))
+	}
+
+	if err := run("weak", "create", "cliuser"); err == nil {
+		t.Errorf("Expected a weak password to be rejected")
+	}
+	if err := run("ValidP@ssw0rd", "create", "-email", "not-an-email", "cliuser"); err == nil {
+		t.Errorf("Expected an invalid email to be rejected")
+	}
+	if exists, _ := store.UserExists(ctx, db, "cliuser"); exists {
+		t.Fatalf("Expected failed creates to leave no user behind")
+	}
+
+	if err := run("ValidP@ssw0rd", "create", "-admin", "-email", "cli@example.com", "-json", "cliuser"); err != nil {
+		t.Fatalf("user create failed: %v", err)
+	}
+	var record userRecord
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to parse JSON output %q: %v", out.String(), err)
+	}
+	if record.Username != "cliuser" || record.Email != "cli@example.com" || !record.Admin || len(record.Roles) != 1 || record.Roles[0] != store.RoleAdmin {
+		t.Errorf("Unexpected created user: %+v", record)
+	}
+
+	if err := run("", "list"); err != nil {
+		t.Fatalf("user list failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "USERNAME") || !strings.Contains(out.String(), "cliuser") {
+		t.Errorf("Expected a table listing cliuser, got %q", out.String())
+	}
+
+	if err := run("N3wP@ssw0rd!", "passwd", "cliuser"); err != nil {
+		t.Fatalf("user passwd failed: %v", err)
+	}
+	user, _ := store.GetUserByUsername(ctx, db, "cliuser")
+	if !store.CheckPasswordHash("N3wP@ssw0rd!", user.PasswordHash) {
+		t.Errorf("Expected the password to be changed")
+	}
+
+	now := time.Now()
+	if err := s.Throttler.Tracker.Lock("cliuser", now, now.Add(auth.LockoutDuration)); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := run("", "unlock", "cliuser"); err != nil {
+		t.Fatalf("user unlock failed: %v", err)
+	}
+	if lockedUntil, _ := s.Throttler.Tracker.LockedUntil("cliuser"); !lockedUntil.IsZero() {
+		t.Errorf("Expected cliuser to be unlocked, locked until %v", lockedUntil)
+	}
+	if err := run("", "unlock", "cliuser"); !errors.Is(err, auth.ErrAccountNotLocked) {
+		t.Errorf("Expected ErrAccountNotLocked, got %v", err)
+	}
+
+	if err := run("", "disable", "cliuser"); err != nil {
+		t.Fatalf("user disable failed: %v", err)
+	}
+	if err := run("", "show", strconv.Itoa(record.ID)); err != nil {
+		t.Fatalf("user show by ID failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "disabled:") || !strings.Contains(out.String(), "true") {
+		t.Errorf("Expected show to report the user as disabled, got %q", out.String())
+	}
+
+	if err := run("", "delete", "-json", "cliuser"); err != nil {
+		t.Fatalf("user delete failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `"roles":["admin"]`) {
+		t.Errorf("Expected the deleted user's roles in the output, got %q", out.String())
+	}
+	if err := run("", "show", "cliuser"); err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("Expected show to fail for a deleted user, got %v", err)
+	}
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("oldpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to generate bcrypt hash: %v", err)
+	}
+	costly := writeFile("costly.json", `[
+		{"username": "importok", "password_hash": "`+string(bcryptHash)+`"},
+		{"username": "importbad", "password_hash": "$scrypt$ln=16,r=1024,p=1$c2FsdA$aGFzaA"}
+	]`)
+	if err := run("", "import", costly); err == nil || !strings.Contains(err.Error(), "importbad") {
+		t.Errorf("Expected a hash with out-of-range parameters to be rejected, got %v", err)
+	}
+	if exists, _ := store.UserExists(ctx, db, "importok"); exists {
+		t.Errorf("Expected a rejected import to leave no user behind")
+	}
+	valid := writeFile("valid.json", `[{"username": "importok", "password_hash": "`+string(bcryptHash)+`"}]`)
+	if err := run("", "import", valid); err != nil {
+		t.Fatalf("user import failed: %v", err)
+	}
+	if out.String() != "imported 1 users\n" {
+		t.Errorf("Unexpected import output %q", out.String())
+	}
+	imported, _ := store.GetUserByUsername(ctx, db, "importok")
+	if imported == nil || !store.CheckPasswordHash("oldpassword", imported.PasswordHash) {
+		t.Errorf("Expected the imported user to keep their password")
+	}
+
+	if err := run("", "sideways", "cliuser"); err == nil {
+		t.Errorf("Expected an unknown subcommand to fail")
+	}
+}
+
+func TestRunHashBench(t *testing.T) {
+	hasher := store.NewPasswordHasher(store.Argon2Config{}, store.PasswordPolicy{})
+
+	var out bytes.Buffer
+	if err := runHashBench(hasher, []string{"-memory", "1024", "-runs", "1", "-json"}, &out); err != nil {
+		t.Fatalf("hash-bench failed: %v", err)
+	}
+
+	var result hashBenchResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse JSON output %q: %v", out.String(), err)
+	}
+	if result.Memory != 1024 || result.Current || result.PerHash <= 0 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	if err := runHashBench(hasher, []string{"-threads", "0"}, &out); err == nil {
+		t.Errorf("Expected zero threads to be rejected")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"auth_module/auth"
+)
+
+// stringsFlag collects every value of a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// clientRecord is how the client commands print a client with -json.
+type clientRecord struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Public       bool     `json:"public"`
+
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+}
+
+func newClientRecord(client *auth.OAuthClient, secret string) clientRecord {
+	return clientRecord{
+		ID:           client.ID,
+		Secret:       secret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		Public:       client.Public,
+
+		PostLogoutRedirectURIs: client.PostLogoutRedirectURIs,
+	}
+}
+
+// runClientCommand implements "auth_module client ...", which registers the
+// applications allowed to sign users in through the OAuth endpoints.
+func runClientCommand(ctx context.Context, s *auth.Service, args []string, out io.Writer) error {
+	db := s.DB
+
+	if len(args) == 0 {
+		return errors.New("usage: client add|list|remove [-json] ...")
+	}
+
+	flags := flag.NewFlagSet("client "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	jsonOutput := flags.Bool("json", false, "print JSON instead of text")
+	public := flags.Bool("public", false, "register a public client without a secret (add only)")
+	var redirectURIs, postLogoutRedirectURIs, scopes stringsFlag
+	flags.Var(&redirectURIs, "redirect-uri", "allowed redirect URI, may be repeated (add only)")
+	flags.Var(&postLogoutRedirectURIs, "post-logout-redirect-uri", "allowed redirect URI after logout, may be repeated (add only)")
+	flags.Var(&scopes, "scope", "scope the client may request, may be repeated (add only)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if flags.NArg() != 1 {
+			return errors.New("usage: client add [-public] -redirect-uri uri [-post-logout-redirect-uri uri] [-scope scope] ... name")
+		}
+		client, secret, err := auth.CreateOAuthClient(ctx, db, flags.Arg(0), redirectURIs, scopes, *public, time.Now())
+		if err != nil {
+			return err
+		}
+		if len(postLogoutRedirectURIs) > 0 {
+			if err := auth.SetPostLogoutRedirectURIs(ctx, db, client.ID, postLogoutRedirectURIs); err != nil {
+				if deleteErr := auth.DeleteOAuthClient(ctx, db, client.ID); deleteErr != nil {
+					return deleteErr
+				}
+				return err
+			}
+			client.PostLogoutRedirectURIs = postLogoutRedirectURIs
+		}
+		if *jsonOutput {
+			return json.NewEncoder(out).Encode(newClientRecord(client, secret))
+		}
+		fmt.Fprintf(out, "registered client %s\nclient_id: %s\n", client.Name, client.ID)
+		if secret != "" {
+			fmt.Fprintf(out, "client_secret: %s\nThe secret is not stored and cannot be shown again.\n", secret)
+		}
+		return nil
+	case "list":
+		clients, err := auth.ListOAuthClients(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		records := make([]clientRecord, 0, len(clients))
+		for _, client := range clients {
+			records = append(records, newClientRecord(&client, ""))
+		}
+		if *jsonOutput {
+			return json.NewEncoder(out).Encode(records)
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CLIENT ID\tNAME\tTYPE\tSCOPES\tREDIRECT URIS")
+		for _, record := range records {
+			kind := "confidential"
+			if record.Public {
+				kind = "public"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", record.ID, record.Name, kind, strings.Join(record.Scopes, " "), strings.Join(record.RedirectURIs, " "))
+		}
+		return w.Flush()
+	case "remove":
+		if flags.NArg() != 1 {
+			return errors.New("usage: client remove client_id")
+		}
+		if err := auth.DeleteOAuthClient(ctx, db, flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "removed client %s\n", flags.Arg(0))
+		return nil
+	default:
+		return fmt.Errorf("unknown client command %q", args[0])
+	}
+}
+
+func clientMain(args []string) {
+	s := mustNewService()
+	err := runClientCommand(context.Background(), s, args, os.Stdout)
+	s.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"auth_module/auth"
+)
+
+func TestRunClientCommand(t *testing.T) {
+	s := newTestService(t)
+
+	ctx := context.Background()
+	var out bytes.Buffer
+	run := func(args ...string) error {
+		out.Reset()
+		return runClientCommand(ctx, s, args, &out)
+	}
+
+	if err := run("add", "wiki"); err == nil {
+		t.Errorf("Expected a client without redirect URIs to be rejected")
+	}
+	if err := run("add", "-redirect-uri", "http://wiki.example.com/callback", "wiki"); err == nil {
+		t.Errorf("Expected a plain http redirect URI to be rejected")
+	}
+
+	if err := run("add", "-redirect-uri", "https://wiki.example.com/callback", "-post-logout-redirect-uri", "ftp://wiki.example.com/", "wiki"); err == nil {
+		t.Errorf("Expected an invalid post-logout redirect URI to be rejected")
+	}
+	if clients, err := auth.ListOAuthClients(ctx, s.DB); err != nil || len(clients) != 0 {
+		t.Errorf("Expected the rejected client not to be kept, got %d clients (%v)", len(clients), err)
+	}
+
+	if err := run("add", "-json", "-redirect-uri", "https://wiki.example.com/callback", "-post-logout-redirect-uri", "https://wiki.example.com/", "-scope", "openid", "-scope", "profile", "wiki"); err != nil {
+		t.Fatalf("client add failed: %v", err)
+	}
+	var record clientRecord
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to parse JSON output %q: %v", out.String(), err)
+	}
+	if record.Secret == "" || record.Public || len(record.Scopes) != 2 || len(record.PostLogoutRedirectURIs) != 1 {
+		t.Errorf("Unexpected registered client: %+v", record)
+	}
+
+	if err := run("add", "-public", "-redirect-uri", "http://127.0.0.1/callback", "cli"); err != nil {
+		t.Fatalf("client add failed: %v", err)
+	}
+	if strings.Contains(out.String(), "client_secret") {
+		t.Errorf("Expected a public client to get no secret, got:\n%s", out.String())
+	}
+
+	if err := run("list"); err != nil {
+		t.Fatalf("client list failed: %v", err)
+	}
+	if !strings.Contains(out.String(), record.ID) || !strings.Contains(out.String(), "public") || strings.Contains(out.String(), record.Secret) {
+		t.Errorf("Unexpected client list:\n%s", out.String())
+	}
+
+	if err := run("remove", record.ID); err != nil {
+		t.Fatalf("client remove failed: %v", err)
+	}
+	if _, err := auth.GetOAuthClient(ctx, s.DB, record.ID); err != auth.ErrOAuthClientNotFound {
+		t.Errorf("Expected the client to be removed, got %v", err)
+	}
+	if err := run("remove", record.ID); err == nil {
+		t.Errorf("Expected removing an unknown client to fail")
+	}
+}
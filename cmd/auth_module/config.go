@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"auth_module/auth"
+)
+
+// configPath is config.yaml in the working directory unless AUTH_CONFIG
+// points elsewhere.
+func configPath() string {
+	if path := os.Getenv("AUTH_CONFIG"); path != "" {
+		return path
+	}
+	return "config.yaml"
+}
+
+// runConfigCommand implements "auth_module config check", which prints the
+// effective configuration with secrets redacted.
+func runConfigCommand(config *auth.Config, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New("usage: config check")
+	}
+
+	data, err := yaml.Marshal(config.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func configMain(args []string) {
+	if err := runConfigCommand(mustLoadConfig(), args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
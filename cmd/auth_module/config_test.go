@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auth_module/auth"
+)
+
+func TestConfigCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("session_secret_key: topsecret\nsmtp_username: mailer\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	noEnv := func(string) (string, bool) { return "", false }
+
+	config, err := auth.LoadConfig(path, noEnv)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runConfigCommand(config, []string{"check"}, &out); err != nil {
+		t.Fatalf("config check failed: %v", err)
+	}
+	if strings.Contains(out.String(), "topsecret") || !strings.Contains(out.String(), "session_secret_key: REDACTED") {
+		t.Errorf("Expected the session secret to be redacted, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "smtp_username: mailer") || !strings.Contains(out.String(), "session_max_age: 8h0m0s") {
+		t.Errorf("Expected non-secret settings and defaults in the output, got:\n%s", out.String())
+	}
+	if config.SessionSecretKey != "topsecret" {
+		t.Errorf("Expected redaction to leave the original config untouched")
+	}
+}
@@ -0,0 +1,93 @@
+// Command auth_module runs the auth web server and the user, client, migrate,
+// config and hash-bench maintenance commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"auth_module/auth"
+	"auth_module/store"
+	"auth_module/web"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	switch args[0] {
+	case "serve":
+		serveMain(args[1:])
+	case "user":
+		userMain(args[1:])
+	case "client":
+		clientMain(args[1:])
+	case "migrate":
+		migrateMain(args[1:])
+	case "config":
+		configMain(args[1:])
+	case "hash-bench":
+		hashBenchMain(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", args[0], usage)
+		os.Exit(2)
+	}
+}
+
+func serveMain(args []string) {
+	s := mustNewService()
+	defer s.Close()
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", s.Config.ListenAddr, "address to listen on")
+	flags.Parse(args)
+
+	err := store.EnsureTestUser(context.Background(), s.Users)
+	if err != nil {
+		log.Fatalf("Failed to ensure test user: %v", err)
+	}
+
+	stopSweeper := s.Sessions.StartSweeper(time.Hour)
+	defer stopSweeper()
+	stopThrottleSweeper := s.Throttler.StartSweeper(10 * time.Minute)
+	defer stopThrottleSweeper()
+
+	r := gin.Default()
+	// Keep gin's ClientIP, which the request log shows, in line with the
+	// address the login throttler uses.
+	if err := r.SetTrustedProxies(s.Config.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies: %v", err)
+	}
+	web.Mount(r)
+	s.RegisterRoutes(r)
+
+	r.Run(*addr)
+}
+
+// mustLoadConfig loads the configuration for the commands that need it and
+// exits with every problem listed if it is invalid.
+func mustLoadConfig() *auth.Config {
+	config, err := auth.LoadConfig(configPath(), os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	return config
+}
+
+func mustNewService() *auth.Service {
+	s, err := auth.NewService(mustLoadConfig())
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"auth_module/store"
+)
+
+// runMigrateCommand implements "auth_module migrate status|up|down".
+func runMigrateCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate status | up [-dry-run] [-to version] | down [-dry-run] [-steps n]")
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "print the SQL that would run without changing the database")
+	target := flags.Int("to", 0, "apply migrations up to and including this version (up only)")
+	steps := flags.Int("steps", 1, "number of migrations to roll back (down only)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	migrator, err := store.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	migrator.DryRun = *dryRun
+	migrator.Log = out
+
+	switch args[0] {
+	case "status":
+		states, err := migrator.Status()
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, state := range states {
+			status, appliedAt := "pending", ""
+			if state.Applied {
+				status = "applied"
+				appliedAt = state.AppliedAt.Format(time.RFC3339)
+				if state.AppliedChecksum != state.Checksum() {
+					status = "modified"
+				}
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", state.Version, state.Name, status, appliedAt)
+		}
+		w.Flush()
+		return err
+	case "up":
+		applied, err := migrator.Up(*target)
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "database is up to date")
+		}
+		return err
+	case "down":
+		if *steps <= 0 {
+			return errors.New("-steps must be positive")
+		}
+		rolledBack, err := migrator.Down(*steps)
+		if err == nil && len(rolledBack) == 0 {
+			fmt.Fprintln(out, "nothing to roll back")
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// migrateMain opens the database without going through auth.NewService,
+// which would apply every pending migration before the command runs.
+func migrateMain(args []string) {
+	db, err := store.OpenDB(mustLoadConfig().Database)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	err = runMigrateCommand(db, args, os.Stdout)
+	db.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openEmptyTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users_test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists)
+	if err != nil {
+		t.Fatalf("Failed to check for table %s: %v", table, err)
+	}
+	return exists
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	db := openEmptyTestDB(t)
+	defer db.Close()
+
+	var out bytes.Buffer
+	if err := runMigrateCommand(db, []string{"status"}, &out); err != nil {
+		t.Fatalf("migrate status failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "0001") || !strings.Contains(out.String(), "pending") {
+		t.Errorf("Expected pending baseline migration in status, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := runMigrateCommand(db, []string{"up"}, &out); err != nil {
+		t.Fatalf("migrate up failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "apply 1_initial_schema") {
+		t.Errorf("Expected applied migration to be reported, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := runMigrateCommand(db, []string{"down", "-dry-run", "-steps", "1000"}, &out); err != nil {
+		t.Fatalf("migrate down -dry-run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "DROP TABLE IF EXISTS users") || !tableExists(t, db, "users") {
+		t.Errorf("Expected dry-run rollback to print SQL only, got %q", out.String())
+	}
+
+	if err := runMigrateCommand(db, []string{"sideways"}, &out); err == nil {
+		t.Errorf("Expected an unknown subcommand to fail")
+	}
+}
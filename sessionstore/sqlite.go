@@ -0,0 +1,349 @@
+// Package sessionstore is a gorilla/sessions store that keeps session data in
+// the sessions table, so users can list and revoke their sessions and
+// disabling an account can sign it out everywhere.
+package sessionstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const sessionIDLen = 32
+
+var ErrNotFound = errors.New("session not found")
+
+// Info describes one of a user's active sessions. Handle identifies
+// the session in URLs so the session ID itself never leaves the server.
+type Info struct {
+	Handle     string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+func (i Info) Device() string {
+	return describeUserAgent(i.UserAgent)
+}
+
+// SQLiteStore is a sessions.Store that keeps session values in the sessions
+// table and only puts a signed, opaque session ID in the cookie.
+type SQLiteStore struct {
+	db      *sql.DB
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func NewSQLiteStore(db *sql.DB, keyPairs ...[]byte) *SQLiteStore {
+	return &SQLiteStore{
+		db:     db,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+func (s *SQLiteStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *SQLiteStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	// A cookie we cannot decode (rotated key, or a value left over from the
+	// old cookie store) is treated like a missing one so the user simply
+	// gets a fresh session.
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	var data []byte
+	query := "SELECT data FROM sessions WHERE id = ? AND expires_at > ?"
+	err = s.db.QueryRow(query, id, time.Now().Unix()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	err = securecookie.GobEncoder{}.Deserialize(data, &session.Values)
+	if err != nil {
+		return session, err
+	}
+
+	_, err = s.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return session, err
+	}
+
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *SQLiteStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := generateSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	// A MaxAge of zero makes a browser-session cookie; the row still needs an
+	// expiry, so fall back to the store default.
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+
+	var userID interface{}
+	if id, ok := session.Values["user_id"].(int); ok {
+		userID = id
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`
+		INSERT INTO sessions (id, user_id, data, created_at, last_seen_at, expires_at, user_agent, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			user_id = excluded.user_id,
+			data = excluded.data,
+			last_seen_at = excluded.last_seen_at,
+			expires_at = excluded.expires_at`,
+		session.ID, userID, data, now, now, now+int64(maxAge), r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew gives session a new ID and deletes the row stored under the old one,
+// keeping its values. Call it when the session's privilege changes, such as
+// at login, so an ID planted in the browser beforehand becomes useless.
+func (s *SQLiteStore) Renew(session *sessions.Session) error {
+	if session.ID != "" {
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", session.ID); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+func (s *SQLiteStore) DeleteExpired() (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListUserSessions returns the user's unexpired sessions, most recently used
+// first, marking the one with currentID as the current session.
+func (s *SQLiteStore) ListUserSessions(userID int, currentID string) ([]Info, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY last_seen_at DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []Info
+	for rows.Next() {
+		var id string
+		var createdAt, lastSeenAt int64
+		info := Info{}
+		if err := rows.Scan(&id, &info.UserAgent, &info.IP, &createdAt, &lastSeenAt); err != nil {
+			return nil, err
+		}
+		info.Handle = sessionHandle(id)
+		info.CreatedAt = time.Unix(createdAt, 0)
+		info.LastSeenAt = time.Unix(lastSeenAt, 0)
+		info.Current = id == currentID
+		infos = append(infos, info)
+	}
+
+	return infos, rows.Err()
+}
+
+func (s *SQLiteStore) RevokeSession(userID int, handle string) error {
+	rows, err := s.db.Query("SELECT id FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	var target string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if sessionHandle(id) == handle {
+			target = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if target == "" {
+		return ErrNotFound
+	}
+
+	_, err = s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", target, userID)
+	return err
+}
+
+func (s *SQLiteStore) RevokeOtherSessions(userID int, currentID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, currentID)
+	return err
+}
+
+// RevokeUserSessions signs the user out everywhere, e.g. after a password
+// reset.
+func (s *SQLiteStore) RevokeUserSessions(userID int) error {
+	return RevokeUserSessions(s.db, userID)
+}
+
+// RevokeUserSessions deletes every session of the user from the sessions
+// table in db, for callers that have the database but no store.
+func RevokeUserSessions(db *sql.DB, userID int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// StartSweeper deletes expired sessions every interval until the returned
+// function is called.
+func (s *SQLiteStore) StartSweeper(interval time.Duration) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := s.DeleteExpired()
+				if err != nil {
+					log.Printf("Failed to delete expired sessions: %v", err)
+				} else if deleted > 0 {
+					log.Printf("Deleted %d expired sessions", deleted)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func generateSessionID() (string, error) {
+	buf := make([]byte, sessionIDLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.Contains(userAgent, "curl/"):
+		browser = "curl"
+	}
+
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
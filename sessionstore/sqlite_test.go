@@ -0,0 +1,241 @@
+package sessionstore
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"auth_module/store"
+)
+
+// openTestDB returns a migrated database in a temporary directory. Foreign
+// keys are not enforced, so sessions can belong to users that do not exist.
+func openTestDB(t *testing.T) *sql.DB {
+	foreignKeys := false
+	db, err := store.OpenDB(store.DatabaseConfig{Path: filepath.Join(t.TempDir(), "sessions_test.db"), ForeignKeys: &foreignKeys})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := store.Migrate(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return db
+}
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	db := openTestDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteStore(db, []byte("test-session-key"))
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "test-agent")
+
+	session, err := store.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !session.IsNew {
+		t.Errorf("Expected a new session for a request without cookie")
+	}
+
+	session.Values["user_id"] = 42
+	session.Values["username"] = "testuser"
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	cookie := w.Result().Cookies()[0]
+	if strings.Contains(cookie.Value, "testuser") {
+		t.Errorf("Expected cookie to hold only the session ID, got %q", cookie.Value)
+	}
+
+	var userID int
+	var userAgent, ip string
+	err = store.db.QueryRow("SELECT user_id, user_agent, ip FROM sessions WHERE id = ?", session.ID).Scan(&userID, &userAgent, &ip)
+	if err != nil {
+		t.Fatalf("Failed to read session row: %v", err)
+	}
+	if userID != 42 || userAgent != "test-agent" || ip != "192.0.2.1" {
+		t.Errorf("Unexpected session row: user_id=%d user_agent=%q ip=%q", userID, userAgent, ip)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+
+	loaded, err := store.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if loaded.IsNew {
+		t.Errorf("Expected existing session to be loaded")
+	}
+	if loaded.Values["user_id"] != 42 || loaded.Values["username"] != "testuser" {
+		t.Errorf("Unexpected session values: %v", loaded.Values)
+	}
+}
+
+func TestSQLiteStoreDelete(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	session, _ := store.Get(r, "session-name")
+	session.Values["user_id"] = 1
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	session.Options.MaxAge = -1
+	if err := session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+
+	loaded, err := store.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !loaded.IsNew || loaded.Values["user_id"] != nil {
+		t.Errorf("Expected deleted session to no longer load, got %v", loaded.Values)
+	}
+}
+
+func TestSQLiteStoreRenew(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	session, _ := store.Get(r, "session-name")
+	session.Values["csrf_token"] = "token"
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	planted := w.Result().Cookies()[0]
+	oldID := session.ID
+
+	if err := store.Renew(session); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	session.Values["user_id"] = 1
+	w = httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if session.ID == oldID {
+		t.Errorf("Expected a new session ID")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(planted)
+	loaded, err := store.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !loaded.IsNew || loaded.Values["user_id"] != nil {
+		t.Errorf("Expected the old session ID to no longer load, got %v", loaded.Values)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	loaded, err = store.Get(r, "session-name")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if loaded.Values["user_id"] != 1 || loaded.Values["csrf_token"] != "token" {
+		t.Errorf("Expected the renewed session to keep its values, got %v", loaded.Values)
+	}
+}
+
+func TestSQLiteStoreDeleteExpired(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	session, _ := store.Get(r, "session-name")
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	_, err := store.db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute).Unix(), session.ID)
+	if err != nil {
+		t.Fatalf("Failed to expire session: %v", err)
+	}
+
+	deleted, err := store.DeleteExpired()
+	if err != nil {
+		t.Fatalf("DeleteExpired failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 expired session to be deleted, got %d", deleted)
+	}
+}
+
+func TestSQLiteStoreRevokeSessions(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		session, _ := store.Get(r, "session-name")
+		session.Values["user_id"] = 7
+		if err := session.Save(r, httptest.NewRecorder()); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	infos, err := store.ListUserSessions(7, ids[0])
+	if err != nil {
+		t.Fatalf("ListUserSessions failed: %v", err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(infos))
+	}
+
+	var other string
+	for _, info := range infos {
+		if info.Handle == ids[0] {
+			t.Errorf("Expected handle to differ from the session ID")
+		}
+		if !info.Current {
+			other = info.Handle
+		}
+	}
+
+	if err := store.RevokeSession(8, other); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound when revoking another user's session, got %v", err)
+	}
+
+	if err := store.RevokeSession(7, other); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+
+	infos, _ = store.ListUserSessions(7, ids[0])
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 sessions after revoking one, got %d", len(infos))
+	}
+
+	if err := store.RevokeOtherSessions(7, ids[0]); err != nil {
+		t.Fatalf("RevokeOtherSessions failed: %v", err)
+	}
+
+	infos, _ = store.ListUserSessions(7, ids[0])
+	if len(infos) != 1 || !infos[0].Current {
+		t.Errorf("Expected only the current session to remain, got %+v", infos)
+	}
+}
@@ -0,0 +1,714 @@
+// Package store keeps users, their password hashes, invites, roles and
+// permissions in SQLite, and migrates the schema that the other packages'
+// tables live in. Functions take the *sql.DB to use; nothing here caches or
+// holds state between calls apart from GrantCache.
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type User struct {
+	ID            int
+	Username      string
+	PasswordHash  string
+	Email         string
+	EmailVerified bool
+	Disabled      bool
+	Admin         bool
+}
+
+const (
+	ArgonTime    = 1
+	ArgonMemory  = 64 * 1024 // 64 MB
+	ArgonThreads = 4
+	ArgonKeyLen  = 32
+	ArgonSaltLen = 16
+)
+
+// Limits on the cost parameters of a stored argon2id hash. Hashes are only
+// verified within them, so a row written by an import or by hand cannot tie
+// up the server for every login attempt against it; auth.Config keeps the
+// hasher's own costs inside them too.
+const (
+	MaxArgonMemory  = 1024 * 1024 // 1 GiB
+	MaxArgonTime    = 16
+	MaxArgonThreads = 64
+	maxHashLen      = 64
+)
+
+var (
+	ErrUserExists    = errors.New("user with this username already exists")
+	ErrInvalidInvite = errors.New("invite code is invalid or has already been used")
+	ErrEmailExists   = errors.New("email address is already in use")
+	ErrUserDisabled  = errors.New("account is disabled")
+)
+
+// DatabaseConfig tunes the connection pool shared by the whole process.
+type DatabaseConfig struct {
+	Path            string        `yaml:"path"`
+	JournalMode     string        `yaml:"journal_mode"`
+	BusyTimeout     time.Duration `yaml:"busy_timeout"`
+	ForeignKeys     *bool         `yaml:"foreign_keys"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+var sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+
+// ApplyDefaults fills in WAL mode, a five second busy timeout and enforced
+// foreign keys, and rejects journal modes SQLite does not know.
+func (c *DatabaseConfig) ApplyDefaults() error {
+	if c.Path == "" {
+		c.Path = "./users.db"
+	}
+	c.JournalMode = strings.ToUpper(c.JournalMode)
+	if c.JournalMode == "" {
+		c.JournalMode = "WAL"
+	}
+	if !slices.Contains(sqliteJournalModes, c.JournalMode) {
+		return fmt.Errorf("unknown journal mode %q", c.JournalMode)
+	}
+	if c.BusyTimeout == 0 {
+		c.BusyTimeout = 5 * time.Second
+	}
+	if c.ForeignKeys == nil {
+		foreignKeys := true
+		c.ForeignKeys = &foreignKeys
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = 10
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = c.MaxOpenConns
+	}
+	return nil
+}
+
+// OpenDB opens the connection pool for the database at cfg.Path. The pragmas are part of the DSN
+// so that every connection the pool opens gets them, not just the first one.
+// It does not touch the schema; run Migrate before serving requests.
+func OpenDB(cfg DatabaseConfig) (*sql.DB, error) {
+	if err := cfg.ApplyDefaults(); err != nil {
+		return nil, err
+	}
+
+	foreignKeys := 0
+	if *cfg.ForeignKeys {
+		foreignKeys = 1
+	}
+
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", fmt.Sprintf("journal_mode(%s)", cfg.JournalMode))
+	pragmas.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", cfg.BusyTimeout.Milliseconds()))
+	pragmas.Add("_pragma", fmt.Sprintf("foreign_keys(%d)", foreignKeys))
+
+	db, err := sql.Open("sqlite", cfg.Path+"?"+pragmas.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	return db, nil
+}
+
+func UserExists(ctx context.Context, db *sql.DB, username string) (bool, error) {
+	var exists bool
+	query := "SELECT COUNT(1) FROM users WHERE username = ?"
+	err := db.QueryRowContext(ctx, query, username).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func CreateUser(ctx context.Context, db *sql.DB, hasher *PasswordHasher, username, password string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	if err := hasher.ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := hasher.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT INTO users (username, password_hash) VALUES (?, ?)", username, hashedPassword)
+	if isSQLiteUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// CreateUserIfNotExists is CreateUser under the name most callers know it by.
+// A taken username is reported as ErrUserExists by the unique constraint, so
+// two registrations racing for the same name cannot both succeed.
+func CreateUserIfNotExists(ctx context.Context, db *sql.DB, hasher *PasswordHasher, username, password string) (int64, error) {
+	return CreateUser(ctx, db, hasher, username, password)
+}
+
+// NoPasswordHash is stored for users created by CreateUserWithoutPassword.
+// It is not in any format CheckPasswordHash understands, so no password
+// matches it.
+const NoPasswordHash = "!"
+
+// CreateUserWithoutPassword creates a user who cannot log in with a
+// password, for users who log in through an identity provider or a
+// directory. No password policy applies; they can set a password with a
+// password reset where that is allowed.
+func CreateUserWithoutPassword(ctx context.Context, db *sql.DB, username string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT INTO users (username, password_hash) VALUES (?, ?)", username, NoPasswordHash)
+	if isSQLiteUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// ImportedUser is a user migrated from another system together with the
+// password hash that system stored.
+type ImportedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+// ImportUsers inserts users with pre-hashed passwords in a single
+// transaction. Passwords are not checked against ValidatePassword since only
+// their hashes are known; the hash must be argon2id or one of the legacy
+// formats CheckPasswordHash understands.
+func ImportUsers(ctx context.Context, db *sql.DB, users []ImportedUser) (int, error) {
+	for _, user := range users {
+		if err := ValidateUsername(user.Username); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+		if err := validatePasswordHash(user.PasswordHash); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, user := range users {
+		_, err := tx.ExecContext(ctx, "INSERT INTO users (username, password_hash) VALUES (?, ?)", user.Username, user.PasswordHash)
+		if isSQLiteUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", user.Username, ErrUserExists)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(users), nil
+}
+
+func ReadUser(ctx context.Context, db *sql.DB, id int) (*User, error) {
+	row := db.QueryRowContext(ctx, "SELECT id, username, password_hash, COALESCE(email, ''), email_verified_at IS NOT NULL, disabled_at IS NOT NULL, admin FROM users WHERE id = ?", id)
+	user := &User{}
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.EmailVerified, &user.Disabled, &user.Admin)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func UpdateUser(ctx context.Context, db *sql.DB, hasher *PasswordHasher, id int, username, password string) error {
+	if username == "" && password == "" {
+		return errors.New("at least one of username or password must be provided")
+	}
+
+	var err error
+	updateFields := make([]string, 0)
+	updateArgs := make([]interface{}, 0)
+
+	if username != "" {
+		if err = ValidateUsername(username); err != nil {
+			return err
+		}
+		updateFields = append(updateFields, "username = ?")
+		updateArgs = append(updateArgs, username)
+	}
+
+	if password != "" {
+		hashedPassword, err := hasher.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		updateFields = append(updateFields, "password_hash = ?")
+		updateArgs = append(updateArgs, hashedPassword)
+	}
+
+	updateArgs = append(updateArgs, id)
+
+	query := fmt.Sprintf("UPDATE users SET %s WHERE id = ?", strings.Join(updateFields, ", "))
+
+	_, err = db.ExecContext(ctx, query, updateArgs...)
+	if isSQLiteUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// SetUserEmail validates and stores the user's email address. Changing the
+// address marks it unverified again; an empty email removes it.
+func SetUserEmail(ctx context.Context, db *sql.DB, id int, email string) error {
+	email = NormalizeEmail(email)
+	if email == "" {
+		_, err := db.ExecContext(ctx, "UPDATE users SET email = NULL, email_verified_at = NULL WHERE id = ?", id)
+		return err
+	}
+
+	if err := ValidateEmail(email); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, `UPDATE users SET email = ?,
+		email_verified_at = CASE WHEN email IS ? THEN email_verified_at ELSE NULL END
+		WHERE id = ?`, email, email, id)
+	if isSQLiteUniqueViolation(err) {
+		return ErrEmailExists
+	}
+	return err
+}
+
+// MarkEmailVerified records that the user confirmed email at time at. It
+// reports false, changing nothing, when email is no longer the user's address.
+func MarkEmailVerified(ctx context.Context, db *sql.DB, id int, email string, at time.Time) (bool, error) {
+	result, err := db.ExecContext(ctx, "UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ?", at.Unix(), id, NormalizeEmail(email))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// EmailExists reports whether a user other than exceptID has email.
+func EmailExists(ctx context.Context, db *sql.DB, email string, exceptID int) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT COUNT(1) FROM users WHERE email = ? AND id != ?", NormalizeEmail(email), exceptID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func DeleteUser(ctx context.Context, db *sql.DB, id int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+// userDataTables are the tables whose user_id column references users(id)
+// with ON DELETE CASCADE.
+var userDataTables = []string{
+	"sessions",
+	"user_totp",
+	"recovery_codes",
+	"webauthn_credentials",
+	"password_reset_tokens",
+	"email_verification_tokens",
+	"user_roles",
+	"api_tokens",
+	"oauth_authorization_codes",
+	"oauth_tokens",
+	"oauth_consents",
+	"external_identities",
+}
+
+// DeleteUserData deletes the rows that belong to user id, which the foreign
+// keys of the schema would otherwise remove along with the user. It is for
+// users kept in a separate UserStore, where the database runs with
+// foreign_keys off; with them on it finds nothing left to delete.
+func DeleteUserData(ctx context.Context, db *sql.DB, id int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range userDataTables {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE invites SET used_by = NULL WHERE used_by = ?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserDisabled disables or re-enables an account. It leaves existing
+// sessions alone; auth.Service.SetUserDisabled also signs the user out.
+func SetUserDisabled(ctx context.Context, db *sql.DB, id int, disabled bool) error {
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = time.Now().Unix()
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE users SET disabled_at = ? WHERE id = ?", disabledAt, id)
+	return err
+}
+
+// SetUserAdmin grants or takes away access to the admin console.
+func SetUserAdmin(ctx context.Context, db *sql.DB, id int, admin bool) error {
+	_, err := db.ExecContext(ctx, "UPDATE users SET admin = ? WHERE id = ?", admin, id)
+	return err
+}
+
+// ListUsers returns one page of users whose username or email contains
+// search, ordered by username, together with the number of matching users.
+func ListUsers(ctx context.Context, db *sql.DB, search string, offset, limit int) ([]User, int, error) {
+	pattern := "%" + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(search) + "%"
+	where := "WHERE username LIKE ? ESCAPE '\\' OR COALESCE(email, '') LIKE ? ESCAPE '\\'"
+
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(1) FROM users "+where, pattern, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, username, password_hash, COALESCE(email, ''), email_verified_at IS NOT NULL, disabled_at IS NOT NULL, admin FROM users "+
+		where+" ORDER BY username LIMIT ? OFFSET ?", pattern, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.EmailVerified, &user.Disabled, &user.Admin); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+
+	return users, total, rows.Err()
+}
+
+func CreateInvite(ctx context.Context, db *sql.DB) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+
+	_, err := db.ExecContext(ctx, "INSERT INTO invites (code) VALUES (?)", code)
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+func InviteValid(ctx context.Context, db *sql.DB, code string) (bool, error) {
+	var valid bool
+	query := "SELECT COUNT(1) FROM invites WHERE code = ? AND used_by IS NULL"
+	err := db.QueryRowContext(ctx, query, code).Scan(&valid)
+	if err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+func ConsumeInvite(ctx context.Context, db *sql.DB, code string, userID int64) error {
+	result, err := db.ExecContext(ctx, "UPDATE invites SET used_by = ?, used_at = CURRENT_TIMESTAMP WHERE code = ? AND used_by IS NULL", userID, code)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrInvalidInvite
+	}
+
+	return nil
+}
+
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, ArgonSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Argon2Config holds the cost of new password hashes. Existing hashes keep
+// their own parameters and are upgraded on the next successful login.
+type Argon2Config struct {
+	Memory  uint32 `yaml:"memory"`
+	Time    uint32 `yaml:"time"`
+	Threads uint8  `yaml:"threads"`
+}
+
+// PasswordPolicy is what PasswordHasher.ValidatePassword checks new
+// passwords against.
+// MaxLength 0 means no upper limit.
+type PasswordPolicy struct {
+	MinLength      int   `yaml:"min_length"`
+	MaxLength      int   `yaml:"max_length"`
+	RequireUpper   *bool `yaml:"require_upper"`
+	RequireLower   *bool `yaml:"require_lower"`
+	RequireDigit   *bool `yaml:"require_digit"`
+	RequireSpecial *bool `yaml:"require_special"`
+}
+
+// ApplyDefaults fills in ArgonMemory, ArgonTime and ArgonThreads for the
+// fields left at zero.
+func (a *Argon2Config) ApplyDefaults() {
+	if a.Memory == 0 {
+		a.Memory = ArgonMemory
+	}
+	if a.Time == 0 {
+		a.Time = ArgonTime
+	}
+	if a.Threads == 0 {
+		a.Threads = ArgonThreads
+	}
+}
+
+// ApplyDefaults requires eight characters and every character class unless
+// configured otherwise.
+func (p *PasswordPolicy) ApplyDefaults() {
+	if p.MinLength == 0 {
+		p.MinLength = 8
+	}
+	for _, rule := range []**bool{&p.RequireUpper, &p.RequireLower, &p.RequireDigit, &p.RequireSpecial} {
+		if *rule == nil {
+			required := true
+			*rule = &required
+		}
+	}
+}
+
+// argonParams are the argon2id cost parameters a hash was produced with.
+type argonParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// PasswordHasher hashes new passwords with one set of argon2id costs and
+// checks them against one password policy. Checking an existing hash does not
+// need a hasher since the costs travel with the hash; see CheckPasswordHash.
+type PasswordHasher struct {
+	params argonParams
+	policy PasswordPolicy
+}
+
+// NewPasswordHasher returns a hasher for costs and policy, using the defaults
+// for any field left at zero.
+func NewPasswordHasher(costs Argon2Config, policy PasswordPolicy) *PasswordHasher {
+	costs.ApplyDefaults()
+	policy.ApplyDefaults()
+
+	return &PasswordHasher{
+		params: argonParams{Time: costs.Time, Memory: costs.Memory, Threads: costs.Threads},
+		policy: policy,
+	}
+}
+
+// Costs returns the argon2id parameters new hashes are produced with.
+func (h *PasswordHasher) Costs() Argon2Config {
+	return Argon2Config{Memory: h.params.Memory, Time: h.params.Time, Threads: h.params.Threads}
+}
+
+// HashPassword returns an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>, so the cost
+// parameters travel with the hash.
+func (h *PasswordHasher) HashPassword(password string) (string, error) {
+	salt, err := GenerateSalt()
+	if err != nil {
+		return "", err
+	}
+
+	params := h.params
+	hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, ArgonKeyLen)
+
+	encodedHash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+	return encodedHash, nil
+}
+
+func CheckPasswordHash(password, encodedHash string) bool {
+	if isLegacyHash(encodedHash) {
+		matched, err := checkLegacyPasswordHash(password, encodedHash)
+		return err == nil && matched
+	}
+
+	params, salt, hash, err := decodeArgonHash(encodedHash)
+	if err != nil {
+		return false
+	}
+
+	computedHash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+
+	return subtle.ConstantTimeCompare(hash, computedHash) == 1
+}
+
+// validatePasswordHash checks that CheckPasswordHash can verify encodedHash:
+// it is in a recognised format and its cost parameters are within limits.
+func validatePasswordHash(encodedHash string) error {
+	if isLegacyHash(encodedHash) {
+		return validateLegacyHash(encodedHash)
+	}
+	_, _, _, err := decodeArgonHash(encodedHash)
+	return err
+}
+
+// NeedsRehash reports whether encodedHash should be replaced with a fresh
+// HashPassword result: it is in the legacy "salt$hash" format or was produced
+// with cost parameters other than the hasher's.
+func (h *PasswordHasher) NeedsRehash(encodedHash string) bool {
+	if !strings.HasPrefix(encodedHash, "$argon2id$") {
+		return true
+	}
+
+	params, _, hash, err := decodeArgonHash(encodedHash)
+	if err != nil {
+		return true
+	}
+
+	return params != h.params || len(hash) != ArgonKeyLen
+}
+
+// decodeArgonHash parses both the PHC format written by HashPassword and the
+// legacy "salt$hash" format, which always used the original constants.
+func decodeArgonHash(encodedHash string) (argonParams, []byte, []byte, error) {
+	parts := split(encodedHash, '$')
+
+	var params argonParams
+	var encodedSalt, encodedKey string
+	switch {
+	case len(parts) == 2:
+		params = argonParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+		encodedSalt, encodedKey = parts[0], parts[1]
+	case len(parts) == 6 && parts[0] == "" && parts[1] == "argon2id":
+		var version int
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return params, nil, nil, err
+		}
+		if version != argon2.Version {
+			return params, nil, nil, errors.New("unsupported argon2 version")
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+			return params, nil, nil, err
+		}
+		if params.Time == 0 || params.Time > MaxArgonTime || params.Threads == 0 || params.Threads > MaxArgonThreads ||
+			params.Memory < 8*uint32(params.Threads) || params.Memory > MaxArgonMemory {
+			return params, nil, nil, errors.New("argon2 parameters out of range")
+		}
+		encodedSalt, encodedKey = parts[4], parts[5]
+	default:
+		return params, nil, nil, errors.New("unrecognised password hash format")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if len(hash) == 0 || len(hash) > maxHashLen {
+		return params, nil, nil, errors.New("invalid password hash length")
+	}
+
+	return params, salt, hash, nil
+}
+
+func split(s string, delim byte) []string {
+	var result []string
+	var start int
+	for i := 0; i < len(s); i++ {
+		if s[i] == delim {
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	result = append(result, s[start:])
+	return result
+}
+
+func GetUserByUsername(ctx context.Context, db *sql.DB, username string) (*User, error) {
+	row := db.QueryRowContext(ctx, "SELECT id, username, password_hash, COALESCE(email, ''), email_verified_at IS NOT NULL, disabled_at IS NOT NULL, admin FROM users WHERE username = ?", username)
+	user := &User{}
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.EmailVerified, &user.Disabled, &user.Admin)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func EnsureTestUser(ctx context.Context, users UserStore) error {
+	username := "test"
+	password := "Test@1234"
+
+	_, err := users.CreateUser(ctx, username, password)
+	if errors.Is(err, ErrUserExists) {
+		log.Printf("Test user already exists: %s", username)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Created test user with username: %s", username)
+
+	return nil
+}
+
+// isSQLiteUniqueViolation reports whether err is SQLite refusing a write that
+// would break a UNIQUE constraint.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
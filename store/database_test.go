@@ -0,0 +1,561 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// testHasher uses the default costs and policy, like a service whose config
+// leaves them unset.
+var testHasher = NewPasswordHasher(Argon2Config{}, PasswordPolicy{})
+
+// openTestDB returns a migrated database of its own in a temporary directory.
+// Foreign keys are not enforced, so store tests can save sessions for users
+// they never created.
+func openTestDB(t *testing.T) *sql.DB {
+	foreignKeys := false
+	db, err := OpenDB(DatabaseConfig{Path: filepath.Join(t.TempDir(), "users_test.db"), ForeignKeys: &foreignKeys})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	err = Migrate(db)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	return db
+}
+
+func TestReadUser(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "readtestuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != username {
+		t.Errorf("Expected username %s, got %s", username, user.Username)
+	}
+
+	if !CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Password hash did not match original password after username update")
+	}
+}
+func TestUpdateUser(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "updatetestuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	updatedUsername := "updateduser"
+	err = UpdateUser(context.Background(), db, testHasher, int(userID), updatedUsername, "")
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != updatedUsername {
+		t.Errorf("Expected username %s, got %s", updatedUsername, user.Username)
+	}
+
+	if !CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Password hash did not match original password after username update")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "deletetestuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	err = DeleteUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err == nil {
+		t.Errorf("Expected error when reading deleted user, got none. User: %+v", user)
+	}
+}
+
+func TestDeleteUserData(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	// With foreign keys off, as for users kept in another UserStore,
+	// deleting the user leaves their rows behind.
+	userID, err := CreateUser(ctx, db, testHasher, "datauser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	otherID, err := CreateUser(ctx, db, testHasher, "otheruser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	for _, id := range []int64{userID, otherID} {
+		if _, err := db.Exec("INSERT INTO user_totp (user_id, secret) VALUES (?, 'secret')", id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, 'hash')", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, err := CreateInvite(ctx, db)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	if err := ConsumeInvite(ctx, db, code, userID); err != nil {
+		t.Fatalf("ConsumeInvite failed: %v", err)
+	}
+
+	if err := DeleteUser(ctx, db, int(userID)); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if err := DeleteUserData(ctx, db, int(userID)); err != nil {
+		t.Fatalf("DeleteUserData failed: %v", err)
+	}
+
+	for _, table := range []string{"user_totp", "recovery_codes"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(1) FROM "+table+" WHERE user_id = ?", userID).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no %s rows of the deleted user, got %d", table, count)
+		}
+		if err := db.QueryRow("SELECT COUNT(1) FROM "+table+" WHERE user_id = ?", otherID).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("Expected the %s row of another user to be kept, got %d", table, count)
+		}
+	}
+
+	// Like ON DELETE SET NULL, the invite forgets who used it.
+	var usedBy sql.NullInt64
+	if err := db.QueryRow("SELECT used_by FROM invites WHERE code = ?", code).Scan(&usedBy); err != nil {
+		t.Fatal(err)
+	}
+	if usedBy.Valid {
+		t.Errorf("Expected the invite to forget the deleted user, got %d", usedBy.Int64)
+	}
+}
+
+func TestCreateUserIfNotExists(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "uniqueuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed on first attempt: %v", err)
+	}
+
+	if userID <= 0 {
+		t.Errorf("Expected valid user ID, got %d", userID)
+	}
+
+	_, err = CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err == nil {
+		t.Fatalf("Expected error for duplicate user creation, but got none")
+	} else {
+		expectedError := "user with this username already exists"
+		if err.Error() != expectedError {
+			t.Errorf("Expected error message '%s', but got '%s'", expectedError, err.Error())
+		}
+	}
+}
+
+func TestHashAndCheckPassword(t *testing.T) {
+	password := "ValidP@ssw0rd"
+	hashedPassword, err := testHasher.HashPassword(password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	if !CheckPasswordHash(password, hashedPassword) {
+		t.Errorf("Password did not match hashed password")
+	}
+
+	if CheckPasswordHash("wrongpassword", hashedPassword) {
+		t.Errorf("Expected hash check to fail with wrong password")
+	}
+}
+
+func TestCreateUserWithPassword(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "secureuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.PasswordHash == "" {
+		t.Fatalf("Password hash was not stored correctly.")
+	}
+
+	if !CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Stored password hash did not match the original password")
+	}
+}
+
+func TestUpdateUsernameOnly(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "initialuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	newUsername := "updateduser"
+	err = UpdateUser(context.Background(), db, testHasher, int(userID), newUsername, "")
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != newUsername {
+		t.Errorf("Expected username %s, got %s", newUsername, user.Username)
+	}
+
+	if !CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Password hash did not match original password after username update")
+	}
+}
+
+func TestUpdatePasswordOnly(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "initialuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	newPassword := "UpdatedP@ssw0rd"
+	err = UpdateUser(context.Background(), db, testHasher, int(userID), "", newPassword)
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != username {
+		t.Errorf("Expected username %s, got %s", username, user.Username)
+	}
+
+	if !CheckPasswordHash(newPassword, user.PasswordHash) {
+		t.Errorf("Stored password hash did not match updated password")
+	}
+}
+
+func TestUpdateUsernameAndPassword(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "initialuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	newUsername := "updateduser"
+	newPassword := "UpdatedP@ssw0rd"
+	err = UpdateUser(context.Background(), db, testHasher, int(userID), newUsername, newPassword)
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != newUsername {
+		t.Errorf("Expected username %s, got %s", newUsername, user.Username)
+	}
+
+	if !CheckPasswordHash(newPassword, user.PasswordHash) {
+		t.Errorf("Stored password hash did not match updated password")
+	}
+}
+
+func TestUpdateNoFields(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	username := "initialuser"
+	password := "ValidP@ssw0rd"
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, username, password)
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	err = UpdateUser(context.Background(), db, testHasher, int(userID), "", "")
+	if err == nil {
+		t.Fatalf("Expected error when updating with no fields, but got none")
+	}
+
+	user, err := ReadUser(context.Background(), db, int(userID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+
+	if user.Username != username {
+		t.Errorf("Expected username %s, got %s", username, user.Username)
+	}
+
+	if !CheckPasswordHash(password, user.PasswordHash) {
+		t.Errorf("Stored password hash did not match original password")
+	}
+}
+
+func TestInvites(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	code, err := CreateInvite(context.Background(), db)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+
+	valid, err := InviteValid(context.Background(), db, code)
+	if err != nil {
+		t.Fatalf("InviteValid failed: %v", err)
+	}
+	if !valid {
+		t.Fatalf("Expected new invite to be valid")
+	}
+
+	userID, err := CreateUserIfNotExists(context.Background(), db, testHasher, "inviteduser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	err = ConsumeInvite(context.Background(), db, code, userID)
+	if err != nil {
+		t.Fatalf("ConsumeInvite failed: %v", err)
+	}
+
+	valid, err = InviteValid(context.Background(), db, code)
+	if err != nil {
+		t.Fatalf("InviteValid failed: %v", err)
+	}
+	if valid {
+		t.Errorf("Expected consumed invite to be invalid")
+	}
+
+	err = ConsumeInvite(context.Background(), db, code, userID)
+	if err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite when reusing invite, got %v", err)
+	}
+}
+
+func legacyPasswordHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
+	return base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash)
+}
+
+func TestHashPasswordPHCFormat(t *testing.T) {
+	hashedPassword, err := testHasher.HashPassword("ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	expectedPrefix := fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$", ArgonMemory, ArgonTime, ArgonThreads)
+	if !strings.HasPrefix(hashedPassword, expectedPrefix) {
+		t.Errorf("Expected hash to start with %s, got %s", expectedPrefix, hashedPassword)
+	}
+
+	if testHasher.NeedsRehash(hashedPassword) {
+		t.Errorf("Expected a fresh hash not to need rehashing")
+	}
+}
+
+func TestCheckPasswordHashFormats(t *testing.T) {
+	password := "ValidP@ssw0rd"
+
+	legacy := legacyPasswordHash(password)
+	if !CheckPasswordHash(password, legacy) {
+		t.Errorf("Expected legacy hash to verify")
+	}
+	if CheckPasswordHash("wrongpassword", legacy) {
+		t.Errorf("Expected legacy hash check to fail with wrong password")
+	}
+	if !testHasher.NeedsRehash(legacy) {
+		t.Errorf("Expected legacy hash to need rehashing")
+	}
+
+	salt := []byte("fedcba9876543210")
+	cheap := argon2.IDKey([]byte(password), salt, 2, 8*1024, 1, 32)
+	outdated := fmt.Sprintf("$argon2id$v=19$m=8192,t=2,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(cheap))
+	if !CheckPasswordHash(password, outdated) {
+		t.Errorf("Expected hash with non-default parameters to verify")
+	}
+	if !testHasher.NeedsRehash(outdated) {
+		t.Errorf("Expected hash with outdated parameters to need rehashing")
+	}
+
+	for _, malformed := range []string{"", "$argon2id$v=19$m=1,t=0,p=1$AAAA$AAAA", "$argon2i$v=19$m=8192,t=2,p=1$AAAA$AAAA", "a$b$c"} {
+		if CheckPasswordHash(password, malformed) {
+			t.Errorf("Expected malformed hash %q to be rejected", malformed)
+		}
+	}
+}
+
+func TestDatabaseConfigDefaults(t *testing.T) {
+	cfg := DatabaseConfig{JournalMode: "wal"}
+	if err := cfg.ApplyDefaults(); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if cfg.JournalMode != "WAL" || cfg.BusyTimeout != 5*time.Second {
+		t.Errorf("Unexpected defaults: %+v", cfg)
+	}
+	if cfg.ForeignKeys == nil || !*cfg.ForeignKeys {
+		t.Errorf("Expected foreign keys to be enforced by default")
+	}
+	if cfg.MaxIdleConns != cfg.MaxOpenConns {
+		t.Errorf("Expected idle pool to match open pool, got %d and %d", cfg.MaxIdleConns, cfg.MaxOpenConns)
+	}
+
+	cfg = DatabaseConfig{JournalMode: "sideways"}
+	if err := cfg.ApplyDefaults(); err == nil {
+		t.Errorf("Expected an unknown journal mode to be rejected")
+	}
+}
+
+func TestSetUserEmail(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	firstID, _ := CreateUserIfNotExists(context.Background(), db, testHasher, "firstuser", "ValidP@ssw0rd")
+	secondID, _ := CreateUserIfNotExists(context.Background(), db, testHasher, "seconduser", "ValidP@ssw0rd")
+
+	if err := SetUserEmail(context.Background(), db, int(firstID), "not-an-email"); err == nil {
+		t.Errorf("Expected an invalid email to be rejected")
+	}
+
+	if err := SetUserEmail(context.Background(), db, int(firstID), "Shared@Example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	if err := SetUserEmail(context.Background(), db, int(secondID), "shared@example.com"); err != ErrEmailExists {
+		t.Errorf("Expected ErrEmailExists for a case variant of a taken address, got %v", err)
+	}
+
+	user, err := ReadUser(context.Background(), db, int(firstID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+	if user.Email != "shared@example.com" || user.EmailVerified {
+		t.Errorf("Expected normalized, unverified email, got %q verified=%v", user.Email, user.EmailVerified)
+	}
+
+	if err := SetUserEmail(context.Background(), db, int(firstID), ""); err != nil {
+		t.Fatalf("SetUserEmail failed to clear email: %v", err)
+	}
+	if err := SetUserEmail(context.Background(), db, int(secondID), "shared@example.com"); err != nil {
+		t.Errorf("Expected a released address to be reusable, got %v", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	for _, username := range []string{"alice", "bobby", "carol", "al_ce"} {
+		if _, err := CreateUserIfNotExists(ctx, db, testHasher, username, "ValidP@ssw0rd"); err != nil {
+			t.Fatalf("CreateUserIfNotExists failed: %v", err)
+		}
+	}
+	bob, _ := GetUserByUsername(ctx, db, "bobby")
+	if err := SetUserEmail(ctx, db, bob.ID, "bob@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+
+	users, total, err := ListUsers(ctx, db, "", 1, 2)
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if total != 4 || len(users) != 2 || users[0].Username != "alice" || users[1].Username != "bobby" {
+		t.Errorf("Expected the second and third users by name, got %d %+v", total, users)
+	}
+
+	users, total, _ = ListUsers(ctx, db, "example.com", 0, 10)
+	if total != 1 || len(users) != 1 || users[0].Username != "bobby" {
+		t.Errorf("Expected a search to match email addresses, got %+v", users)
+	}
+
+	users, total, _ = ListUsers(ctx, db, "_", 0, 10)
+	if total != 1 || users[0].Username != "al_ce" {
+		t.Errorf("Expected LIKE wildcards in the search to match literally, got %+v", users)
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Hashes imported from older systems are verified in their original format
+// and replaced with argon2id by auth.Service.LoginUser on the next successful
+// login, since NeedsRehash reports true for anything that is not argon2id.
+//
+// Recognised formats:
+//
+//	$2a$, $2b$, $2y$                         bcrypt
+//	pbkdf2_sha256$<iter>$<salt>$<hash>       Django PBKDF2-SHA256
+//	$pbkdf2-sha256$<iter>$<salt>$<hash>      passlib PBKDF2-SHA256
+//	$scrypt$ln=<n>,r=<r>,p=<p>$<salt>$<hash> passlib scrypt
+
+// Limits on the cost of legacy hashes, so that one imported or tampered row
+// cannot make a login attempt run for minutes or allocate gigabytes. They are
+// well above what the source systems ever defaulted to.
+const (
+	maxLegacyBcryptCost       = 16
+	maxLegacyPBKDF2Iterations = 10_000_000
+	maxLegacyScryptLogN       = 20
+	maxLegacyScryptR          = 32
+	maxLegacyScryptP          = 16
+)
+
+// passlib's "adapted base64" uses '.' instead of '+' and omits padding.
+var passlibEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+func isBcryptHash(encodedHash string) bool {
+	return strings.HasPrefix(encodedHash, "$2a$") || strings.HasPrefix(encodedHash, "$2b$") || strings.HasPrefix(encodedHash, "$2y$")
+}
+
+func isLegacyHash(encodedHash string) bool {
+	return isBcryptHash(encodedHash) ||
+		strings.HasPrefix(encodedHash, "pbkdf2_sha256$") ||
+		strings.HasPrefix(encodedHash, "$pbkdf2-sha256$") ||
+		strings.HasPrefix(encodedHash, "$scrypt$")
+}
+
+// validateLegacyHash parses encodedHash and checks its cost parameters
+// without computing anything.
+func validateLegacyHash(encodedHash string) error {
+	switch {
+	case isBcryptHash(encodedHash):
+		_, err := bcryptHash(encodedHash)
+		return err
+	case strings.HasPrefix(encodedHash, "pbkdf2_sha256$"):
+		_, _, _, err := parsePBKDF2(encodedHash, base64.StdEncoding, false)
+		return err
+	case strings.HasPrefix(encodedHash, "$pbkdf2-sha256$"):
+		_, _, _, err := parsePBKDF2(encodedHash[1:], passlibEncoding, true)
+		return err
+	case strings.HasPrefix(encodedHash, "$scrypt$"):
+		_, _, _, _, _, err := parseScrypt(encodedHash)
+		return err
+	default:
+		return errors.New("unrecognised password hash format")
+	}
+}
+
+func checkLegacyPasswordHash(password, encodedHash string) (bool, error) {
+	switch {
+	case isBcryptHash(encodedHash):
+		hash, err := bcryptHash(encodedHash)
+		if err != nil {
+			return false, err
+		}
+		err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encodedHash, "pbkdf2_sha256$"):
+		return checkPBKDF2(password, encodedHash, base64.StdEncoding, false)
+	case strings.HasPrefix(encodedHash, "$pbkdf2-sha256$"):
+		return checkPBKDF2(password, encodedHash[1:], passlibEncoding, true)
+	case strings.HasPrefix(encodedHash, "$scrypt$"):
+		return checkScrypt(password, encodedHash)
+	default:
+		return false, errors.New("unrecognised password hash format")
+	}
+}
+
+// bcryptHash returns encodedHash in a form x/crypto/bcrypt accepts, after
+// checking its cost.
+func bcryptHash(encodedHash string) ([]byte, error) {
+	// x/crypto/bcrypt only knows the $2a$ and $2b$ prefixes; $2y$ is the
+	// same algorithm under PHP's name.
+	if strings.HasPrefix(encodedHash, "$2y$") {
+		encodedHash = "$2b$" + encodedHash[4:]
+	}
+	hash := []byte(encodedHash)
+
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return nil, err
+	}
+	if cost > maxLegacyBcryptCost {
+		return nil, errors.New("bcrypt cost out of range")
+	}
+	return hash, nil
+}
+
+func parsePBKDF2(encodedHash string, encoding *base64.Encoding, encodedSalt bool) (int, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 4 {
+		return 0, nil, nil, errors.New("malformed pbkdf2 hash")
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxLegacyPBKDF2Iterations {
+		return 0, nil, nil, errors.New("invalid pbkdf2 iteration count")
+	}
+
+	salt := []byte(parts[2])
+	if encodedSalt {
+		salt, err = encoding.DecodeString(parts[2])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	hash, err := encoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	// Every 32 bytes of output cost another run of all the iterations.
+	if len(hash) == 0 || len(hash) > maxHashLen {
+		return 0, nil, nil, errors.New("invalid pbkdf2 hash length")
+	}
+
+	return iterations, salt, hash, nil
+}
+
+func checkPBKDF2(password, encodedHash string, encoding *base64.Encoding, encodedSalt bool) (bool, error) {
+	iterations, salt, hash, err := parsePBKDF2(encodedHash, encoding, encodedSalt)
+	if err != nil {
+		return false, err
+	}
+
+	computedHash := pbkdf2.Key([]byte(password), salt, iterations, len(hash), sha256.New)
+	return subtle.ConstantTimeCompare(hash, computedHash) == 1, nil
+}
+
+func parseScrypt(encodedHash string) (logN, r, p int, salt, hash []byte, err error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 5 {
+		return 0, 0, 0, nil, nil, errors.New("malformed scrypt hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	// scrypt needs 128*r*N bytes of memory and p times the work.
+	if logN <= 0 || logN > maxLegacyScryptLogN || r <= 0 || r > maxLegacyScryptR || p <= 0 || p > maxLegacyScryptP ||
+		128*r<<logN > MaxArgonMemory*1024 {
+		return 0, 0, 0, nil, nil, errors.New("scrypt parameters out of range")
+	}
+
+	salt, err = passlibEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	hash, err = passlibEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	if len(hash) == 0 || len(hash) > maxHashLen {
+		return 0, 0, 0, nil, nil, errors.New("invalid scrypt hash length")
+	}
+
+	return logN, r, p, salt, hash, nil
+}
+
+func checkScrypt(password, encodedHash string) (bool, error) {
+	logN, r, p, salt, hash, err := parseScrypt(encodedHash)
+	if err != nil {
+		return false, err
+	}
+
+	computedHash, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, computedHash) == 1, nil
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+func legacyTestHashes(t *testing.T, password string) map[string]string {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to generate bcrypt hash: %v", err)
+	}
+
+	salt := []byte("legacysaltvalue!")
+	pbkdf2Hash := pbkdf2.Key([]byte(password), salt, 1000, 32, sha256.New)
+	scryptHash, err := scrypt.Key([]byte(password), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatalf("Failed to generate scrypt hash: %v", err)
+	}
+
+	return map[string]string{
+		"bcrypt":         string(bcryptHash),
+		"bcrypt 2y":      "$2y$" + string(bcryptHash)[4:],
+		"django pbkdf2":  fmt.Sprintf("pbkdf2_sha256$1000$%s$%s", salt, base64.StdEncoding.EncodeToString(pbkdf2Hash)),
+		"passlib pbkdf2": fmt.Sprintf("$pbkdf2-sha256$1000$%s$%s", passlibEncoding.EncodeToString(salt), passlibEncoding.EncodeToString(pbkdf2Hash)),
+		"passlib scrypt": fmt.Sprintf("$scrypt$ln=10,r=8,p=1$%s$%s", passlibEncoding.EncodeToString(salt), passlibEncoding.EncodeToString(scryptHash)),
+	}
+}
+
+func TestCheckLegacyPasswordHash(t *testing.T) {
+	password := "ValidP@ssw0rd"
+
+	for name, hash := range legacyTestHashes(t, password) {
+		t.Run(name, func(t *testing.T) {
+			if !CheckPasswordHash(password, hash) {
+				t.Errorf("Expected %s hash to verify", name)
+			}
+			if CheckPasswordHash("wrongpassword", hash) {
+				t.Errorf("Expected %s hash check to fail with wrong password", name)
+			}
+			if !testHasher.NeedsRehash(hash) {
+				t.Errorf("Expected %s hash to need rehashing", name)
+			}
+		})
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	// Deliberately weak: imported passwords skip ValidatePassword.
+	password := "oldpassword"
+
+	var users []ImportedUser
+	i := 0
+	for _, hash := range legacyTestHashes(t, password) {
+		users = append(users, ImportedUser{Username: fmt.Sprintf("imported%d", i), PasswordHash: hash})
+		i++
+	}
+
+	_, err := ImportUsers(context.Background(), db, append(users, ImportedUser{Username: "badhash", PasswordHash: "$1$saltsalt$md5cryptisnotsupported"}))
+	if err == nil || !strings.Contains(err.Error(), "badhash") {
+		t.Errorf("Expected import with an unknown hash format to fail, got %v", err)
+	}
+
+	// Hashes in a known format whose cost would tie up the server at every
+	// login are refused on import and again when checked.
+	salt, key := base64.RawStdEncoding.EncodeToString([]byte("somesaltsomesalt")), base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	passlibSalt, passlibKey := passlibEncoding.EncodeToString([]byte("somesaltsomesalt")), passlibEncoding.EncodeToString(make([]byte, 32))
+	for _, hash := range []string{
+		fmt.Sprintf("$argon2id$v=19$m=%d,t=1,p=1$%s$%s", MaxArgonMemory+1, salt, key),
+		fmt.Sprintf("$argon2id$v=19$m=65536,t=%d,p=1$%s$%s", MaxArgonTime+1, salt, key),
+		fmt.Sprintf("$argon2id$v=19$m=65536,t=1,p=%d$%s$%s", MaxArgonThreads+1, salt, key),
+		fmt.Sprintf("$argon2id$v=19$m=65536,t=1,p=1$%s$%s", salt, base64.RawStdEncoding.EncodeToString(make([]byte, 4096))),
+		fmt.Sprintf("$scrypt$ln=16,r=%d,p=1$%s$%s", maxLegacyScryptR+1, passlibSalt, passlibKey),
+		fmt.Sprintf("$scrypt$ln=16,r=8,p=%d$%s$%s", maxLegacyScryptP+1, passlibSalt, passlibKey),
+		fmt.Sprintf("$scrypt$ln=20,r=16,p=1$%s$%s", passlibSalt, passlibKey),
+		fmt.Sprintf("pbkdf2_sha256$1000$somesalt$%s", base64.StdEncoding.EncodeToString(make([]byte, 1<<20))),
+		"$2b$31$" + legacyTestHashes(t, password)["bcrypt"][7:],
+	} {
+		if _, err := ImportUsers(context.Background(), db, []ImportedUser{{Username: "costly", PasswordHash: hash}}); err == nil {
+			t.Errorf("Expected import of %.40s... to fail", hash)
+		}
+		if CheckPasswordHash(password, hash) {
+			t.Errorf("Expected %.40s... not to verify", hash)
+		}
+	}
+
+	imported, err := ImportUsers(context.Background(), db, users)
+	if err != nil {
+		t.Fatalf("ImportUsers failed: %v", err)
+	}
+	if imported != len(users) {
+		t.Errorf("Expected %d users to be imported, got %d", len(users), imported)
+	}
+
+	if _, err := ImportUsers(context.Background(), db, users[:1]); err == nil {
+		t.Errorf("Expected importing an existing username to fail")
+	}
+
+	for _, user := range users {
+		stored, err := GetUserByUsername(context.Background(), db, user.Username)
+		if err != nil {
+			t.Fatalf("GetUserByUsername failed: %v", err)
+		}
+		if stored.PasswordHash != user.PasswordHash || !CheckPasswordHash(password, stored.PasswordHash) {
+			t.Errorf("Expected %s to keep its imported hash, got %s", user.Username, stored.PasswordHash)
+		}
+	}
+}
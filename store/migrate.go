@@ -0,0 +1,371 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is one numbered schema change, read from
+// migrations/<version>_<name>.up.sql and the matching .down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the up script, so editing a migration after it has been
+// applied somewhere is detected instead of silently diverging.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationState is a migration together with whether and when it has been
+// applied to a database.
+type MigrationState struct {
+	Migration
+	Applied         bool
+	AppliedAt       time.Time
+	AppliedChecksum string
+}
+
+var (
+	ErrMigrationChecksum = errors.New("applied migration has been modified")
+	ErrUnknownMigration  = errors.New("database has a migration this build does not know about")
+)
+
+// loadMigrations reads all migrations from fsys, ordered by version.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		base := path.Base(name)
+
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", base)
+		}
+
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		versionPart, migrationName, ok := strings.Cut(stem, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", base)
+		}
+		version, err := strconv.Atoi(versionPart)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", base)
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = migration
+		}
+		if migration.Name != migrationName {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, migrationName)
+		}
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations. With DryRun set it only writes
+// what it would do to Log.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	DryRun     bool
+	Log        io.Writer
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, Log: io.Discard}, nil
+}
+
+// Migrate brings db up to the latest migration.
+func Migrate(db *sql.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(0)
+	return err
+}
+
+// Status lists every known migration and whether it has been applied. It
+// fails with ErrMigrationChecksum or ErrUnknownMigration when the database
+// does not match this build's migrations.
+func (m *Migrator) Status() ([]MigrationState, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		state := MigrationState{Migration: migration}
+		if row, ok := applied[migration.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = row.AppliedAt
+			state.AppliedChecksum = row.AppliedChecksum
+			delete(applied, migration.Version)
+		}
+		states = append(states, state)
+	}
+
+	if len(applied) > 0 {
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Ints(versions)
+		return states, fmt.Errorf("%w: version %d", ErrUnknownMigration, versions[0])
+	}
+
+	for _, state := range states {
+		if state.Applied && state.AppliedChecksum != state.Checksum() {
+			return states, fmt.Errorf("%w: %d_%s", ErrMigrationChecksum, state.Version, state.Name)
+		}
+	}
+
+	return states, nil
+}
+
+// Up applies pending migrations up to and including target, or all of them
+// when target is 0, and returns the migrations it applied.
+func (m *Migrator) Up(target int) ([]Migration, error) {
+	legacy, err := m.isLegacyDatabase()
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.DryRun {
+		if err := m.ensureTable(); err != nil {
+			return nil, err
+		}
+		if legacy {
+			if err := adoptLegacySchema(m.db); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var applied []Migration
+	for _, state := range states {
+		if state.Applied || (target > 0 && state.Version > target) {
+			continue
+		}
+
+		fmt.Fprintf(m.Log, "apply %d_%s\n", state.Version, state.Name)
+		if m.DryRun {
+			fmt.Fprintln(m.Log, strings.TrimSpace(state.Up))
+		} else {
+			err := m.inTx(func(tx *sql.Tx) error {
+				if _, err := tx.Exec(state.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+					state.Version, state.Name, state.Checksum(), time.Now().Unix())
+				return err
+			})
+			if err != nil {
+				return applied, fmt.Errorf("migration %d_%s: %w", state.Version, state.Name, err)
+			}
+		}
+		applied = append(applied, state.Migration)
+	}
+
+	return applied, nil
+}
+
+// Down rolls back the most recently applied migrations, steps of them, and
+// returns the migrations it rolled back.
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	states, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var rolledBack []Migration
+	for i := len(states) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		state := states[i]
+		if !state.Applied {
+			continue
+		}
+		if state.Down == "" {
+			return rolledBack, fmt.Errorf("migration %d_%s cannot be rolled back: it has no down script", state.Version, state.Name)
+		}
+
+		fmt.Fprintf(m.Log, "roll back %d_%s\n", state.Version, state.Name)
+		if m.DryRun {
+			fmt.Fprintln(m.Log, strings.TrimSpace(state.Down))
+		} else {
+			err := m.inTx(func(tx *sql.Tx) error {
+				if _, err := tx.Exec(state.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", state.Version)
+				return err
+			})
+			if err != nil {
+				return rolledBack, fmt.Errorf("migration %d_%s: %w", state.Version, state.Name, err)
+			}
+		}
+		rolledBack = append(rolledBack, state.Migration)
+	}
+
+	return rolledBack, nil
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) applied() (map[int]MigrationState, error) {
+	applied := make(map[int]MigrationState)
+
+	var exists bool
+	err := m.db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&exists)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := m.db.Query("SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state MigrationState
+		var appliedAt int64
+		if err := rows.Scan(&state.Version, &state.Name, &state.AppliedChecksum, &appliedAt); err != nil {
+			return nil, err
+		}
+		state.Applied = true
+		state.AppliedAt = time.Unix(appliedAt, 0)
+		applied[state.Version] = state
+	}
+
+	return applied, rows.Err()
+}
+
+func (m *Migrator) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isLegacyDatabase reports whether db was created by OpenDB before
+// migrations existed: it has a users table but no schema_migrations.
+func (m *Migrator) isLegacyDatabase() (bool, error) {
+	var tables int
+	err := m.db.QueryRow(`SELECT
+		(SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'users') -
+		(SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`).Scan(&tables)
+	if err != nil {
+		return false, err
+	}
+	return tables == 1, nil
+}
+
+// adoptLegacySchema adds the columns that the baseline migration expects but
+// that users.db files from before the email feature lack. Everything else in
+// the baseline uses IF NOT EXISTS.
+func adoptLegacySchema(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "users", "email", "TEXT"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "users", "email_verified_at", "INTEGER")
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func openEmptyTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users_test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists)
+	if err != nil {
+		t.Fatalf("Failed to check for table %s: %v", table, err)
+	}
+	return exists
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_second.up.sql":   {Data: []byte("CREATE TABLE b (id INTEGER);")},
+		"migrations/0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"migrations/0001_first.up.sql":    {Data: []byte("CREATE TABLE a (id INTEGER);")},
+	}
+
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].Name != "second" {
+		t.Fatalf("Expected migrations ordered by version, got %+v", migrations)
+	}
+	if migrations[0].Down != "" || migrations[1].Down != "DROP TABLE b;" {
+		t.Errorf("Unexpected down scripts: %+v", migrations)
+	}
+
+	fsys["migrations/0003_third.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE c;")}
+	if _, err := loadMigrations(fsys); err == nil {
+		t.Errorf("Expected a migration without an up script to be rejected")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	db := openEmptyTestDB(t)
+	defer db.Close()
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+
+	var log bytes.Buffer
+	migrator.Log = &log
+	migrator.DryRun = true
+	planned, err := migrator.Up(0)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(planned) == 0 || !strings.Contains(log.String(), "CREATE TABLE IF NOT EXISTS users") {
+		t.Errorf("Expected dry run to print the pending SQL, got %q", log.String())
+	}
+	if tableExists(t, db, "users") || tableExists(t, db, "schema_migrations") {
+		t.Fatalf("Expected dry run to leave the database untouched")
+	}
+
+	migrator.DryRun = false
+	applied, err := migrator.Up(0)
+	if err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if len(applied) != len(planned) {
+		t.Errorf("Expected %d migrations to be applied, got %d", len(planned), len(applied))
+	}
+
+	states, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	for _, state := range states {
+		if !state.Applied {
+			t.Errorf("Expected migration %d to be applied", state.Version)
+		}
+	}
+
+	if applied, err := migrator.Up(0); err != nil || len(applied) != 0 {
+		t.Errorf("Expected second Up to be a no-op, got %d applied, err %v", len(applied), err)
+	}
+
+	rolledBack, err := migrator.Down(len(states))
+	if err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if len(rolledBack) != len(states) || tableExists(t, db, "users") {
+		t.Errorf("Expected all migrations to be rolled back")
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate failed after rollback: %v", err)
+	}
+
+	if _, err := db.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1"); err != nil {
+		t.Fatalf("Failed to tamper with checksum: %v", err)
+	}
+	if err := Migrate(db); !errors.Is(err, ErrMigrationChecksum) {
+		t.Errorf("Expected ErrMigrationChecksum, got %v", err)
+	}
+
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (9999, 'future', '', 0)"); err != nil {
+		t.Fatalf("Failed to insert unknown migration: %v", err)
+	}
+	if _, err := migrator.Status(); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("Expected ErrUnknownMigration, got %v", err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db := openEmptyTestDB(t)
+	defer db.Close()
+
+	// The schema OpenDB created before users had email addresses.
+	_, err := db.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL
+		);
+		INSERT INTO users (username, password_hash) VALUES ('olduser', 'salt$hash');`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate failed on legacy database: %v", err)
+	}
+
+	user, err := GetUserByUsername(context.Background(), db, "olduser")
+	if err != nil {
+		t.Fatalf("GetUserByUsername failed: %v", err)
+	}
+	if err := SetUserEmail(context.Background(), db, user.ID, "olduser@example.com"); err != nil {
+		t.Errorf("Expected the email column to be added, got %v", err)
+	}
+	if !tableExists(t, db, "sessions") {
+		t.Errorf("Expected missing tables to be created")
+	}
+}
+
+func TestUserAdminMigration(t *testing.T) {
+	db := openEmptyTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	if _, err := migrator.Up(7); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	var ids []int64
+	for _, username := range []string{"roleadmin", "plainuser"} {
+		result, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, '!')", username)
+		if err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		ids = append(ids, id)
+	}
+	if err := AssignRole(ctx, db, int(ids[0]), RoleAdmin); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+
+	if _, err := migrator.Up(0); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	for i, want := range []bool{true, false} {
+		user, err := ReadUser(ctx, db, int(ids[i]))
+		if err != nil {
+			t.Fatalf("ReadUser failed: %v", err)
+		}
+		if user.Admin != want {
+			t.Errorf("Expected %s to have admin %v after the migration, got %v", user.Username, want, user.Admin)
+		}
+	}
+}
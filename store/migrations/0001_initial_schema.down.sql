@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS email_verification_tokens;
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP TABLE IF EXISTS account_lockouts;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS webauthn_credentials;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP INDEX IF EXISTS sessions_expires_at;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS invites;
+DROP INDEX IF EXISTS users_email;
+DROP TABLE IF EXISTS users;
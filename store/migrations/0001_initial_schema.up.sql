@@ -0,0 +1,82 @@
+-- Baseline: the schema OpenDB used to create with CREATE TABLE IF NOT EXISTS.
+-- The IF NOT EXISTS clauses let databases from before migrations adopt it.
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	email TEXT,
+	email_verified_at INTEGER
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS invites (
+	code TEXT PRIMARY KEY,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	data BLOB NOT NULL,
+	created_at INTEGER NOT NULL,
+	last_seen_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS user_totp (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	confirmed INTEGER NOT NULL DEFAULT 0,
+	last_used_step INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	credential_id BLOB NOT NULL UNIQUE,
+	public_key BLOB NOT NULL,
+	sign_count INTEGER NOT NULL DEFAULT 0,
+	name TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS account_lockouts (
+	username TEXT PRIMARY KEY,
+	locked_at INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS user_roles_role_id;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,35 @@
+CREATE TABLE roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE permissions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+	PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE user_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX user_roles_role_id ON user_roles (role_id);
+
+-- The admin role holds every permission the application defines.
+INSERT INTO roles (name, description) VALUES ('admin', 'Full access to the admin pages');
+
+INSERT INTO permissions (name, description) VALUES
+	('admin:access', 'Open the admin pages'),
+	('users:manage', 'Create, edit and delete user accounts');
+
+INSERT INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions WHERE roles.name = 'admin';
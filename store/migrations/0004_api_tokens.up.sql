@@ -0,0 +1,15 @@
+-- Personal access tokens. Only a SHA-256 hash of each token is kept; scopes
+-- is a space-separated list. Times are Unix seconds, expires_at NULL means
+-- the token never expires.
+CREATE TABLE api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER,
+	last_used_at INTEGER
+);
+
+CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS oauth_consents;
+DROP INDEX IF EXISTS oauth_tokens_grant_id;
+DROP TABLE IF EXISTS oauth_tokens;
+DROP TABLE IF EXISTS oauth_authorization_codes;
+DROP TABLE IF EXISTS oauth_clients;
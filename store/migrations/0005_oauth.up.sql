@@ -0,0 +1,47 @@
+-- OAuth 2.0 authorization server. Secrets, codes and tokens are stored as
+-- SHA-256 hashes; redirect_uris and scopes are space-separated lists. Times
+-- are Unix seconds.
+CREATE TABLE oauth_clients (
+	id TEXT PRIMARY KEY,
+	secret_hash TEXT,
+	name TEXT NOT NULL,
+	redirect_uris TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+-- grant_id ties an authorization code to every token issued from it, so a
+-- replayed code or refresh token can revoke the whole family.
+CREATE TABLE oauth_authorization_codes (
+	code_hash TEXT PRIMARY KEY,
+	grant_id TEXT NOT NULL,
+	client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	redirect_uri TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	code_challenge TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER
+);
+
+CREATE TABLE oauth_tokens (
+	token_hash TEXT PRIMARY KEY,
+	kind TEXT NOT NULL CHECK (kind IN ('access', 'refresh')),
+	grant_id TEXT NOT NULL,
+	client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	scope TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	revoked_at INTEGER
+);
+
+CREATE INDEX oauth_tokens_grant_id ON oauth_tokens (grant_id);
+
+CREATE TABLE oauth_consents (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+	scope TEXT NOT NULL,
+	granted_at INTEGER NOT NULL,
+	PRIMARY KEY (user_id, client_id)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE oauth_clients DROP COLUMN post_logout_redirect_uris;
+ALTER TABLE oauth_authorization_codes DROP COLUMN auth_time;
+ALTER TABLE oauth_authorization_codes DROP COLUMN nonce;
+DROP TABLE oidc_signing_keys;
@@ -0,0 +1,15 @@
+-- OpenID Connect. ID tokens are signed with the keys below; private_key is
+-- the PKCS #8 key, encrypted with a key derived from the session secret.
+CREATE TABLE oidc_signing_keys (
+	kid TEXT PRIMARY KEY,
+	alg TEXT NOT NULL,
+	private_key TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+-- The nonce and the time the user signed in are copied into every ID token
+-- issued for the grant the code starts.
+ALTER TABLE oauth_authorization_codes ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_authorization_codes ADD COLUMN auth_time INTEGER;
+
+ALTER TABLE oauth_clients ADD COLUMN post_logout_redirect_uris TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+-- Accounts at external OpenID Connect providers that users log in with. A
+-- user can link one identity per provider; subject is the provider's sub
+-- claim, which is only unique per provider.
+CREATE TABLE external_identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	email TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	last_login_at INTEGER,
+	PRIMARY KEY (provider, subject),
+	UNIQUE (user_id, provider)
+);
@@ -0,0 +1,7 @@
+-- Users who may open the admin console. Whoever held the admin role before
+-- keeps that access.
+ALTER TABLE users ADD COLUMN admin INTEGER NOT NULL DEFAULT 0;
+
+UPDATE users SET admin = 1 WHERE id IN (
+	SELECT user_roles.user_id FROM user_roles JOIN roles ON roles.id = user_roles.role_id WHERE roles.name = 'admin'
+);
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The role and permissions seeded by the 0002_rbac migration.
+const (
+	RoleAdmin             = "admin"
+	PermissionAdminAccess = "admin:access"
+	PermissionManageUsers = "users:manage"
+)
+
+// GrantCacheTTL bounds how long a change to roles made by another process
+// can take to reach this one.
+const GrantCacheTTL = time.Minute
+
+var (
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrPermissionNotFound = errors.New("permission not found")
+)
+
+// Grants are the roles assigned to a user and the permissions those roles
+// carry.
+type Grants struct {
+	Roles       map[string]bool
+	Permissions map[string]bool
+}
+
+func (g *Grants) HasRole(role string) bool {
+	return g.Roles[role]
+}
+
+func (g *Grants) HasPermission(permission string) bool {
+	return g.Permissions[permission]
+}
+
+func CreateRole(ctx context.Context, db *sql.DB, name, description string) (int64, error) {
+	result, err := db.ExecContext(ctx, "INSERT INTO roles (name, description) VALUES (?, ?)", name, description)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func DeleteRole(ctx context.Context, db *sql.DB, name string) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM roles WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func CreatePermission(ctx context.Context, db *sql.DB, name, description string) (int64, error) {
+	result, err := db.ExecContext(ctx, "INSERT INTO permissions (name, description) VALUES (?, ?)", name, description)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func GrantPermission(ctx context.Context, db *sql.DB, role, permission string) error {
+	roleID, err := lookupID(ctx, db, "SELECT id FROM roles WHERE name = ?", role, ErrRoleNotFound)
+	if err != nil {
+		return err
+	}
+	permissionID, err := lookupID(ctx, db, "SELECT id FROM permissions WHERE name = ?", permission, ErrPermissionNotFound)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT OR IGNORE INTO role_permissions (role_id, permission_id) VALUES (?, ?)", roleID, permissionID)
+	return err
+}
+
+func RevokePermission(ctx context.Context, db *sql.DB, role, permission string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM role_permissions
+		WHERE role_id = (SELECT id FROM roles WHERE name = ?)
+		AND permission_id = (SELECT id FROM permissions WHERE name = ?)`, role, permission)
+	return err
+}
+
+func AssignRole(ctx context.Context, db *sql.DB, userID int, role string) error {
+	roleID, err := lookupID(ctx, db, "SELECT id FROM roles WHERE name = ?", role, ErrRoleNotFound)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT OR IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)", userID, roleID)
+	return err
+}
+
+func UnassignRole(ctx context.Context, db *sql.DB, userID int, role string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id = ? AND role_id = (SELECT id FROM roles WHERE name = ?)", userID, role)
+	return err
+}
+
+// LoadGrants reads the user's roles and permissions from the database,
+// bypassing the cache.
+func LoadGrants(ctx context.Context, db *sql.DB, userID int) (*Grants, error) {
+	grants := &Grants{Roles: make(map[string]bool), Permissions: make(map[string]bool)}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT roles.name, COALESCE(permissions.name, '') FROM user_roles
+		JOIN roles ON roles.id = user_roles.role_id
+		LEFT JOIN role_permissions ON role_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = role_permissions.permission_id
+		WHERE user_roles.user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role, permission string
+		if err := rows.Scan(&role, &permission); err != nil {
+			return nil, err
+		}
+		grants.Roles[role] = true
+		if permission != "" {
+			grants.Permissions[permission] = true
+		}
+	}
+
+	return grants, rows.Err()
+}
+
+// UsersWithRole returns the IDs of every user assigned role.
+func UsersWithRole(ctx context.Context, db *sql.DB, role string) (map[int]bool, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_roles.user_id FROM user_roles
+		JOIN roles ON roles.id = user_roles.role_id
+		WHERE roles.name = ?`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users[userID] = true
+	}
+
+	return users, rows.Err()
+}
+
+func lookupID(ctx context.Context, db *sql.DB, query, name string, notFound error) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, query, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, notFound
+	}
+	return id, err
+}
+
+// GrantCache keeps each user's grants for ttl so authorization checks do not
+// hit the database on every request. The functions in this package leave
+// invalidation to the caller; auth.Service's role methods take care of it.
+type GrantCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int]grantCacheEntry
+}
+
+type grantCacheEntry struct {
+	grants    *Grants
+	expiresAt time.Time
+}
+
+func NewGrantCache(ttl time.Duration) *GrantCache {
+	return &GrantCache{ttl: ttl, entries: make(map[int]grantCacheEntry)}
+}
+
+func (c *GrantCache) Get(ctx context.Context, db *sql.DB, userID int) (*Grants, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.grants, nil
+	}
+
+	grants, err := LoadGrants(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[userID] = grantCacheEntry{grants: grants, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return grants, nil
+}
+
+func (c *GrantCache) Invalidate(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
+
+func (c *GrantCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]grantCacheEntry)
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRoleAssignment(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	userID, err := CreateUserIfNotExists(ctx, db, testHasher, "roleuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	grants, err := LoadGrants(ctx, db, int(userID))
+	if err != nil {
+		t.Fatalf("LoadGrants failed: %v", err)
+	}
+	if len(grants.Roles) != 0 || len(grants.Permissions) != 0 {
+		t.Errorf("Expected a new user to have no grants, got %+v", grants)
+	}
+
+	if err := AssignRole(ctx, db, int(userID), "nosuchrole"); err != ErrRoleNotFound {
+		t.Errorf("Expected ErrRoleNotFound, got %v", err)
+	}
+	if err := AssignRole(ctx, db, int(userID), RoleAdmin); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+
+	grants, err = LoadGrants(ctx, db, int(userID))
+	if err != nil {
+		t.Fatalf("LoadGrants failed: %v", err)
+	}
+	if !grants.HasRole(RoleAdmin) || !grants.HasPermission(PermissionAdminAccess) || !grants.HasPermission(PermissionManageUsers) {
+		t.Errorf("Expected the seeded admin role and its permissions, got %+v", grants)
+	}
+
+	if _, err := CreateRole(ctx, db, "support", "Helpdesk staff"); err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	if _, err := CreatePermission(ctx, db, "tickets:read", "Read support tickets"); err != nil {
+		t.Fatalf("CreatePermission failed: %v", err)
+	}
+	if err := GrantPermission(ctx, db, "support", "tickets:write"); err != ErrPermissionNotFound {
+		t.Errorf("Expected ErrPermissionNotFound, got %v", err)
+	}
+	if err := GrantPermission(ctx, db, "support", "tickets:read"); err != nil {
+		t.Fatalf("GrantPermission failed: %v", err)
+	}
+	if err := UnassignRole(ctx, db, int(userID), RoleAdmin); err != nil {
+		t.Fatalf("UnassignRole failed: %v", err)
+	}
+	if err := AssignRole(ctx, db, int(userID), "support"); err != nil {
+		t.Fatalf("AssignRole failed: %v", err)
+	}
+
+	grants, err = LoadGrants(ctx, db, int(userID))
+	if err != nil {
+		t.Fatalf("LoadGrants failed: %v", err)
+	}
+	if grants.HasRole(RoleAdmin) || grants.HasPermission(PermissionAdminAccess) || !grants.HasPermission("tickets:read") {
+		t.Errorf("Expected only the support grants, got %+v", grants)
+	}
+
+	if err := DeleteRole(ctx, db, "support"); err != nil {
+		t.Fatalf("DeleteRole failed: %v", err)
+	}
+	grants, err = LoadGrants(ctx, db, int(userID))
+	if err != nil || len(grants.Roles) != 0 {
+		t.Errorf("Expected deleting the role to remove the assignment, got %+v (%v)", grants, err)
+	}
+}
+
+func TestGrantCache(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	userID, err := CreateUserIfNotExists(ctx, db, testHasher, "cacheuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUserIfNotExists failed: %v", err)
+	}
+
+	cache := NewGrantCache(time.Hour)
+	grants, err := cache.Get(ctx, db, int(userID))
+	if err != nil || grants.HasRole(RoleAdmin) {
+		t.Fatalf("Expected no admin role, got %+v (%v)", grants, err)
+	}
+
+	// Bypass AssignRole so only the cache's own invalidation is exercised.
+	_, err = db.Exec("INSERT INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?", userID, RoleAdmin)
+	if err != nil {
+		t.Fatalf("Failed to assign role: %v", err)
+	}
+
+	grants, _ = cache.Get(ctx, db, int(userID))
+	if grants.HasRole(RoleAdmin) {
+		t.Errorf("Expected cached grants until invalidated")
+	}
+
+	cache.Invalidate(int(userID))
+	grants, _ = cache.Get(ctx, db, int(userID))
+	if !grants.HasRole(RoleAdmin) {
+		t.Errorf("Expected fresh grants after invalidation")
+	}
+}
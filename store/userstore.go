@@ -0,0 +1,660 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UserStore is the storage backend for user accounts. Lookups of users that
+// do not exist return sql.ErrNoRows, whichever backend is used. A username or
+// email that is already taken is reported as ErrUserExists or ErrEmailExists
+// by the write itself, not by a lookup beforehand, so concurrent requests
+// cannot both claim one. Passwords are validated and hashed with the
+// PasswordHasher the store was created with; the methods otherwise behave
+// like the package functions of the same name.
+type UserStore interface {
+	UserExists(ctx context.Context, username string) (bool, error)
+	CreateUser(ctx context.Context, username, password string) (int64, error)
+	CreateUserWithoutPassword(ctx context.Context, username string) (int64, error)
+	ImportUsers(ctx context.Context, users []ImportedUser) (int, error)
+	ReadUser(ctx context.Context, id int) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	ListUsers(ctx context.Context, search string, offset, limit int) ([]User, int, error)
+	UpdateUser(ctx context.Context, id int, username, password string) error
+	SetUserEmail(ctx context.Context, id int, email string) error
+	MarkEmailVerified(ctx context.Context, id int, email string, at time.Time) (bool, error)
+	SetUserDisabled(ctx context.Context, id int, disabled bool) error
+	SetUserAdmin(ctx context.Context, id int, admin bool) error
+	DeleteUser(ctx context.Context, id int) error
+}
+
+// SQLiteUserStore is the UserStore for the users.db schema created by the
+// embedded migrations.
+type SQLiteUserStore struct {
+	db     *sql.DB
+	hasher *PasswordHasher
+}
+
+func NewSQLiteUserStore(db *sql.DB, hasher *PasswordHasher) *SQLiteUserStore {
+	return &SQLiteUserStore{db: db, hasher: hasher}
+}
+
+func (s *SQLiteUserStore) UserExists(ctx context.Context, username string) (bool, error) {
+	return UserExists(ctx, s.db, username)
+}
+
+func (s *SQLiteUserStore) CreateUser(ctx context.Context, username, password string) (int64, error) {
+	return CreateUser(ctx, s.db, s.hasher, username, password)
+}
+
+func (s *SQLiteUserStore) CreateUserWithoutPassword(ctx context.Context, username string) (int64, error) {
+	return CreateUserWithoutPassword(ctx, s.db, username)
+}
+
+func (s *SQLiteUserStore) ImportUsers(ctx context.Context, users []ImportedUser) (int, error) {
+	return ImportUsers(ctx, s.db, users)
+}
+
+func (s *SQLiteUserStore) ReadUser(ctx context.Context, id int) (*User, error) {
+	return ReadUser(ctx, s.db, id)
+}
+
+func (s *SQLiteUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	return GetUserByUsername(ctx, s.db, username)
+}
+
+func (s *SQLiteUserStore) ListUsers(ctx context.Context, search string, offset, limit int) ([]User, int, error) {
+	return ListUsers(ctx, s.db, search, offset, limit)
+}
+
+func (s *SQLiteUserStore) UpdateUser(ctx context.Context, id int, username, password string) error {
+	return UpdateUser(ctx, s.db, s.hasher, id, username, password)
+}
+
+func (s *SQLiteUserStore) SetUserEmail(ctx context.Context, id int, email string) error {
+	return SetUserEmail(ctx, s.db, id, email)
+}
+
+func (s *SQLiteUserStore) MarkEmailVerified(ctx context.Context, id int, email string, at time.Time) (bool, error) {
+	return MarkEmailVerified(ctx, s.db, id, email, at)
+}
+
+func (s *SQLiteUserStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	return SetUserDisabled(ctx, s.db, id, disabled)
+}
+
+func (s *SQLiteUserStore) SetUserAdmin(ctx context.Context, id int, admin bool) error {
+	return SetUserAdmin(ctx, s.db, id, admin)
+}
+
+func (s *SQLiteUserStore) DeleteUser(ctx context.Context, id int) error {
+	return DeleteUser(ctx, s.db, id)
+}
+
+// postgresUsersSchema mirrors the users table of the SQLite schema. Columns
+// added since the table was first created are added to existing tables too.
+const postgresUsersSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	email TEXT UNIQUE,
+	email_verified_at TIMESTAMPTZ,
+	disabled_at TIMESTAMPTZ,
+	admin BOOLEAN NOT NULL DEFAULT FALSE
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS admin BOOLEAN NOT NULL DEFAULT FALSE`
+
+// postgresUniqueViolation is the SQLSTATE PostgreSQL reports when an insert
+// or update collides with a unique constraint.
+const postgresUniqueViolation = "23505"
+
+// PostgresUserStore is a UserStore backed by PostgreSQL, for deployments
+// that share one user database between several hosts.
+type PostgresUserStore struct {
+	db     *sql.DB
+	hasher *PasswordHasher
+}
+
+// OpenPostgresUserStore connects to the PostgreSQL server described by dsn
+// and creates the users table if it does not exist yet.
+func OpenPostgresUserStore(ctx context.Context, dsn string, hasher *PasswordHasher) (*PostgresUserStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewPostgresUserStore(db, hasher)
+	if err := store.CreateSchema(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func NewPostgresUserStore(db *sql.DB, hasher *PasswordHasher) *PostgresUserStore {
+	return &PostgresUserStore{db: db, hasher: hasher}
+}
+
+func (s *PostgresUserStore) CreateSchema(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, postgresUsersSchema)
+	return err
+}
+
+func (s *PostgresUserStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresUserStore) UserExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (s *PostgresUserStore) CreateUser(ctx context.Context, username, password string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	if err := s.hasher.ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := s.hasher.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = s.db.QueryRowContext(ctx, "INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id", username, hashedPassword).Scan(&id)
+	if isPostgresUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *PostgresUserStore) CreateUserWithoutPassword(ctx context.Context, username string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err := s.db.QueryRowContext(ctx, "INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id", username, NoPasswordHash).Scan(&id)
+	if isPostgresUniqueViolation(err) {
+		return 0, ErrUserExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *PostgresUserStore) ImportUsers(ctx context.Context, users []ImportedUser) (int, error) {
+	for _, user := range users {
+		if err := ValidateUsername(user.Username); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+		if err := validatePasswordHash(user.PasswordHash); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, user := range users {
+		_, err := tx.ExecContext(ctx, "INSERT INTO users (username, password_hash) VALUES ($1, $2)", user.Username, user.PasswordHash)
+		if isPostgresUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", user.Username, ErrUserExists)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(users), nil
+}
+
+func (s *PostgresUserStore) ReadUser(ctx context.Context, id int) (*User, error) {
+	return s.scanUser(s.db.QueryRowContext(ctx, "SELECT "+postgresUserColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s *PostgresUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	return s.scanUser(s.db.QueryRowContext(ctx, "SELECT "+postgresUserColumns+" FROM users WHERE username = $1", username))
+}
+
+// ListUsers matches search case-insensitively, like LIKE does in SQLite.
+func (s *PostgresUserStore) ListUsers(ctx context.Context, search string, offset, limit int) ([]User, int, error) {
+	pattern := "%" + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(search) + "%"
+	where := "WHERE username ILIKE $1 OR COALESCE(email, '') ILIKE $1"
+
+	var total int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(1) FROM users "+where, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+postgresUserColumns+" FROM users "+where+" ORDER BY username LIMIT $2 OFFSET $3", pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := s.scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, total, rows.Err()
+}
+
+func (s *PostgresUserStore) UpdateUser(ctx context.Context, id int, username, password string) error {
+	if username == "" && password == "" {
+		return errors.New("at least one of username or password must be provided")
+	}
+
+	updateFields := make([]string, 0)
+	updateArgs := make([]interface{}, 0)
+
+	if username != "" {
+		if err := ValidateUsername(username); err != nil {
+			return err
+		}
+		updateArgs = append(updateArgs, username)
+		updateFields = append(updateFields, fmt.Sprintf("username = $%d", len(updateArgs)))
+	}
+
+	if password != "" {
+		hashedPassword, err := s.hasher.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		updateArgs = append(updateArgs, hashedPassword)
+		updateFields = append(updateFields, fmt.Sprintf("password_hash = $%d", len(updateArgs)))
+	}
+
+	updateArgs = append(updateArgs, id)
+
+	query := fmt.Sprintf("UPDATE users SET %s WHERE id = $%d", strings.Join(updateFields, ", "), len(updateArgs))
+
+	_, err := s.db.ExecContext(ctx, query, updateArgs...)
+	if isPostgresUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (s *PostgresUserStore) SetUserEmail(ctx context.Context, id int, email string) error {
+	email = NormalizeEmail(email)
+	if email == "" {
+		_, err := s.db.ExecContext(ctx, "UPDATE users SET email = NULL, email_verified_at = NULL WHERE id = $1", id)
+		return err
+	}
+
+	if err := ValidateEmail(email); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET email = $1,
+		email_verified_at = CASE WHEN email IS NOT DISTINCT FROM $1 THEN email_verified_at ELSE NULL END
+		WHERE id = $2`, email, id)
+	if isPostgresUniqueViolation(err) {
+		return ErrEmailExists
+	}
+	return err
+}
+
+func (s *PostgresUserStore) MarkEmailVerified(ctx context.Context, id int, email string, at time.Time) (bool, error) {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET email_verified_at = $1 WHERE id = $2 AND email = $3", at, id, NormalizeEmail(email))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (s *PostgresUserStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET disabled_at = $1 WHERE id = $2", disabledAt, id)
+	return err
+}
+
+func (s *PostgresUserStore) SetUserAdmin(ctx context.Context, id int, admin bool) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET admin = $1 WHERE id = $2", admin, id)
+	return err
+}
+
+func (s *PostgresUserStore) DeleteUser(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+	return err
+}
+
+// postgresUserColumns are the columns scanUser reads, in order.
+const postgresUserColumns = "id, username, password_hash, COALESCE(email, ''), email_verified_at IS NOT NULL, disabled_at IS NOT NULL, admin"
+
+func (s *PostgresUserStore) scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	user := &User{}
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.EmailVerified, &user.Disabled, &user.Admin)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func isPostgresUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation
+}
+
+// MemoryUserStore keeps users in memory. It is meant for unit tests that do
+// not need the rest of the schema.
+type MemoryUserStore struct {
+	mu     sync.Mutex
+	hasher *PasswordHasher
+	users  map[int]User
+	nextID int
+}
+
+func NewMemoryUserStore(hasher *PasswordHasher) *MemoryUserStore {
+	return &MemoryUserStore{hasher: hasher, users: make(map[int]User), nextID: 1}
+}
+
+func (s *MemoryUserStore) UserExists(ctx context.Context, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.findByUsername(username)
+	return ok, nil
+}
+
+func (s *MemoryUserStore) CreateUser(ctx context.Context, username, password string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	if err := s.hasher.ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := s.hasher.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.findByUsername(username); ok {
+		return 0, ErrUserExists
+	}
+
+	id := s.nextID
+	s.nextID++
+	s.users[id] = User{ID: id, Username: username, PasswordHash: hashedPassword}
+
+	return int64(id), nil
+}
+
+func (s *MemoryUserStore) CreateUserWithoutPassword(ctx context.Context, username string) (int64, error) {
+	if err := ValidateUsername(username); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.findByUsername(username); ok {
+		return 0, ErrUserExists
+	}
+
+	id := s.nextID
+	s.nextID++
+	s.users[id] = User{ID: id, Username: username, PasswordHash: NoPasswordHash}
+
+	return int64(id), nil
+}
+
+func (s *MemoryUserStore) ImportUsers(ctx context.Context, users []ImportedUser) (int, error) {
+	for _, user := range users {
+		if err := ValidateUsername(user.Username); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+		if err := validatePasswordHash(user.PasswordHash); err != nil {
+			return 0, fmt.Errorf("%s: %w", user.Username, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool, len(users))
+	for _, user := range users {
+		if _, ok := s.findByUsername(user.Username); ok || seen[user.Username] {
+			return 0, fmt.Errorf("%s: %w", user.Username, ErrUserExists)
+		}
+		seen[user.Username] = true
+	}
+
+	for _, user := range users {
+		id := s.nextID
+		s.nextID++
+		s.users[id] = User{ID: id, Username: user.Username, PasswordHash: user.PasswordHash}
+	}
+
+	return len(users), nil
+}
+
+func (s *MemoryUserStore) ReadUser(ctx context.Context, id int) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &user, nil
+}
+
+func (s *MemoryUserStore) UpdateUser(ctx context.Context, id int, username, password string) error {
+	if username == "" && password == "" {
+		return errors.New("at least one of username or password must be provided")
+	}
+
+	if username != "" {
+		if err := ValidateUsername(username); err != nil {
+			return err
+		}
+	}
+
+	var hashedPassword string
+	if password != "" {
+		var err error
+		hashedPassword, err = s.hasher.HashPassword(password)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Like an UPDATE matching no rows, a missing user is not an error.
+	user, ok := s.users[id]
+	if !ok {
+		return nil
+	}
+
+	if username != "" {
+		if other, ok := s.findByUsername(username); ok && other.ID != id {
+			return ErrUserExists
+		}
+		user.Username = username
+	}
+	if hashedPassword != "" {
+		user.PasswordHash = hashedPassword
+	}
+	s.users[id] = user
+
+	return nil
+}
+
+func (s *MemoryUserStore) SetUserEmail(ctx context.Context, id int, email string) error {
+	email = NormalizeEmail(email)
+	if email != "" {
+		if err := ValidateEmail(email); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil
+	}
+
+	if email != "" {
+		for _, other := range s.users {
+			if other.Email == email && other.ID != id {
+				return ErrEmailExists
+			}
+		}
+	}
+
+	if user.Email != email {
+		user.EmailVerified = false
+	}
+	user.Email = email
+	s.users[id] = user
+
+	return nil
+}
+
+func (s *MemoryUserStore) MarkEmailVerified(ctx context.Context, id int, email string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || user.Email == "" || user.Email != NormalizeEmail(email) {
+		return false, nil
+	}
+
+	user.EmailVerified = true
+	s.users[id] = user
+
+	return true, nil
+}
+
+func (s *MemoryUserStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		user.Disabled = disabled
+		s.users[id] = user
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) SetUserAdmin(ctx context.Context, id int, admin bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		user.Admin = admin
+		s.users[id] = user
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) DeleteUser(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.findByUsername(username)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &user, nil
+}
+
+func (s *MemoryUserStore) ListUsers(ctx context.Context, search string, offset, limit int) ([]User, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	search = strings.ToLower(search)
+	var matches []User
+	for _, user := range s.users {
+		if strings.Contains(strings.ToLower(user.Username), search) || strings.Contains(strings.ToLower(user.Email), search) {
+			matches = append(matches, user)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Username < matches[j].Username })
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	matches = matches[offset:]
+	if limit >= 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	if len(matches) == 0 {
+		return nil, total, nil
+	}
+
+	return matches, total, nil
+}
+
+func (s *MemoryUserStore) findByUsername(username string) (User, bool) {
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, true
+		}
+	}
+	return User{}, false
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testUserStore runs the same checks against every UserStore implementation
+// so the backends cannot drift apart.
+func testUserStore(t *testing.T, store UserStore) {
+	ctx := context.Background()
+
+	id, err := store.CreateUser(ctx, "storeuser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	if _, err := store.CreateUser(ctx, "storeuser", "ValidP@ssw0rd"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists for a duplicate username, got %v", err)
+	}
+	if _, err := store.CreateUser(ctx, "weakuser", "weak"); err == nil {
+		t.Errorf("Expected a weak password to be rejected")
+	}
+
+	nopassID, err := store.CreateUserWithoutPassword(ctx, "nopassuser")
+	if err != nil {
+		t.Fatalf("CreateUserWithoutPassword failed: %v", err)
+	}
+	if _, err := store.CreateUserWithoutPassword(ctx, "storeuser"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists for a duplicate username, got %v", err)
+	}
+	nopass, err := store.ReadUser(ctx, int(nopassID))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+	if nopass.PasswordHash != NoPasswordHash || CheckPasswordHash("", nopass.PasswordHash) || CheckPasswordHash(NoPasswordHash, nopass.PasswordHash) {
+		t.Errorf("Expected a user without a usable password, got %+v", nopass)
+	}
+	if err := store.DeleteUser(ctx, int(nopassID)); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+
+	exists, err := store.UserExists(ctx, "storeuser")
+	if err != nil || !exists {
+		t.Errorf("Expected storeuser to exist, got %v (%v)", exists, err)
+	}
+
+	user, err := store.ReadUser(ctx, int(id))
+	if err != nil {
+		t.Fatalf("ReadUser failed: %v", err)
+	}
+	if user.Username != "storeuser" || !CheckPasswordHash("ValidP@ssw0rd", user.PasswordHash) {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+
+	if err := store.UpdateUser(ctx, int(id), "renamed", "N3wP@ssw0rd!"); err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	if err := store.UpdateUser(ctx, int(id), "", ""); err == nil {
+		t.Errorf("Expected an empty update to be rejected")
+	}
+
+	user, err = store.GetUserByUsername(ctx, "renamed")
+	if err != nil {
+		t.Fatalf("GetUserByUsername failed: %v", err)
+	}
+	if user.ID != int(id) || !CheckPasswordHash("N3wP@ssw0rd!", user.PasswordHash) {
+		t.Errorf("Expected update to be applied, got %+v", user)
+	}
+	if _, err := store.GetUserByUsername(ctx, "storeuser"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for the old username, got %v", err)
+	}
+
+	otherID, err := store.CreateUser(ctx, "otheruser", "ValidP@ssw0rd")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := store.UpdateUser(ctx, int(otherID), "renamed", ""); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists when renaming to a taken username, got %v", err)
+	}
+
+	if err := store.SetUserEmail(ctx, int(id), " Renamed@Example.com "); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	if err := store.SetUserEmail(ctx, int(otherID), "renamed@example.com"); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("Expected ErrEmailExists for a taken email, got %v", err)
+	}
+	if verified, err := store.MarkEmailVerified(ctx, int(id), "stale@example.com", time.Now()); err != nil || verified {
+		t.Errorf("Expected a stale address not to be verified, got %v (%v)", verified, err)
+	}
+	if verified, err := store.MarkEmailVerified(ctx, int(id), "renamed@example.com", time.Now()); err != nil || !verified {
+		t.Errorf("Expected the current address to be verified, got %v (%v)", verified, err)
+	}
+	user, _ = store.ReadUser(ctx, int(id))
+	if user.Email != "renamed@example.com" || !user.EmailVerified {
+		t.Errorf("Expected a verified email, got %+v", user)
+	}
+	if err := store.SetUserEmail(ctx, int(id), "changed@example.com"); err != nil {
+		t.Fatalf("SetUserEmail failed: %v", err)
+	}
+	user, _ = store.ReadUser(ctx, int(id))
+	if user.EmailVerified {
+		t.Errorf("Expected a changed email to be unverified, got %+v", user)
+	}
+
+	if err := store.SetUserDisabled(ctx, int(otherID), true); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if other, _ := store.ReadUser(ctx, int(otherID)); !other.Disabled {
+		t.Errorf("Expected otheruser to be disabled, got %+v", other)
+	}
+	if err := store.SetUserDisabled(ctx, int(otherID), false); err != nil {
+		t.Fatalf("SetUserDisabled failed: %v", err)
+	}
+	if other, _ := store.ReadUser(ctx, int(otherID)); other.Disabled {
+		t.Errorf("Expected otheruser to be enabled again, got %+v", other)
+	}
+
+	if err := store.SetUserAdmin(ctx, int(otherID), true); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+	if other, _ := store.GetUserByUsername(ctx, "otheruser"); !other.Admin {
+		t.Errorf("Expected otheruser to be an admin, got %+v", other)
+	}
+	if err := store.SetUserAdmin(ctx, int(otherID), false); err != nil {
+		t.Fatalf("SetUserAdmin failed: %v", err)
+	}
+	if other, _ := store.ReadUser(ctx, int(otherID)); other.Admin {
+		t.Errorf("Expected otheruser to be an admin no longer, got %+v", other)
+	}
+
+	users, total, err := store.ListUsers(ctx, "", 0, 1)
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if total != 2 || len(users) != 1 || users[0].Username != "otheruser" {
+		t.Errorf("Expected the first of 2 users, got %d %+v", total, users)
+	}
+	users, total, err = store.ListUsers(ctx, "CHANGED", 0, 10)
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if total != 1 || len(users) != 1 || users[0].ID != int(id) {
+		t.Errorf("Expected a search by email to find renamed, got %d %+v", total, users)
+	}
+
+	hash, err := testHasher.HashPassword("Imp0rted-P@ss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ImportUsers(ctx, []ImportedUser{{Username: "imported", PasswordHash: hash}, {Username: "otheruser", PasswordHash: hash}}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists for an import with a taken username, got %v", err)
+	}
+	if exists, _ := store.UserExists(ctx, "imported"); exists {
+		t.Errorf("Expected a failed import to add nobody")
+	}
+	if n, err := store.ImportUsers(ctx, []ImportedUser{{Username: "imported", PasswordHash: hash}}); err != nil || n != 1 {
+		t.Errorf("Expected 1 imported user, got %d (%v)", n, err)
+	}
+	imported, err := store.GetUserByUsername(ctx, "imported")
+	if err != nil || !CheckPasswordHash("Imp0rted-P@ss", imported.PasswordHash) {
+		t.Errorf("Expected the imported hash to be kept, got %+v (%v)", imported, err)
+	}
+
+	if err := store.DeleteUser(ctx, int(id)); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if _, err := store.ReadUser(ctx, int(id)); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows after delete, got %v", err)
+	}
+	exists, err = store.UserExists(ctx, "renamed")
+	if err != nil || exists {
+		t.Errorf("Expected deleted user to be gone, got %v (%v)", exists, err)
+	}
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	testUserStore(t, NewMemoryUserStore(testHasher))
+}
+
+func TestSQLiteUserStore(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	testUserStore(t, NewSQLiteUserStore(db, testHasher))
+}
+
+func TestPostgresUserStore(t *testing.T) {
+	dsn := startTestPostgres(t)
+
+	store, err := OpenPostgresUserStore(context.Background(), dsn, testHasher)
+	if err != nil {
+		t.Fatalf("OpenPostgresUserStore failed: %v", err)
+	}
+	defer store.Close()
+
+	testUserStore(t, store)
+}
+
+// startTestPostgres initialises a throwaway cluster with the initdb and
+// postgres binaries on PATH and returns a DSN for it. The server only listens
+// on a Unix socket inside the test's temporary directory and is stopped when
+// the test ends.
+func startTestPostgres(t *testing.T) string {
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("initdb not found on PATH")
+	}
+	postgres, err := exec.LookPath("postgres")
+	if err != nil {
+		t.Skip("postgres not found on PATH")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("postgres refuses to run as root")
+	}
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "-A", "trust", "--no-sync").CombinedOutput()
+	if err != nil {
+		t.Fatalf("initdb failed: %v\n%s", err, out)
+	}
+
+	cmd := exec.Command(postgres, "-D", dataDir, "-k", dir, "-h", "", "-F")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start postgres: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	})
+
+	dsn := fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", dir)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err := db.Ping()
+		if err == nil {
+			return dsn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("postgres did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
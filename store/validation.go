@@ -0,0 +1,101 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+func ValidateUsername(username string) error {
+	if len(username) < 4 || len(username) > 24 {
+		return errors.New("username must be between 4 and 24 characters long")
+	}
+
+	matched, err := regexp.MatchString(`^[a-z][a-z0-9_]*$`, username)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return errors.New("username must start with a letter and can only contain lowercase letters, digits, and underscores")
+	}
+
+	return nil
+}
+
+// ValidatePassword checks a new password against the hasher's policy.
+func (h *PasswordHasher) ValidatePassword(password string) error {
+	policy := h.policy
+
+	if len(password) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", policy.MinLength)
+	}
+	if policy.MaxLength > 0 && len(password) > policy.MaxLength {
+		return fmt.Errorf("password must be at most %d characters long", policy.MaxLength)
+	}
+
+	var hasUpper bool
+	var hasLower bool
+	var hasNumber bool
+	var hasSpecial bool
+
+	specialCharPattern := regexp.MustCompile(`[!@#$%^&*(),.?":{}|<>]`)
+
+	for _, char := range password {
+		switch {
+		case 'a' <= char && char <= 'z':
+			hasLower = true
+		case 'A' <= char && char <= 'Z':
+			hasUpper = true
+		case '0' <= char && char <= '9':
+			hasNumber = true
+		case specialCharPattern.MatchString(string(char)):
+			hasSpecial = true
+		}
+	}
+
+	if *policy.RequireUpper && !hasUpper {
+		return errors.New("password must contain at least one uppercase letter")
+	}
+	if *policy.RequireLower && !hasLower {
+		return errors.New("password must contain at least one lowercase letter")
+	}
+	if *policy.RequireDigit && !hasNumber {
+		return errors.New("password must contain at least one digit")
+	}
+	if *policy.RequireSpecial && !hasSpecial {
+		return errors.New("password must contain at least one special character")
+	}
+
+	return nil
+}
+
+// ValidateEmail accepts a bare address such as "user@example.com". Display
+// names and comments are rejected so the stored value is exactly what mail
+// is sent to.
+func ValidateEmail(email string) error {
+	if len(email) > 254 {
+		return errors.New("email address must be at most 254 characters long")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return errors.New("email address is not valid")
+	}
+
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return errors.New("email address must include a domain such as example.com")
+	}
+
+	return nil
+}
+
+// NormalizeEmail lowercases the address so uniqueness checks are not fooled
+// by case differences.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	testCases := []struct {
+		username string
+		isValid  bool
+	}{
+		{"validuser", true},
+		{"user123", true},
+		{"user_name", true},
+		{"user_name_", true},
+		{"username1234", true},
+		{"user", true},
+		{"1username", false},
+		{"user-name", false},
+		{"UserName", false},
+		{"user name", false},
+		{"us", false},
+		{"thisisaverylongusernameover24characters", false},
+		{"user@name", false},
+	}
+
+	mockPassword := "ValidP@ssw0rd"
+
+	for _, tc := range testCases {
+		_, err := CreateUserIfNotExists(context.Background(), db, testHasher, tc.username, mockPassword)
+		if (err == nil) != tc.isValid {
+			t.Errorf("Expected validity of username '%s' to be %v, got error: %v", tc.username, tc.isValid, err)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	testCases := []struct {
+		password string
+		isValid  bool
+	}{
+		{"P@ssw0rd", true},
+		{"password", false},
+		{"PASSWORD", false},
+		{"Passw0rd", false},
+		{"P@ssword", false},
+		{"P@ss1", false},
+		{"ValidP@ssword123", true},
+	}
+
+	for _, tc := range testCases {
+		err := testHasher.ValidatePassword(tc.password)
+		if (err == nil) != tc.isValid {
+			t.Errorf("Expected validity of password '%s' to be %v, got error: %v", tc.password, tc.isValid, err)
+		}
+	}
+}
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	optional := false
+	hasher := NewPasswordHasher(Argon2Config{}, PasswordPolicy{MinLength: 12, MaxLength: 16, RequireUpper: &optional,
+		RequireDigit: &optional, RequireSpecial: &optional})
+
+	testCases := []struct {
+		password string
+		isValid  bool
+	}{
+		{"P@ssw0rd", false},
+		{"correcthorse", true},
+		{"CORRECTHORSE", false},
+		{"correcthorsebattery", false},
+	}
+
+	for _, tc := range testCases {
+		err := hasher.ValidatePassword(tc.password)
+		if (err == nil) != tc.isValid {
+			t.Errorf("Expected validity of password '%s' to be %v, got error: %v", tc.password, tc.isValid, err)
+		}
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	testCases := []struct {
+		email   string
+		isValid bool
+	}{
+		{"user@example.com", true},
+		{"first.last+tag@mail.example.org", true},
+		{"user@localhost", false},
+		{"user@example.", false},
+		{"Some One <user@example.com>", false},
+		{"user.example.com", false},
+		{"user@@example.com", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		err := ValidateEmail(tc.email)
+		if (err == nil) != tc.isValid {
+			t.Errorf("Expected validity of email '%s' to be %v, got error: %v", tc.email, tc.isValid, err)
+		}
+	}
+}
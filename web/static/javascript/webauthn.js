@@ -0,0 +1,93 @@
+function base64urlToBuffer(value) {
+    var base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    while (base64.length % 4 !== 0) {
+        base64 += "=";
+    }
+    var binary = atob(base64);
+    var bytes = new Uint8Array(binary.length);
+    for (var i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes.buffer;
+}
+function bufferToBase64url(buffer) {
+    var bytes = new Uint8Array(buffer);
+    var binary = "";
+    for (var i = 0; i < bytes.length; i++) {
+        binary += String.fromCharCode(bytes[i]);
+    }
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+function csrfToken() {
+    var meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : "";
+}
+function postJSON(url, body) {
+    return fetch(url, {
+        method: "POST",
+        headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfToken() },
+        body: JSON.stringify(body || {})
+    }).then(function (response) {
+        return response.json().then(function (data) {
+            if (!response.ok) {
+                throw new Error(data.error || "Request failed");
+            }
+            return data;
+        });
+    });
+}
+function showWebAuthnError(error) {
+    var target = document.getElementById("webauthn-error");
+    if (target) {
+        target.textContent = error.message;
+    }
+}
+function registerPasskey() {
+    var nameInput = document.getElementById("passkey-name");
+    postJSON("/webauthn/register/begin").then(function (options) {
+        var publicKey = options.publicKey;
+        publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+        publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+        publicKey.excludeCredentials.forEach(function (credential) {
+            credential.id = base64urlToBuffer(credential.id);
+        });
+        return navigator.credentials.create({ publicKey: publicKey });
+    }).then(function (credential) {
+        return postJSON("/webauthn/register/finish", {
+            name: nameInput ? nameInput.value : "",
+            id: credential.id,
+            rawId: bufferToBase64url(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                attestationObject: bufferToBase64url(credential.response.attestationObject)
+            }
+        });
+    }).then(function () {
+        window.location.reload();
+    }).catch(showWebAuthnError);
+}
+function loginWithPasskey() {
+    postJSON("/webauthn/login/begin").then(function (options) {
+        var publicKey = options.publicKey;
+        publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+        publicKey.allowCredentials.forEach(function (credential) {
+            credential.id = base64urlToBuffer(credential.id);
+        });
+        return navigator.credentials.get({ publicKey: publicKey });
+    }).then(function (assertion) {
+        return postJSON("/webauthn/login/finish", {
+            id: assertion.id,
+            rawId: bufferToBase64url(assertion.rawId),
+            type: assertion.type,
+            response: {
+                clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+                authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+                signature: bufferToBase64url(assertion.response.signature),
+                userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null
+            }
+        });
+    }).then(function (result) {
+        window.location.href = result.redirect;
+    }).catch(showWebAuthnError);
+}
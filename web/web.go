@@ -0,0 +1,40 @@
+// Package web embeds the HTML templates the auth handlers render and the
+// stylesheets and scripts those pages link to, so a program that imports the
+// module does not need them on disk.
+package web
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/*.html
+var templates embed.FS
+
+//go:embed static
+var static embed.FS
+
+// Templates parses the embedded templates.
+func Templates() *template.Template {
+	return template.Must(template.ParseFS(templates, "templates/*.html"))
+}
+
+// Static returns the embedded files that belong under /static.
+func Static() http.FileSystem {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+// Mount loads the templates into engine and serves the static files under
+// /static. Call it before auth.Service.RegisterRoutes.
+func Mount(engine *gin.Engine) {
+	engine.SetHTMLTemplate(Templates())
+	engine.StaticFS("/static", Static())
+}
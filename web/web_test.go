@@ -0,0 +1,27 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	Mount(router)
+	router.GET("/login", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "login.html", gin.H{})
+	})
+
+	for _, path := range []string{"/login", "/static/css/login.css", "/static/javascript/webauthn.js"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("Expected %s to be served, got %d", path, w.Code)
+		}
+	}
+}